@@ -0,0 +1,106 @@
+// accesslog.go
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// --- Access Log ---
+
+const (
+	accessLogOff  = "off"
+	accessLogText = "text"
+	accessLogJSON = "json"
+)
+
+// accessLogFormat is how accessLogMiddleware writes each request: a plain
+// line through the standard logger, one JSON object per line on stderr, or
+// nothing.
+var accessLogFormat = accessLogText
+
+// accessLogger writes JSON access log lines without the standard logger's
+// timestamp prefix.
+var accessLogger = log.New(os.Stderr, "", 0)
+
+// statusRecorder captures the status code and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps streaming handlers that check for http.Flusher working.
+func (s *statusRecorder) Flush() {
+	http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// accessLogEntry is one request in the JSON access log.
+type accessLogEntry struct {
+	Time       string  `json:"time"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMs float64 `json:"duration_ms"`
+	Remote     string  `json:"remote"`
+}
+
+// accessLogMiddleware logs the method, path, status, response size and
+// duration of every request once it has been served. Streams are logged
+// when they end.
+func accessLogMiddleware(next http.Handler) http.Handler {
+	if accessLogFormat == accessLogOff {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		d := time.Since(start)
+
+		if accessLogFormat == accessLogJSON {
+			data, err := json.Marshal(accessLogEntry{
+				Time:       start.UTC().Format(time.RFC3339Nano),
+				Method:     r.Method,
+				Path:       r.URL.Path,
+				Status:     rec.status,
+				Bytes:      rec.bytes,
+				DurationMs: float64(d.Microseconds()) / 1000,
+				Remote:     r.RemoteAddr,
+			})
+			if err == nil {
+				accessLogger.Println(string(data))
+			}
+			return
+		}
+		log.Printf("%s %s %d %dB %s", r.Method, r.URL.Path, rec.status, rec.bytes, d.Round(time.Microsecond))
+	})
+}
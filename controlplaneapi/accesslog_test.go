@@ -0,0 +1,108 @@
+// accesslog_test.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogMiddleware(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		"/implicit": func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("hello")) },
+		"/missing":  func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) },
+		"/empty":    func(w http.ResponseWriter, r *http.Request) {},
+		"/twice": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+			w.WriteHeader(http.StatusInternalServerError)
+		},
+	}
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantBytes  int64
+	}{
+		{path: "/implicit", wantStatus: http.StatusOK, wantBytes: 5},
+		{path: "/missing", wantStatus: http.StatusNotFound, wantBytes: int64(len("404 page not found\n"))},
+		{path: "/empty", wantStatus: http.StatusOK},
+		{path: "/twice", wantStatus: http.StatusAccepted},
+	}
+
+	savedFormat, savedOutput := accessLogFormat, accessLogger.Writer()
+	t.Cleanup(func() {
+		accessLogFormat = savedFormat
+		accessLogger.SetOutput(savedOutput)
+		log.SetOutput(os.Stderr)
+	})
+	for _, format := range []string{accessLogText, accessLogJSON} {
+		for _, tt := range tests {
+			t.Run(format+tt.path, func(t *testing.T) {
+				var buf bytes.Buffer
+				accessLogFormat = format
+				accessLogger.SetOutput(&buf)
+				log.SetOutput(&buf)
+				accessLogMiddleware(handlers[tt.path]).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path+"?token=secret", nil))
+				line := buf.String()
+				if strings.Contains(line, "secret") {
+					t.Errorf("the query string was logged: %s", line)
+				}
+				if format == accessLogText {
+					if want := fmt.Sprintf("GET %s %d %dB ", tt.path, tt.wantStatus, tt.wantBytes); !strings.Contains(line, want) {
+						t.Errorf("got %q, want it to contain %q", line, want)
+					}
+					return
+				}
+				var entry accessLogEntry
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("%q isn't a JSON line: %v", line, err)
+				}
+				if entry.Method != http.MethodGet || entry.Path != tt.path || entry.Status != tt.wantStatus || entry.Bytes != tt.wantBytes {
+					t.Errorf("got %+v, want status %d and %d bytes", entry, tt.wantStatus, tt.wantBytes)
+				}
+			})
+		}
+	}
+}
+
+func TestAccessLogKeepsStreamsFlushable(t *testing.T) {
+	savedFormat, savedOutput := accessLogFormat, accessLogger.Writer()
+	t.Cleanup(func() {
+		accessLogFormat = savedFormat
+		accessLogger.SetOutput(savedOutput)
+	})
+	accessLogFormat = accessLogJSON
+	accessLogger.SetOutput(io.Discard)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("the wrapped writer isn't an http.Flusher, so SSE handlers would refuse to stream")
+		}
+		w.Write([]byte("data: x\n\n"))
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("Flush through the access log: %v", err)
+		}
+	})
+	rec := httptest.NewRecorder()
+	accessLogMiddleware(h).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dev/logs", nil))
+	if !rec.Flushed {
+		t.Error("the response wasn't flushed")
+	}
+}
+
+func TestAccessLogOff(t *testing.T) {
+	saved := accessLogFormat
+	t.Cleanup(func() { accessLogFormat = saved })
+	accessLogFormat = accessLogOff
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(*statusRecorder); ok {
+			t.Error("the handler was wrapped with the access log off")
+		}
+	})
+	accessLogMiddleware(h).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
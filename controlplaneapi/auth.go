@@ -0,0 +1,64 @@
+// auth.go
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// --- Authentication ---
+
+var (
+	// authProtectReads extends the token requirement to read-only endpoints
+	// (everything except /health, /healthz and /readyz).
+	authProtectReads bool
+)
+
+// requireAuth rejects requests without a valid bearer token when an auth token
+// is configured. It runs before the handler, so no file or process operation
+// happens for unauthenticated requests.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token := currentSettings().AuthToken; token != "" && !validBearerToken(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="control-plane"`)
+			httpError(w, "Missing or invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// readAuth protects a read-only endpoint only when authProtectReads is set.
+func readAuth(next http.HandlerFunc) http.HandlerFunc {
+	protected := requireAuth(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authProtectReads {
+			protected(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// validBearerToken compares the request's bearer token with want in constant
+// time. Hashing first keeps the comparison independent of length.
+func validBearerToken(r *http.Request, want string) bool {
+	header := r.Header.Get("Authorization")
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+	got := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	wantSum := sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(got[:], wantSum[:]) == 1
+}
+
+// redactSecret hides a configured secret while showing whether it is set.
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "[REDACTED]"
+}
@@ -0,0 +1,141 @@
+// autorestart.go
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// --- Auto-Restart On Crash ---
+
+var (
+	// autoRestart restarts the dev server when it exits without a stop.
+	autoRestart bool
+	// autoRestartMax is how many consecutive restarts are attempted before
+	// giving up.
+	autoRestartMax = 5
+	// autoRestartBackoff is the delay before the first restart; it doubles
+	// with each consecutive attempt up to autoRestartMaxBackoff.
+	autoRestartBackoff = time.Second
+)
+
+const (
+	autoRestartMaxBackoff = 30 * time.Second
+	// autoRestartStableAfter is how long a process must stay up for its exit
+	// to count as a fresh crash rather than another failed attempt.
+	autoRestartStableAfter = 30 * time.Second
+)
+
+var (
+	// autoRestartMu guards the auto-restart state below.
+	autoRestartMu sync.Mutex
+	// autoRestartOpts are the options of the last explicit start or restart.
+	autoRestartOpts devStartOptions
+	// autoRestartAttempts counts consecutive restarts since the dev server
+	// last stayed up.
+	autoRestartAttempts int
+	// autoRestartCount counts successful restarts since the last explicit
+	// start or restart.
+	autoRestartCount int
+	// autoRestartGaveUp is set once autoRestartMax attempts have failed.
+	autoRestartGaveUp bool
+)
+
+// resetAutoRestart records the options of an explicit start or restart for
+// later restarts and clears the counters. Callers must hold devOpMutex.
+func resetAutoRestart(opts devStartOptions) {
+	autoRestartMu.Lock()
+	defer autoRestartMu.Unlock()
+	// Restarts warm the default paths in the background and return without
+	// waiting for readiness, rather than repeating a request's prewarm and
+	// startup timeout.
+	opts.Prewarm = nil
+	opts.StartupTimeout = 0
+	autoRestartOpts = opts
+	autoRestartAttempts = 0
+	autoRestartCount = 0
+	autoRestartGaveUp = false
+}
+
+// autoRestartStatus is reported by /dev/status.
+func autoRestartStatus() map[string]interface{} {
+	autoRestartMu.Lock()
+	defer autoRestartMu.Unlock()
+	return map[string]interface{}{
+		"enabled":       autoRestart,
+		"restart_count": autoRestartCount,
+		"gave_up":       autoRestartGaveUp,
+	}
+}
+
+// handleUnexpectedExit is called by the supervisor when the dev server exits
+// without being stopped through the control plane.
+func handleUnexpectedExit(dp *devProcess) {
+	if !autoRestart || !devServerExpected.Load() {
+		return
+	}
+	autoRestartMu.Lock()
+	if time.Since(dp.startedAt) >= autoRestartStableAfter {
+		autoRestartAttempts = 0
+	}
+	autoRestartMu.Unlock()
+	scheduleAutoRestart()
+}
+
+// scheduleAutoRestart starts the dev server again after a backoff delay,
+// unless the attempts are used up.
+func scheduleAutoRestart() {
+	autoRestartMu.Lock()
+	if autoRestartAttempts >= autoRestartMax {
+		autoRestartGaveUp = true
+		autoRestartMu.Unlock()
+		log.Printf("Dev server auto-restart gave up after %d attempts", autoRestartMax)
+		logBroadcaster.Submit(fmt.Sprintf("--- Auto-restart gave up after %d attempts ---", autoRestartMax))
+		return
+	}
+	autoRestartAttempts++
+	attempt := autoRestartAttempts
+	autoRestartMu.Unlock()
+
+	delay := autoRestartBackoff << (attempt - 1)
+	if delay > autoRestartMaxBackoff || delay <= 0 {
+		delay = autoRestartMaxBackoff
+	}
+	log.Printf("Dev server exited unexpectedly; restarting in %s (attempt %d of %d)", delay, attempt, autoRestartMax)
+	logBroadcaster.Submit(fmt.Sprintf("--- Auto-restarting in %s (attempt %d of %d) ---", delay, attempt, autoRestartMax))
+	time.AfterFunc(delay, autoRestartDevServer)
+}
+
+// autoRestartDevServer performs a scheduled restart. It backs off if the dev
+// server was stopped or started by someone else in the meantime.
+func autoRestartDevServer() {
+	devOpMutex.Lock()
+	defer devOpMutex.Unlock()
+
+	if !devServerExpected.Load() {
+		log.Println("Auto-restart cancelled: dev server was stopped")
+		return
+	}
+	if pid, err := readPID(); err == nil && isProcessAlive(pid) {
+		log.Printf("Auto-restart skipped: dev server already running with PID %d", pid)
+		return
+	}
+
+	autoRestartMu.Lock()
+	opts := autoRestartOpts
+	autoRestartMu.Unlock()
+	pid, _, err := startDevServer(opts)
+	if err != nil {
+		log.Printf("Auto-restart failed: %v", err)
+		logBroadcaster.Submit(fmt.Sprintf("--- Auto-restart failed: %v ---", err))
+		scheduleAutoRestart()
+		return
+	}
+	autoRestartMu.Lock()
+	autoRestartCount++
+	autoRestartMu.Unlock()
+	devRestartsTotal.Add(1, "reason", "auto")
+	log.Printf("Dev server auto-restarted with PID %d", pid)
+}
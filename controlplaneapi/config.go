@@ -0,0 +1,295 @@
+// config.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// --- Config File (-config) ---
+
+// The config file is a JSON object keyed by flag name, with "_" accepted for
+// "-". A flag given on the command line wins, then the environment variable
+// it defaults to (when set), then the file, then the flag's default.
+
+// flagEnvVars are the environment variables flags default to.
+var flagEnvVars = map[string]string{
+	"auth-token":    "AUTH_TOKEN",
+	"dev-command":   "DEV_COMMAND",
+	"install-flags": "INSTALL_FLAGS",
+	"npm-registry":  "NPM_REGISTRY",
+	"prewarm-paths": "PREWARM_PATHS",
+}
+
+// commandLineFlags take a command line rather than a comma-separated list, so
+// a list value for them is quoted and joined with spaces.
+var commandLineFlags = map[string]bool{"dev-command": true, "install-flags": true}
+
+var (
+	// configFile is the config file read at startup and on SIGHUP; empty
+	// disables it.
+	configFile string
+	// explicitFlags are the flags given on the command line.
+	explicitFlags = map[string]bool{}
+	// startupConfig is the config file as applied at startup, so a reload can
+	// tell which changes need a restart.
+	startupConfig map[string]string
+)
+
+// applyConfigFile sets every flag the config file gives that the command line
+// and environment don't. It must run right after flag.Parse, before the
+// flags are validated.
+func applyConfigFile() error {
+	flag.Visit(func(f *flag.Flag) { explicitFlags[f.Name] = true })
+	if configFile == "" {
+		return nil
+	}
+	values, err := readConfigFile(configFile)
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedStringKeys(values) {
+		if overriddenFlag(name) {
+			log.Printf("%s: ignoring %s, which the command line or environment sets", configFile, name)
+			continue
+		}
+		if err := flag.Set(name, values[name]); err != nil {
+			return fmt.Errorf("%s: invalid value %q for %s: %w", configFile, values[name], name, err)
+		}
+	}
+	startupConfig = values
+	log.Printf("Loaded %d settings from %s", len(values), configFile)
+	return nil
+}
+
+// overriddenFlag reports whether the command line or environment gives name.
+func overriddenFlag(name string) bool {
+	if explicitFlags[name] {
+		return true
+	}
+	env, ok := flagEnvVars[name]
+	return ok && os.Getenv(env) != ""
+}
+
+// readConfigFile parses the config file into flag values by flag name,
+// rejecting keys that aren't flags.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if raw == nil {
+		return nil, fmt.Errorf("%s: must hold a JSON object", path)
+	}
+	keys := make([]string, 0, len(raw))
+	for k := range raw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	values := make(map[string]string, len(raw))
+	for _, key := range keys {
+		name := strings.ReplaceAll(key, "_", "-")
+		if name == "config" || flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s: unknown key %q", path, key)
+		}
+		if _, dup := values[name]; dup {
+			return nil, fmt.Errorf("%s: %s is given twice", path, name)
+		}
+		v, err := configValue(name, raw[key])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+		values[name] = v
+	}
+	return values, nil
+}
+
+// configValue converts a JSON value to the string flag.Set expects.
+func configValue(name string, v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return "", fmt.Errorf("list items must be strings")
+			}
+			if commandLineFlags[name] {
+				s = quoteArg(s)
+			}
+			items = append(items, s)
+		}
+		if commandLineFlags[name] {
+			return strings.Join(items, " "), nil
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("must be a string, number, boolean or list of strings")
+}
+
+// quoteArg single-quotes s for splitCommandLine when it needs it.
+func quoteArg(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n'\"\\") {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// --- Reloadable Settings (SIGHUP) ---
+
+// liveSettings are the settings a SIGHUP reloads. They are swapped as a
+// whole, so a request never sees old and new values mixed.
+type liveSettings struct {
+	// AllowedOrigins restricts CORS to these origins. Empty allows any origin.
+	AllowedOrigins map[string]bool
+	// AuthToken, when set, is required as a bearer token on mutating
+	// endpoints.
+	AuthToken string
+	// InstallFlags, when set, replaces the detected manager's default install
+	// flags (everything after "install").
+	InstallFlags []string
+}
+
+// liveFlags are the flags behind liveSettings.
+var liveFlags = []string{"allowed-origins", "auth-token", "install-flags"}
+
+// settings holds the current liveSettings; use currentSettings.
+var settings atomic.Pointer[liveSettings]
+
+func currentSettings() *liveSettings {
+	return settings.Load()
+}
+
+// newLiveSettings parses the flag values behind liveSettings.
+func newLiveSettings(origins, authToken, installFlags string) (*liveSettings, error) {
+	s := &liveSettings{AllowedOrigins: parseOrigins(origins), AuthToken: authToken}
+	if installFlags != "" {
+		argv, err := splitCommandLine(installFlags)
+		if err != nil {
+			return nil, fmt.Errorf("-install-flags %q: %w", installFlags, err)
+		}
+		s.InstallFlags = argv
+	}
+	return s, nil
+}
+
+// liveFlagValue is what a reload uses for one of liveFlags: the command
+// line's or environment's value when given, otherwise the config file's,
+// otherwise the default.
+func liveFlagValue(name string, file map[string]string) string {
+	f := flag.Lookup(name)
+	if overriddenFlag(name) {
+		return f.Value.String()
+	}
+	if v, ok := file[name]; ok {
+		return v
+	}
+	return f.DefValue
+}
+
+// reloadSettings re-reads the config file on SIGHUP, applies liveFlags and
+// logs what changed. On error the current settings are kept. The dev server
+// and open streams are left alone.
+func reloadSettings() {
+	var file map[string]string
+	if configFile != "" {
+		var err error
+		if file, err = readConfigFile(configFile); err != nil {
+			log.Printf("Config reload failed, keeping the current settings: %v", err)
+			return
+		}
+	}
+	next, err := newLiveSettings(liveFlagValue("allowed-origins", file), liveFlagValue("auth-token", file), liveFlagValue("install-flags", file))
+	if err != nil {
+		log.Printf("Config reload failed, keeping the current settings: %v", err)
+		return
+	}
+	changes := settingsChanges(settings.Swap(next), next)
+	if len(changes) == 0 {
+		log.Println("Config reloaded: no changes")
+	} else {
+		log.Printf("Config reloaded: %s", strings.Join(changes, "; "))
+	}
+	if pending := restartOnlyChanges(startupConfig, file); len(pending) > 0 {
+		log.Printf("Config file changes to %s only apply on restart", strings.Join(pending, ", "))
+	}
+}
+
+// settingsChanges describes how next differs from prev, without revealing the
+// auth token.
+func settingsChanges(prev, next *liveSettings) []string {
+	var changes []string
+	if a, b := sortedKeys(prev.AllowedOrigins), sortedKeys(next.AllowedOrigins); !slices.Equal(a, b) {
+		changes = append(changes, fmt.Sprintf("allowed origins %s -> %s", describeOrigins(a), describeOrigins(b)))
+	}
+	switch {
+	case prev.AuthToken == next.AuthToken:
+	case next.AuthToken == "":
+		changes = append(changes, "auth token removed, auth disabled")
+	case prev.AuthToken == "":
+		changes = append(changes, "auth token set, auth enabled")
+	default:
+		changes = append(changes, "auth token changed")
+	}
+	if !slices.Equal(prev.InstallFlags, next.InstallFlags) || (prev.InstallFlags == nil) != (next.InstallFlags == nil) {
+		changes = append(changes, fmt.Sprintf("install flags %s -> %s", describeInstallFlags(prev.InstallFlags), describeInstallFlags(next.InstallFlags)))
+	}
+	return changes
+}
+
+// restartOnlyChanges lists the flags other than liveFlags whose config file
+// value differs between prev and next.
+func restartOnlyChanges(prev, next map[string]string) []string {
+	var changed []string
+	seen := map[string]bool{}
+	for _, m := range []map[string]string{prev, next} {
+		for name := range m {
+			if seen[name] || slices.Contains(liveFlags, name) {
+				continue
+			}
+			seen[name] = true
+			a, inPrev := prev[name]
+			b, inNext := next[name]
+			if a != b || inPrev != inNext {
+				changed = append(changed, name)
+			}
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func describeOrigins(origins []string) string {
+	if len(origins) == 0 {
+		return "any"
+	}
+	return fmt.Sprintf("%q", origins)
+}
+
+func describeInstallFlags(flags []string) string {
+	if flags == nil {
+		return "defaults"
+	}
+	return fmt.Sprintf("%q", flags)
+}
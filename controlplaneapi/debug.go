@@ -0,0 +1,141 @@
+// debug.go
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// --- Debug Snapshot (for /debug/snapshot) ---
+
+// snapshotHandler returns everything useful for a bug report in one response.
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	pid, err := readPID()
+	running := err == nil && isProcessAlive(pid)
+
+	devServer := map[string]interface{}{
+		"running":  running,
+		"pid":      nil,
+		"expected": devServerExpected.Load(),
+	}
+	if running {
+		devServer["pid"] = pid
+	}
+	lastExitMu.Lock()
+	if lastExit != nil {
+		devServer["last_exit"] = *lastExit
+	}
+	lastExitMu.Unlock()
+
+	command := map[string]interface{}{
+		"package_manager": detectPackageManager(appDir).Name,
+	}
+	if dc, overridden, err := selectDevCommand(projectDir(), defaultAppPort, devCommandOverride); err != nil {
+		command["error"] = err.Error()
+	} else {
+		command["command"] = dc.Command
+		command["args"] = dc.Args
+		if overridden {
+			command["override"] = true
+		}
+	}
+
+	files, bytes, diskErr := appDirUsage()
+	disk := map[string]interface{}{
+		"files": files,
+		"bytes": bytes,
+	}
+	if diskErr != nil {
+		disk["error"] = diskErr.Error()
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"timestamp":      time.Now().UTC().Format(time.RFC3339),
+		"uptime_seconds": int64(time.Since(controlPlaneStartedAt).Seconds()),
+		"version":        version,
+		"config":         snapshotConfig(),
+		"dev_server":     devServer,
+		"dev_command":    command,
+		"disk":           disk,
+		"maintenance":    currentMaintenance(),
+		"metrics":        collectMetrics(),
+		"logs": map[string]interface{}{
+			"clients":     logBroadcaster.ClientCount(),
+			"error_lines": logBroadcaster.errorLines.Load(),
+		},
+	})
+}
+
+// snapshotConfig returns the effective configuration, with secrets redacted.
+func snapshotConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"listen_addr":         listenAddr,
+		"admin_listen_addr":   adminListenAddr,
+		"app_dir":             appDir,
+		"app_subdir":          appSubdir,
+		"default_app_port":    defaultAppPort,
+		"health_mode":         healthMode,
+		"readiness_check":     readinessCheck,
+		"readiness_path":      readinessPath,
+		"max_pull_bytes":      maxPullBytes,
+		"max_sync_bytes":      maxSyncBytes,
+		"max_sync_file_bytes": maxSyncFileBytes,
+		"max_file_read_bytes": maxFileReadBytes,
+		"stop_signal":         signalName(stopSignal),
+		"stop_sequence":       stopSequenceNames(),
+		"prewarm_paths":       defaultPrewarmPaths,
+		"allow_symlinks":      allowSymlinks,
+		"default_ignore":      defaultIgnore,
+		"allowed_origins":     sortedKeys(currentSettings().AllowedOrigins),
+		"auth_token":          redactSecret(currentSettings().AuthToken),
+		"install_flags":       currentSettings().InstallFlags,
+		"config_file":         configFile,
+		"auth_reads":          authProtectReads,
+	}
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// appDirUsage returns the number of files and total bytes under appDir,
+// excluding node_modules which would dominate (and slow down) the walk.
+func appDirUsage() (files int, bytes int64, err error) {
+	err = filepath.WalkDir(appDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == "node_modules" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil // Removed mid-walk.
+		}
+		files++
+		bytes += info.Size()
+		return nil
+	})
+	return files, bytes, err
+}
+
+// stopSequenceNames describes the effective stop steps, e.g. "SIGINT:3s".
+func stopSequenceNames() []string {
+	var names []string
+	for _, step := range stopSteps() {
+		names = append(names, step.String())
+	}
+	return names
+}
@@ -0,0 +1,89 @@
+// debug_test.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRedactsSecrets(t *testing.T) {
+	useAppDir(t)
+	useTestBroadcaster(t)
+	saved := currentSettings()
+	t.Cleanup(func() { settings.Store(saved) })
+	s, err := newLiveSettings("", "token-s3cret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.Store(s)
+
+	pid, _, err := startDevServer(devStartOptions{
+		Port:    freePort(t),
+		Command: []string{"sh", "-c", "while :; do sleep 0.05; done"},
+		Env:     map[string]string{"API_KEY": "env-s3cret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := ownedDevProcessDone(pid)
+	t.Cleanup(func() {
+		syscall.Kill(-pid, syscall.SIGKILL)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+		lastExitMu.Lock()
+		lastExit = nil
+		lastExitMu.Unlock()
+	})
+
+	rec := httptest.NewRecorder()
+	snapshotHandler(rec, httptest.NewRequest(http.MethodGet, "/debug/snapshot", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+	body := rec.Body.String()
+	for _, secret := range []string{"token-s3cret", "env-s3cret"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("the snapshot leaks %q: %s", secret, body)
+		}
+	}
+
+	var snapshot map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for k := range snapshot {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	want := "config,dev_command,dev_server,disk,logs,maintenance,metrics,timestamp,uptime_seconds,version"
+	if got := strings.Join(keys, ","); got != want {
+		t.Errorf("got keys %s, want %s", got, want)
+	}
+	var parts struct {
+		Config struct {
+			AuthToken string `json:"auth_token"`
+		} `json:"config"`
+		DevServer struct {
+			Running bool `json:"running"`
+			PID     int  `json:"pid"`
+		} `json:"dev_server"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &parts); err != nil {
+		t.Fatal(err)
+	}
+	if parts.Config.AuthToken != "[REDACTED]" {
+		t.Errorf("got auth_token %q", parts.Config.AuthToken)
+	}
+	if !parts.DevServer.Running || parts.DevServer.PID != pid {
+		t.Errorf("got dev_server %+v, want PID %d running", parts.DevServer, pid)
+	}
+}
@@ -0,0 +1,66 @@
+// diagnostics.go
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// --- Install Failure Diagnostics (for /dev/install) ---
+
+// installDiagnostic classifies a failed dependency install.
+type installDiagnostic struct {
+	// Category is a stable identifier, e.g. "peer_dependency_conflict".
+	Category string `json:"category"`
+	Hint     string `json:"hint"`
+	// Match is the output line that identified the failure.
+	Match string `json:"match,omitempty"`
+}
+
+// installFailureRules are checked in order; the first rule that matches any
+// output line wins. Patterns cover npm's error codes and their pnpm/yarn
+// equivalents.
+var installFailureRules = []struct {
+	category string
+	pattern  *regexp.Regexp
+	hint     string
+}{
+	{
+		category: "peer_dependency_conflict",
+		pattern:  regexp.MustCompile(`\bERESOLVE\b|ERR_PNPM_PEER_DEP_ISSUES|unable to resolve dependency tree`),
+		hint:     "Two packages require incompatible versions of a peer dependency. Align the versions in package.json, or pass --legacy-peer-deps to accept the conflict.",
+	},
+	{
+		category: "package_not_found",
+		pattern:  regexp.MustCompile(`\bE404\b|ERR_PNPM_FETCH_404|404 Not Found|is not in this registry`),
+		hint:     "A package or version in package.json doesn't exist in the registry. Check the name for typos and that the version has been published.",
+	},
+	{
+		category: "network",
+		pattern:  regexp.MustCompile(`\b(ENOTFOUND|EAI_AGAIN|ETIMEDOUT|ECONNREFUSED|ECONNRESET)\b`),
+		hint:     "The registry could not be reached. Check network access and any registry or proxy configuration, then retry.",
+	},
+	{
+		category: "permissions",
+		pattern:  regexp.MustCompile(`\b(EACCES|EPERM)\b`),
+		hint:     "The package manager couldn't write to a directory. Check ownership of the app directory, node_modules and the npm cache.",
+	},
+}
+
+// diagnoseInstallFailure inspects the output of a failed install and returns
+// a diagnostic for the first recognized failure mode, or nil.
+func diagnoseInstallFailure(output string) *installDiagnostic {
+	lines := strings.Split(output, "\n")
+	for _, rule := range installFailureRules {
+		for _, line := range lines {
+			if rule.pattern.MatchString(line) {
+				return &installDiagnostic{
+					Category: rule.category,
+					Hint:     rule.hint,
+					Match:    strings.TrimSpace(line),
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// diagnostics_test.go
+package main
+
+import "testing"
+
+func TestDiagnoseInstallFailure(t *testing.T) {
+	tests := []struct {
+		name         string
+		output       string
+		wantCategory string
+		wantMatch    string
+	}{
+		{
+			name:         "npm peer conflict",
+			output:       "npm ERR! code ERESOLVE\nnpm ERR! ERESOLVE unable to resolve dependency tree\n",
+			wantCategory: "peer_dependency_conflict",
+			wantMatch:    "npm ERR! code ERESOLVE",
+		},
+		{
+			name:         "pnpm peer issues",
+			output:       " ERR_PNPM_PEER_DEP_ISSUES  Unmet peer dependencies",
+			wantCategory: "peer_dependency_conflict",
+			wantMatch:    "ERR_PNPM_PEER_DEP_ISSUES  Unmet peer dependencies",
+		},
+		{
+			name:         "npm 404",
+			output:       "npm ERR! code E404\nnpm ERR! 404 Not Found - GET https://registry.npmjs.org/left-padd",
+			wantCategory: "package_not_found",
+			wantMatch:    "npm ERR! code E404",
+		},
+		{
+			name:         "yarn missing version",
+			output:       `error Couldn't find package "react@99" required by "app" on the "npm" registry. "react@99" is not in this registry.`,
+			wantCategory: "package_not_found",
+		},
+		{
+			name:         "offline",
+			output:       "npm ERR! code ENOTFOUND\nnpm ERR! network request to https://registry.npmjs.org failed",
+			wantCategory: "network",
+			wantMatch:    "npm ERR! code ENOTFOUND",
+		},
+		{
+			name:         "permissions",
+			output:       "npm ERR! code EACCES\nnpm ERR! syscall mkdir",
+			wantCategory: "permissions",
+		},
+		{
+			// Rules are tried in order, so an earlier rule wins even when
+			// a later one matches a line before it.
+			name:         "earlier rule wins",
+			output:       "npm ERR! code ECONNRESET\nnpm ERR! code E404",
+			wantCategory: "package_not_found",
+			wantMatch:    "npm ERR! code E404",
+		},
+		{
+			name:   "words merely containing a code",
+			output: "npm ERR! unknown failure in XEACCESS handling",
+		},
+		{
+			name:   "unrecognized",
+			output: "npm ERR! code ELIFECYCLE\nnpm ERR! errno 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := diagnoseInstallFailure(tt.output)
+			if tt.wantCategory == "" {
+				if d != nil {
+					t.Fatalf("got %+v, want no diagnostic", d)
+				}
+				return
+			}
+			if d == nil || d.Category != tt.wantCategory || d.Hint == "" {
+				t.Fatalf("got %+v, want category %q with a hint", d, tt.wantCategory)
+			}
+			if tt.wantMatch != "" && d.Match != tt.wantMatch {
+				t.Errorf("got match %q, want %q", d.Match, tt.wantMatch)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+// env.go
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// --- Dev Server Environment (request "env" and the app's .env file) ---
+
+var (
+	// envKeyRegex matches variable names that shells and Node accept.
+	envKeyRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	// secretEnvKeyRegex matches names whose values are redacted when logged
+	// or shown by /dev/env; -secret-env-pattern replaces it.
+	secretEnvKeyRegex = regexp.MustCompile(`(?i)secret|token|passw|key|credential|auth|cookie|session|private`)
+)
+
+// envFileName is the dotenv file in projectDir loaded into the dev server's
+// environment at each start; empty disables it.
+var envFileName = ".env"
+
+// reservedEnvKeys are set by the control plane for the dev server and can only
+// be replaced with override_port_host.
+var reservedEnvKeys = []string{"PORT", "HOST"}
+
+// validateDevEnv checks variables from a start/restart request.
+func validateDevEnv(env map[string]string, overridePortHost bool) error {
+	for k, v := range env {
+		if !envKeyRegex.MatchString(k) {
+			return fmt.Errorf("%q is not a valid variable name", k)
+		}
+		if strings.ContainsRune(v, 0) {
+			return fmt.Errorf("the value of %s contains a NUL byte", k)
+		}
+		if !overridePortHost && isReservedEnvKey(k) {
+			return fmt.Errorf("%s is set by the control plane; pass override_port_host to replace it", k)
+		}
+	}
+	return nil
+}
+
+func isReservedEnvKey(k string) bool {
+	for _, r := range reservedEnvKeys {
+		if k == r {
+			return true
+		}
+	}
+	return false
+}
+
+// devServerEnv returns the dev server's environment: the control plane's own,
+// then the framework's (from detection), the env file's, PORT and HOST, and
+// finally opts.Env, later entries replacing earlier ones.
+func devServerEnv(opts devStartOptions, frameworkEnv map[string]string) []string {
+	env := os.Environ()
+	for _, k := range sortedStringKeys(frameworkEnv) {
+		env = append(env, k+"="+frameworkEnv[k])
+	}
+	fileEnv := loadEnvFile()
+	for _, k := range sortedStringKeys(fileEnv) {
+		env = append(env, k+"="+fileEnv[k])
+	}
+	env = append(env, "PORT="+strconv.Itoa(opts.Port), "HOST=0.0.0.0")
+	for _, k := range sortedStringKeys(opts.Env) {
+		env = append(env, k+"="+opts.Env[k])
+	}
+	return env
+}
+
+// loadEnvFile reads projectDir's env file, if there is one. Invalid lines, and
+// PORT and HOST, are logged and skipped; values are never logged.
+func loadEnvFile() map[string]string {
+	if envFileName == "" {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(projectDir(), envFileName))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Failed to read %s: %v", envFileName, err)
+		}
+		return nil
+	}
+	defer f.Close()
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		k, v, ok, err := parseEnvLine(scanner.Text())
+		switch {
+		case err != nil:
+			log.Printf("%s:%d: skipping %v", envFileName, n, err)
+		case ok && isReservedEnvKey(k):
+			log.Printf("%s:%d: skipping %s, which the control plane sets", envFileName, n, k)
+		case ok:
+			vars[k] = v
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Failed to read %s: %v", envFileName, err)
+	}
+	log.Printf("Loaded %d variables from %s", len(vars), envFileName)
+	return vars
+}
+
+// parseEnvLine parses a dotenv line: KEY=value, optionally preceded by
+// "export". Values may be single-quoted (taken literally) or double-quoted
+// (with \n, \t, \" and \\ escapes); unquoted ones end at " #". It returns
+// false for blank lines and comments.
+func parseEnvLine(line string) (key, value string, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false, nil
+	}
+	line = strings.TrimPrefix(line, "export ")
+	key, value, found := strings.Cut(line, "=")
+	key = strings.TrimSpace(key)
+	if !found {
+		return "", "", false, fmt.Errorf("line without '='")
+	}
+	if !envKeyRegex.MatchString(key) {
+		return "", "", false, fmt.Errorf("%q is not a valid variable name", key)
+	}
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.HasPrefix(value, "'"):
+		end := strings.IndexByte(value[1:], '\'')
+		if end < 0 {
+			return "", "", false, fmt.Errorf("unterminated quote for %s", key)
+		}
+		return key, value[1 : 1+end], true, nil
+	case strings.HasPrefix(value, `"`):
+		var b strings.Builder
+		for i := 1; i < len(value); i++ {
+			c := value[i]
+			switch {
+			case c == '"':
+				return key, b.String(), true, nil
+			case c == '\\' && i+1 < len(value):
+				i++
+				switch value[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				case 'r':
+					b.WriteByte('\r')
+				default:
+					b.WriteByte(value[i])
+				}
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return "", "", false, fmt.Errorf("unterminated quote for %s", key)
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return key, value, true, nil
+}
+
+// redactedEnv formats vars for logging as KEY=value, with the values of
+// secret-looking keys replaced.
+func redactedEnv(vars map[string]string) string {
+	parts := make([]string, 0, len(vars))
+	for _, k := range sortedStringKeys(vars) {
+		v := vars[k]
+		if secretEnvKeyRegex.MatchString(k) {
+			v = "[redacted]"
+		}
+		parts = append(parts, k+"="+v)
+	}
+	return strings.Join(parts, " ")
+}
+
+// DevEnvResponse is the /dev/env result.
+type DevEnvResponse struct {
+	PID int `json:"pid"`
+	// Source is "start" for the environment recorded when this control plane
+	// started the dev server, or "proc" for one read from /proc after a
+	// control plane restart.
+	Source string            `json:"source"`
+	Env    map[string]string `json:"env"`
+	// Redacted lists the keys whose values were hidden.
+	Redacted []string `json:"redacted"`
+	Count    int      `json:"count"`
+}
+
+// devEnvHandler shows the environment the running dev server was started
+// with, the inherited, framework, env file, PORT/HOST and request variables
+// all merged, with the values of keys matching secretEnvKeyRegex redacted.
+func devEnvHandler(w http.ResponseWriter, r *http.Request) {
+	rec, err := readPIDFile()
+	if err != nil || !isProcessAlive(rec.PID) {
+		httpError(w, "Dev server not running", http.StatusConflict)
+		return
+	}
+	source := "start"
+	environ := ownedDevProcessEnv(rec.PID)
+	if environ == nil {
+		source = "proc"
+		if environ, err = processEnviron(rec.PID); err != nil {
+			httpError(w, fmt.Sprintf("Failed to read the dev server's environment: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	resp := DevEnvResponse{PID: rec.PID, Source: source, Env: make(map[string]string), Redacted: []string{}}
+	// As with exec, a later entry for a key replaces an earlier one.
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			resp.Env[k] = v
+		}
+	}
+	for _, k := range sortedStringKeys(resp.Env) {
+		if secretEnvKeyRegex.MatchString(k) {
+			resp.Env[k] = "[redacted]"
+			resp.Redacted = append(resp.Redacted, k)
+		}
+	}
+	resp.Count = len(resp.Env)
+	jsonResponse(w, http.StatusOK, resp)
+}
+
+func sortedStringKeys(vars map[string]string) []string {
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
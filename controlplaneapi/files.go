@@ -0,0 +1,196 @@
+// files.go
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// --- App Dir Listing (for /files) ---
+
+// FileEntry describes one regular file under appDir.
+type FileEntry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Mode    string    `json:"mode"`
+	// SHA256 is only set with ?hashes=true.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+type FilesResponse struct {
+	Files []FileEntry `json:"files"`
+	Count int         `json:"count"`
+	Bytes int64       `json:"bytes"`
+}
+
+// filesHandler lists every regular file under appDir, except ignored ones
+// and those matching the comma-separated patterns in ?ignore=, so a sync
+// client can diff against it.
+// ?hashes=true adds each file's sha256, which means reading every file.
+func filesHandler(w http.ResponseWriter, r *http.Request) {
+	hashes := false
+	if v := r.URL.Query().Get("hashes"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			httpError(w, "Query parameter 'hashes' must be a boolean", http.StatusBadRequest)
+			return
+		}
+		hashes = b
+	}
+	extra, err := parseIgnoreList(r.URL.Query().Get("ignore"))
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid query parameter 'ignore': %v", err), http.StatusBadRequest)
+		return
+	}
+	ignore := loadIgnore(extra)
+
+	resp := FilesResponse{Files: []FileEntry{}}
+	err = filepath.WalkDir(appDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p != appDir && errors.Is(err, fs.ErrNotExist) {
+				return nil // Removed while listing.
+			}
+			return err
+		}
+		if p == appDir {
+			return nil
+		}
+		rel, err := filepath.Rel(appDir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if ignore.Ignored(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Symlinks aren't followed, and only regular files can be synced.
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		entry := FileEntry{Path: rel, Size: info.Size(), ModTime: info.ModTime().UTC(), Mode: formatFileMode(info.Mode())}
+		if hashes {
+			if entry.SHA256, err = fileSHA256(p); errors.Is(err, fs.ErrNotExist) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+		resp.Files = append(resp.Files, entry)
+		resp.Bytes += entry.Size
+		return nil
+	})
+	if err != nil {
+		httpError(w, fmt.Sprintf("Failed to list files: %v", err), http.StatusInternalServerError)
+		return
+	}
+	resp.Count = len(resp.Files)
+	jsonResponse(w, http.StatusOK, resp)
+}
+
+// --- Single File Reads (for /files/read) ---
+
+// maxFileReadBytes caps the size of a file /files/read returns. Zero disables
+// the cap.
+var maxFileReadBytes int64 = 64 << 20
+
+// FileContentResponse is a /files/read result with ?encoding=base64.
+type FileContentResponse struct {
+	FileEntry
+	Content string `json:"content"`
+}
+
+// fileReadHandler returns the content of the file at ?path=, raw with a
+// Content-Type from its extension or content by default, or as JSON with
+// base64 content, its sha256 and metadata with ?encoding=base64.
+func fileReadHandler(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Query().Get("path")
+	if p == "" {
+		httpError(w, "Query parameter 'path' is required", http.StatusBadRequest)
+		return
+	}
+	encoding := r.URL.Query().Get("encoding")
+	if encoding != "" && encoding != "raw" && encoding != "base64" {
+		httpError(w, "Query parameter 'encoding' must be 'raw' or 'base64'", http.StatusBadRequest)
+		return
+	}
+
+	dest, err := resolveWithinAppDir(p)
+	if err == nil {
+		err = checkSymlinks(dest, true)
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	f, err := os.Open(dest)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			httpError(w, fmt.Sprintf("File not found: %s", p), http.StatusNotFound)
+			return
+		}
+		httpError(w, fmt.Sprintf("Failed to open file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		httpError(w, fmt.Sprintf("Failed to open file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if info.IsDir() {
+		httpError(w, "Path is a directory, not a file", http.StatusBadRequest)
+		return
+	}
+	if !info.Mode().IsRegular() {
+		httpError(w, "Path is not a regular file", http.StatusBadRequest)
+		return
+	}
+	if maxFileReadBytes > 0 && info.Size() > maxFileReadBytes {
+		httpError(w, fmt.Sprintf("File is %d bytes, more than the %d byte limit", info.Size(), maxFileReadBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if encoding != "base64" {
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+		return
+	}
+	// Read no more than was checked against the limit, in case it grew.
+	data, err := io.ReadAll(io.LimitReader(f, info.Size()))
+	if err != nil {
+		httpError(w, fmt.Sprintf("Failed to read file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	absAppDir, _ := filepath.Abs(appDir)
+	rel, _ := filepath.Rel(absAppDir, dest)
+	sum := sha256.Sum256(data)
+	jsonResponse(w, http.StatusOK, FileContentResponse{
+		FileEntry: FileEntry{
+			Path:    filepath.ToSlash(rel),
+			Size:    int64(len(data)),
+			ModTime: info.ModTime().UTC(),
+			Mode:    formatFileMode(info.Mode()),
+			SHA256:  hex.EncodeToString(sum[:]),
+		},
+		Content: base64.StdEncoding.EncodeToString(data),
+	})
+}
@@ -0,0 +1,216 @@
+// ignore.go
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// --- Ignore Rules (for /files, archive extraction and mirror syncs) ---
+
+var (
+	// ignoreFileName is the gitignore-syntax file in appDir whose rules are
+	// added to defaultIgnore.
+	ignoreFileName = ".syncignore"
+	// defaultIgnore holds the gitignore-syntax patterns applied before the
+	// ignore file, which can re-include them with "!".
+	defaultIgnore = []string{"node_modules", ".git"}
+)
+
+// ignoreRule is one gitignore pattern compiled to a regular expression over
+// slash-separated paths relative to appDir.
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreMatcher decides which paths under appDir are left alone.
+type ignoreMatcher struct {
+	rules []ignoreRule
+}
+
+// parseIgnoreRule compiles a gitignore pattern. It returns false for blank
+// lines and comments.
+func parseIgnoreRule(line string) (ignoreRule, bool, error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false, nil
+	}
+	var rule ignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:] // \# and \! escape a leading # or !.
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// A slash anywhere but at the end anchors the pattern to appDir;
+	// otherwise it matches at any depth.
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return ignoreRule{}, false, fmt.Errorf("empty pattern")
+	}
+
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case strings.HasPrefix(line[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(line[i:], "**") && i+2 == len(line):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(line[i+1:], ']')
+			if end < 0 {
+				return ignoreRule{}, false, fmt.Errorf("unterminated [ in %q", line)
+			}
+			class := line[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(line):
+			i++
+			b.WriteString(regexp.QuoteMeta(line[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return ignoreRule{}, false, fmt.Errorf("invalid pattern %q: %w", line, err)
+	}
+	rule.re = re
+	return rule, true, nil
+}
+
+// parseIgnoreList parses a comma-separated list of gitignore patterns.
+func parseIgnoreList(spec string) ([]ignoreRule, error) {
+	var rules []ignoreRule
+	for _, p := range strings.Split(spec, ",") {
+		rule, ok, err := parseIgnoreRule(strings.TrimSpace(p))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// loadIgnore returns defaultIgnore followed by the rules in appDir's ignore
+// file, if there is one, and then extra. Invalid lines in the file are
+// logged and skipped.
+func loadIgnore(extra []ignoreRule) *ignoreMatcher {
+	m := &ignoreMatcher{}
+	for _, p := range defaultIgnore {
+		if rule, ok, err := parseIgnoreRule(p); err == nil && ok {
+			m.rules = append(m.rules, rule)
+		}
+	}
+	f, err := os.Open(filepath.Join(appDir, ignoreFileName))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Failed to read %s: %v", ignoreFileName, err)
+		}
+	} else {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			rule, ok, err := parseIgnoreRule(scanner.Text())
+			if err != nil {
+				log.Printf("%s:%d: skipping %v", ignoreFileName, n, err)
+				continue
+			}
+			if ok {
+				m.rules = append(m.rules, rule)
+			}
+		}
+	}
+	m.rules = append(m.rules, extra...)
+	return m
+}
+
+// isProtected reports whether rel is always left alone whatever the rules say:
+// node_modules at any depth, and the control plane's own files (the pid file,
+// warm paths, logs, rotated ones included, and pull staging directories).
+func isProtected(rel string) bool {
+	for _, f := range []string{pidFile, warmPathsFile, runLogFile, logFilePath} {
+		name := filepath.Base(f)
+		if rel == name {
+			return true
+		}
+		if n, ok := strings.CutPrefix(rel, name+"."); ok {
+			if _, err := strconv.Atoi(n); err == nil {
+				return true
+			}
+		}
+	}
+	if strings.HasPrefix(rel, pullStagingPrefix) {
+		return true
+	}
+	for _, part := range strings.Split(rel, "/") {
+		if part == "node_modules" {
+			return true
+		}
+	}
+	return false
+}
+
+// matches applies the rules to rel alone; the last matching rule wins.
+func (m *ignoreMatcher) matches(rel string, isDir bool) bool {
+	ignored := false
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(rel) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// Ignored reports whether rel, a slash-separated path relative to appDir, or
+// one of its parent directories is ignored. As with git, a file can't be
+// re-included once its directory is ignored.
+func (m *ignoreMatcher) Ignored(rel string, isDir bool) bool {
+	rel = path.Clean(rel)
+	if isProtected(rel) {
+		return true
+	}
+	parts := strings.Split(rel, "/")
+	for i := 1; i < len(parts); i++ {
+		if m.matches(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return m.matches(rel, isDir)
+}
@@ -0,0 +1,303 @@
+// install.go
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// --- Dependency Install Tracking (for /dev/install/cancel) ---
+
+var (
+	// installMu serializes dependency installs, which would corrupt
+	// node_modules if two ran at once.
+	installMu sync.Mutex
+
+	activeInstallMu sync.Mutex
+	// activeInstall is the install command currently running, if any.
+	activeInstall *installRun
+)
+
+// installCancelGrace is how long a cancelled install gets to exit after
+// SIGTERM before its process group is killed.
+const installCancelGrace = 3 * time.Second
+
+// installRun is a running install command.
+type installRun struct {
+	cmd *exec.Cmd
+	// done is closed once the package manager has exited and been reaped.
+	done      chan struct{}
+	cancelled atomic.Bool
+	// before is restored by cancelInstall, which then closes restored.
+	before   *installSnapshot
+	restored chan struct{}
+}
+
+// installStateFiles are the files in node_modules where package managers
+// record a completed install. A cancelled install removes them, so the next
+// one doesn't take its partial node_modules for up to date.
+var installStateFiles = []string{".package-lock.json", ".yarn-integrity", ".yarn-state.yml", ".modules.yaml"}
+
+// installSnapshot is the state of dir an install may leave half-written: its
+// lockfiles and whether node_modules existed.
+type installSnapshot struct {
+	dir string
+	// lockfiles maps each lockfile name to its content, nil if it was absent.
+	lockfiles      map[string][]byte
+	hadNodeModules bool
+}
+
+func snapshotInstall(dir string) *installSnapshot {
+	s := &installSnapshot{dir: dir, lockfiles: make(map[string][]byte)}
+	for _, pm := range packageManagers {
+		for _, name := range pm.Lockfiles {
+			data, _ := os.ReadFile(filepath.Join(dir, name))
+			s.lockfiles[name] = data
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dir, "node_modules")); err == nil && info.IsDir() {
+		s.hadNodeModules = true
+	}
+	return s
+}
+
+// restore undoes what a cancelled install left behind: lockfiles get their
+// old content back, and node_modules is removed if the install created it,
+// or else loses its install state files.
+func (s *installSnapshot) restore() {
+	for name, old := range s.lockfiles {
+		p := filepath.Join(s.dir, name)
+		current, readErr := os.ReadFile(p)
+		var err error
+		if old == nil && readErr == nil {
+			err = os.Remove(p)
+		} else if old != nil && !bytes.Equal(current, old) {
+			err = os.WriteFile(p, old, 0644)
+		}
+		if err != nil {
+			log.Printf("Failed to restore %s after cancelling the install: %v", p, err)
+		}
+	}
+	nodeModules := filepath.Join(s.dir, "node_modules")
+	if !s.hadNodeModules {
+		if err := os.RemoveAll(nodeModules); err != nil {
+			log.Printf("Failed to remove the partial %s: %v", nodeModules, err)
+		}
+		return
+	}
+	for _, name := range installStateFiles {
+		if err := os.Remove(filepath.Join(nodeModules, name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove %s after cancelling the install: %v", name, err)
+		}
+	}
+}
+
+// runInstallCommand runs a package manager install in appDir in its own
+// process group, streaming its output, so that installCancelHandler can stop
+// it along with any lifecycle scripts it spawned. cancelled reports whether it
+// was stopped that way, in which case it returns once the install's partial
+// changes have been undone.
+func runInstallCommand(command string, args []string) (out commandOutput, cancelled bool, err error) {
+	return runInstallCommandIn(appDir, command, args)
+}
+
+// runInstallCommandIn is runInstallCommand in dir.
+func runInstallCommandIn(dir, command string, args []string) (out commandOutput, cancelled bool, err error) {
+	cmd := exec.Command(command, args...)
+	cmd.Dir = dir
+	cmd.Env = installEnv()
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	run := &installRun{cmd: cmd, done: make(chan struct{}), before: snapshotInstall(dir), restored: make(chan struct{})}
+	defer func() {
+		activeInstallMu.Lock()
+		if activeInstall == run {
+			activeInstall = nil
+		}
+		activeInstallMu.Unlock()
+	}()
+
+	out, err = streamCommandOutput(cmd, func() {
+		activeInstallMu.Lock()
+		activeInstall = run
+		activeInstallMu.Unlock()
+	})
+	close(run.done)
+	if run.cancelled.Load() {
+		// Hold on to installMu until cancelInstall has cleaned up, so the
+		// next install doesn't start on a half-restored app dir.
+		<-run.restored
+		return out, true, err
+	}
+	return out, false, err
+}
+
+// runDependencyInstall installs dependencies in dir with pm, adding
+// extraArgs. With npm it runs `npm ci` when npmCIApplies, falling back to
+// `npm install` if ci refuses the lockfile as out of sync with package.json.
+func runDependencyInstall(dir string, pm packageManager, extraArgs []string) (out commandOutput, cancelled bool, err error) {
+	start := time.Now()
+	defer func() { observeInstall(time.Since(start), cancelled, err) }()
+	args := append(pm.installArgs(), extraArgs...)
+	if pm.Name != npmManager.Name || !useNpmCI || !npmCIApplies(dir) {
+		return runInstallCommandIn(dir, pm.Name, args)
+	}
+
+	ciArgs := append([]string{"ci"}, args[1:]...)
+	out, cancelled, err = runInstallCommandIn(dir, pm.Name, ciArgs)
+	if err == nil || cancelled || !npmLockfileDriftRegex.MatchString(out.Stderr+"\n"+out.Stdout) {
+		return out, cancelled, err
+	}
+	log.Println("npm ci failed because package-lock.json is out of sync with package.json; falling back to npm install")
+	logBroadcaster.Submit("--- package-lock.json is out of sync; falling back to npm install ---")
+	return runInstallCommandIn(dir, pm.Name, args)
+}
+
+// cancelInstall stops the running install, if any, and waits for it to exit.
+// It reports whether there was one to cancel.
+func cancelInstall() bool {
+	activeInstallMu.Lock()
+	run := activeInstall
+	activeInstallMu.Unlock()
+	if run == nil {
+		return false
+	}
+
+	pid := run.cmd.Process.Pid
+	run.cancelled.Store(true)
+	log.Printf("Cancelling install (PID %d)", pid)
+	logBroadcaster.Submit(fmt.Sprintf("--- Cancelling install (PID %d) ---", pid))
+	syscall.Kill(-pid, syscall.SIGTERM)
+	select {
+	case <-run.done:
+	case <-time.After(installCancelGrace):
+		log.Printf("Install (PID %d) did not exit within %s, sending SIGKILL", pid, installCancelGrace)
+		syscall.Kill(-pid, syscall.SIGKILL)
+		select {
+		case <-run.done:
+		case <-time.After(killTimeout):
+			log.Printf("Install (PID %d) still running %s after SIGKILL", pid, killTimeout)
+		}
+	}
+	// Lifecycle scripts that ignored SIGTERM may outlive the package
+	// manager, keeping its process group. Once the package manager has been
+	// reaped, a live process with its pid means the pid, and so possibly the
+	// group id, was reused, and the group is left alone.
+	exited := false
+	select {
+	case <-run.done:
+		exited = true
+	default:
+	}
+	if !exited || !processExists(pid) {
+		syscall.Kill(-pid, syscall.SIGKILL)
+	} else {
+		log.Printf("PID %d was reused after the install exited; not killing its process group", pid)
+	}
+	run.before.restore()
+	close(run.restored)
+	logBroadcaster.Submit("--- Install cancelled; lockfiles restored and partial install state removed ---")
+	return true
+}
+
+// installCancelHandler stops a running /dev/install. Its response reports
+// whether an install was actually cancelled.
+func installCancelHandler(w http.ResponseWriter, r *http.Request) {
+	cancelled := cancelInstall()
+	message := "No install is running"
+	if cancelled {
+		message = "Install cancelled"
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"success":   true,
+		"cancelled": cancelled,
+		"message":   message,
+	})
+}
+
+// --- Reconciliation Debouncing ---
+
+// reconcileDebounce is the quiet period after a package.json change before
+// dependencies are reconciled, so bursts of syncs share one install. Zero
+// reconciles immediately.
+var reconcileDebounce = 500 * time.Millisecond
+
+// reconcileBatch is one reconciliation shared by the syncs that asked for it
+// before it started.
+type reconcileBatch struct {
+	dir      string
+	timer    *time.Timer
+	done     chan struct{}
+	messages []string
+	errs     []string
+}
+
+var (
+	reconcileMu sync.Mutex
+	// pendingReconcile holds, for each install dir, the batch waiting out its
+	// quiet period, if any.
+	pendingReconcile = map[string]*reconcileBatch{}
+)
+
+// requestReconcile reconciles dependencies in dir once no other request for
+// it has arrived for reconcileDebounce, and returns that run's results. A
+// request made while a run is already under way waits for the next one, which
+// starts after it, so the final install always sees the latest package.json.
+func requestReconcile(dir string) (messages []string, errs []string) {
+	if reconcileDebounce <= 0 {
+		return reconcileDependencies(dir)
+	}
+	reconcileMu.Lock()
+	batch := pendingReconcile[dir]
+	if batch == nil {
+		batch = &reconcileBatch{dir: dir, done: make(chan struct{})}
+		pendingReconcile[dir] = batch
+		batch.timer = time.AfterFunc(reconcileDebounce, func() { runReconcileBatch(batch) })
+	} else {
+		log.Printf("Dependency reconciliation already pending; delaying it %s", reconcileDebounce)
+		batch.timer.Reset(reconcileDebounce)
+	}
+	reconcileMu.Unlock()
+
+	<-batch.done
+	return batch.messages, batch.errs
+}
+
+// requestReconciles reconciles each of dirs in turn, the app dir first, and
+// returns all their results.
+func requestReconciles(dirs map[string]bool) (messages []string, errs []string) {
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Strings(sorted)
+	for _, dir := range sorted {
+		m, e := requestReconcile(dir)
+		messages = append(messages, m...)
+		errs = append(errs, e...)
+	}
+	return messages, errs
+}
+
+func runReconcileBatch(batch *reconcileBatch) {
+	reconcileMu.Lock()
+	if pendingReconcile[batch.dir] != batch {
+		// The timer was reset just as it fired, and the batch already ran.
+		reconcileMu.Unlock()
+		return
+	}
+	delete(pendingReconcile, batch.dir)
+	reconcileMu.Unlock()
+
+	batch.messages, batch.errs = reconcileDependencies(batch.dir)
+	close(batch.done)
+}
@@ -0,0 +1,211 @@
+// install_test.go
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startFakeInstall runs script as the install command and waits for it to
+// register as the active install. The returned channel yields whether it
+// reported being cancelled.
+func startFakeInstall(t *testing.T, dir, script string) <-chan bool {
+	t.Helper()
+	result := make(chan bool, 1)
+	go func() {
+		_, cancelled, _ := runInstallCommand("sh", []string{"-c", script})
+		result <- cancelled
+	}()
+	waitFor(t, "the install to start", func() bool {
+		activeInstallMu.Lock()
+		defer activeInstallMu.Unlock()
+		return activeInstall != nil
+	})
+	waitFor(t, "the install to write its files", func() bool {
+		_, err := os.Stat(filepath.Join(dir, "started"))
+		return err == nil
+	})
+	return result
+}
+
+func TestCancelInstallRestoresState(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, dir string)
+		check func(t *testing.T, dir string)
+	}{
+		{
+			name: "fresh install",
+			check: func(t *testing.T, dir string) {
+				for _, rel := range []string{"node_modules", "package-lock.json"} {
+					if _, err := os.Stat(filepath.Join(dir, rel)); !os.IsNotExist(err) {
+						t.Errorf("%s is left after cancelling an install that created it", rel)
+					}
+				}
+			},
+		},
+		{
+			name: "existing install",
+			setup: func(t *testing.T, dir string) {
+				writeTestFile(t, dir, "package-lock.json", "old lock")
+				writeTestFile(t, dir, "node_modules/react/index.js", "react")
+			},
+			check: func(t *testing.T, dir string) {
+				if got := readTestFile(t, dir, "package-lock.json"); got != "old lock" {
+					t.Errorf("package-lock.json: got %q, want it restored", got)
+				}
+				if got := readTestFile(t, dir, "node_modules/react/index.js"); got != "react" {
+					t.Errorf("existing package was touched: %q", got)
+				}
+				if _, err := os.Stat(filepath.Join(dir, "node_modules", ".package-lock.json")); !os.IsNotExist(err) {
+					t.Error("node_modules/.package-lock.json is left, so the next install would trust the partial tree")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := useAppDir(t)
+			if tt.setup != nil {
+				tt.setup(t, dir)
+			}
+			result := startFakeInstall(t, dir, `mkdir -p node_modules/left-pad &&
+				echo partial > package-lock.json && echo partial > node_modules/.package-lock.json &&
+				touch started && sleep 30`)
+			if !cancelInstall() {
+				t.Fatal("cancelInstall found no install")
+			}
+			if !<-result {
+				t.Error("the install didn't report being cancelled")
+			}
+			os.Remove(filepath.Join(dir, "started"))
+			tt.check(t, dir)
+		})
+	}
+}
+
+func TestCancelInstallKillsSurvivingScripts(t *testing.T) {
+	dir := useAppDir(t)
+	// A lifecycle script that ignores SIGTERM outlives the package manager,
+	// which exits on it.
+	result := startFakeInstall(t, dir, `sh -c 'trap "" TERM; echo $$ > child.pid; while :; do sleep 0.1; done' >/dev/null 2>&1 &
+		while [ ! -s child.pid ]; do sleep 0.01; done; touch started; wait`)
+	data, err := os.ReadFile(filepath.Join(dir, "child.pid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var childPID int
+	if _, err := fmt.Sscan(string(data), &childPID); err != nil {
+		t.Fatal(err)
+	}
+	cancelInstall()
+	<-result
+	waitFor(t, "the surviving script to be killed", func() bool { return !processExists(childPID) })
+}
+
+// useFakeNpm puts an npm first on PATH that runs script, and live settings in
+// place for installArgs.
+func useFakeNpm(t *testing.T, script string) {
+	t.Helper()
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "npm"), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	saved := currentSettings()
+	t.Cleanup(func() { settings.Store(saved) })
+	s, err := newLiveSettings("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.Store(s)
+}
+
+func TestInstallsDontOverlap(t *testing.T) {
+	dir := useAppDir(t)
+	savedDebounce := reconcileDebounce
+	t.Cleanup(func() { reconcileDebounce = savedDebounce })
+	reconcileDebounce = 0
+	writeTestFile(t, dir, "package.json", "{}")
+	// Each run notes whether another was still going when it started.
+	useFakeNpm(t, `if [ -e running ]; then echo "$*" >> overlaps; fi
+touch running; echo "$*" >> runs; sleep 0.1; rm running`)
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, errs := reconcileDependencies(dir); len(errs) > 0 {
+				t.Errorf("reconcile failed: %v", errs)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			dependenciesInstallHandler(rec, httptest.NewRequest(http.MethodPost, "/dev/install", nil))
+			codes <- rec.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		// /dev/install refuses to queue behind a running install.
+		if code != http.StatusOK && code != http.StatusConflict {
+			t.Errorf("/dev/install got %d", code)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "overlaps")); err == nil {
+		t.Errorf("installs overlapped: %s", data)
+	}
+	// Each reconcile installs and prunes.
+	if runs := strings.Count(readTestFile(t, dir, "runs"), "prune"); runs != 3 {
+		t.Errorf("got %d reconciles, want all 3 to wait their turn", runs)
+	}
+}
+
+func TestRapidSyncsShareOneReconcile(t *testing.T) {
+	dir := useAppDir(t)
+	useTestBroadcaster(t)
+	saved := reconcileDebounce
+	t.Cleanup(func() { reconcileDebounce = saved })
+	reconcileDebounce = 300 * time.Millisecond
+	// Each install records the package.json it saw.
+	useFakeNpm(t, `if [ "$1" = install ]; then cat package.json >> installs; echo >> installs; fi`)
+
+	const syncs = 3
+	codes := make(chan int, syncs)
+	var last string
+	for i := 1; i <= syncs; i++ {
+		last = fmt.Sprintf(`{"dependencies": {"left-pad": "1.%d.0"}}`, i)
+		body := fmt.Sprintf(`{"files": {"package.json": %q}}`, base64.StdEncoding.EncodeToString([]byte(last)))
+		go func() {
+			rec := httptest.NewRecorder()
+			syncHandler(rec, httptest.NewRequest(http.MethodPost, "/sync", strings.NewReader(body)))
+			codes <- rec.Code
+		}()
+		// Sent one at a time, each within the quiet period of the last.
+		waitFor(t, "the sync to be written", func() bool {
+			data, _ := os.ReadFile(filepath.Join(dir, "package.json"))
+			return string(data) == last
+		})
+		time.Sleep(50 * time.Millisecond)
+	}
+	for i := 0; i < syncs; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("got %d from a sync", code)
+		}
+	}
+	if got := readTestFile(t, dir, "installs"); got != last+"\n" {
+		t.Errorf("got installs:\n%s\nwant one, of the last package.json", got)
+	}
+}
@@ -0,0 +1,273 @@
+// logfile.go
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Rotating Log File ---
+
+var (
+	// logFilePath receives every broadcast line, across dev server runs and
+	// control plane restarts. Rotated files are logFilePath.1 (newest) up to
+	// logFilePath.<logFileKeep>.
+	logFilePath = "/app/applet/.dev.log"
+	// logFileMaxBytes rotates the file once it grows past this size. Zero
+	// disables size-based rotation.
+	logFileMaxBytes int64 = 10 << 20
+	// logFileMaxAge rotates the file once it has been open this long. Zero
+	// disables time-based rotation.
+	logFileMaxAge = 24 * time.Hour
+	// logFileKeep is how many rotated files are kept.
+	logFileKeep = 5
+)
+
+// logFileQueueSize is how many lines may wait for the writer before new ones
+// are dropped rather than blocking the broadcaster.
+const logFileQueueSize = 4096
+
+// logFileFlushInterval bounds how long a line sits in the write buffer.
+const logFileFlushInterval = time.Second
+
+// persistentLog is the rotating log file; nil when disabled.
+var persistentLog *rotatingLog
+
+// rotatingLog writes lines to a file from a single goroutine, which is also
+// the only one to rotate the file, so rotation can't race with writes. It
+// backs both persistentLog and runLogs.
+type rotatingLog struct {
+	path string
+	// maxBytes and maxAge rotate the file once it grows past that size or
+	// has been open that long; zero disables each. keep is how many rotated
+	// files are kept.
+	maxBytes int64
+	maxAge   time.Duration
+	keep     int
+
+	lines    chan string
+	truncate chan chan struct{}
+	rotateCh chan chan struct{}
+	flushCh  chan chan struct{}
+	quit     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+	// dropped counts lines not queued since the writer last caught up.
+	dropped atomic.Int64
+
+	// The fields below are owned by the run goroutine.
+	f        *os.File
+	w        *bufio.Writer
+	size     int64
+	openedAt time.Time
+}
+
+// startRotatingLog opens path for appending and starts its writer.
+func startRotatingLog(path string, maxBytes int64, maxAge time.Duration, keep int) *rotatingLog {
+	l := &rotatingLog{
+		path:     path,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		keep:     keep,
+		lines:    make(chan string, logFileQueueSize),
+		truncate: make(chan chan struct{}),
+		rotateCh: make(chan chan struct{}),
+		flushCh:  make(chan chan struct{}),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	l.open()
+	go l.run()
+	return l
+}
+
+// Write queues a line without blocking. If the writer has fallen behind, the
+// line is dropped and counted; the count is written to the file when it
+// catches up.
+func (l *rotatingLog) Write(line string) {
+	select {
+	case l.lines <- line:
+	default:
+		select {
+		case l.lines <- "": // Wake the writer to record the drop.
+		default:
+		}
+		l.dropped.Add(1)
+	}
+}
+
+// Truncate empties the file, discarding queued lines, and returns once done.
+// Rotated files are kept.
+func (l *rotatingLog) Truncate() {
+	l.request(l.truncate)
+}
+
+// Rotate writes the queued lines, then starts a new file, and returns once
+// done.
+func (l *rotatingLog) Rotate() {
+	l.request(l.rotateCh)
+}
+
+// Flush writes the queued lines out to the file and returns once done.
+func (l *rotatingLog) Flush() {
+	l.request(l.flushCh)
+}
+
+// request asks the writer to do something and waits for it, unless the
+// writer has stopped.
+func (l *rotatingLog) request(ch chan chan struct{}) {
+	done := make(chan struct{})
+	select {
+	case ch <- done:
+		<-done
+	case <-l.done:
+	}
+}
+
+// Close writes the queued lines and closes the file. Lines written after
+// Close are dropped.
+func (l *rotatingLog) Close() {
+	l.once.Do(func() { close(l.quit) })
+	<-l.done
+}
+
+func (l *rotatingLog) run() {
+	defer close(l.done)
+	flush := time.NewTicker(logFileFlushInterval)
+	defer flush.Stop()
+	for {
+		select {
+		case line := <-l.lines:
+			l.writeLine(line)
+		case done := <-l.truncate:
+			l.truncateFile()
+			close(done)
+		case done := <-l.rotateCh:
+			l.writeQueued()
+			l.rotate()
+			close(done)
+		case done := <-l.flushCh:
+			l.writeQueued()
+			if l.w != nil {
+				l.w.Flush()
+			}
+			close(done)
+		case <-l.quit:
+			l.writeQueued()
+			l.closeFile()
+			return
+		case <-flush.C:
+			if l.w != nil {
+				l.w.Flush()
+			}
+			if l.maxAge > 0 && l.f != nil && time.Since(l.openedAt) >= l.maxAge {
+				l.rotate()
+			}
+		}
+	}
+}
+
+// writeQueued writes the lines queued so far.
+func (l *rotatingLog) writeQueued() {
+	for {
+		select {
+		case line := <-l.lines:
+			l.writeLine(line)
+		default:
+			return
+		}
+	}
+}
+
+func (l *rotatingLog) writeLine(line string) {
+	if n := l.dropped.Swap(0); n > 0 {
+		l.writeLine(fmt.Sprintf("%s STDERR ...[%d lines dropped: log file writer fell behind]\n", formatLogTime(time.Now()), n))
+	}
+	if line == "" {
+		return
+	}
+	if l.f == nil {
+		return
+	}
+	if l.maxBytes > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxBytes {
+		l.rotate()
+		if l.f == nil {
+			return
+		}
+	}
+	n, err := l.w.WriteString(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("Failed to write %s, disabling it: %v", l.path, err)
+		l.closeFile()
+	}
+}
+
+// open opens the file for appending. Its age counts from now.
+func (l *rotatingLog) open() {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("Logs won't be saved to %s: %v", l.path, err)
+		return
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		log.Printf("Logs won't be saved to %s: %v", l.path, err)
+		return
+	}
+	l.f, l.w, l.size, l.openedAt = f, bufio.NewWriter(f), info.Size(), time.Now()
+}
+
+func (l *rotatingLog) truncateFile() {
+drain:
+	for {
+		select {
+		case <-l.lines:
+		default:
+			break drain
+		}
+	}
+	l.dropped.Store(0)
+	if l.f == nil {
+		return
+	}
+	l.w.Reset(l.f)
+	if err := l.f.Truncate(0); err != nil {
+		log.Printf("Failed to clear %s: %v", l.path, err)
+		return
+	}
+	l.size = 0
+}
+
+func (l *rotatingLog) closeFile() {
+	if l.f == nil {
+		return
+	}
+	l.w.Flush()
+	l.f.Close()
+	l.f, l.w = nil, nil
+}
+
+// rotate shifts path.N to .N+1, dropping files beyond keep, and starts a new
+// file at path.
+func (l *rotatingLog) rotate() {
+	l.closeFile()
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.keep))
+	for i := l.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if l.keep > 0 {
+		if err := os.Rename(l.path, l.path+".1"); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to rotate %s: %v", l.path, err)
+		}
+	} else {
+		os.Remove(l.path)
+	}
+	l.open()
+}
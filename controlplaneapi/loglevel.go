@@ -0,0 +1,154 @@
+// loglevel.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// --- Log Severity Classification ---
+
+// logLevel is the severity of a log line, ordered from least to most severe.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+// parseLogLevel parses a level name such as "warn" or "warning".
+func parseLogLevel(name string) (logLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug", "trace":
+		return levelDebug, nil
+	case "info":
+		return levelInfo, nil
+	case "warn", "warning":
+		return levelWarn, nil
+	case "error", "err", "fatal":
+		return levelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q: must be one of debug, info, warn, error", name)
+}
+
+var (
+	// Explicit level markers at the start of a line, e.g. "[WARN]", "npm ERR!", "error:".
+	leadingLevelRegex = regexp.MustCompile(`(?i)^\s*(?:npm\s+)?[\[(]?(debug|trace|verbose|info|warn|warning|error|err!?|fatal)[\])]?(?::|\s|$)`)
+	// Structured key/value markers, e.g. level=error or "level":"warn".
+	keyedLevelRegex = regexp.MustCompile(`(?i)"?\blevel"?\s*[=:]\s*"?(debug|trace|verbose|info|warn|warning|error|err|fatal)\b`)
+	errorRegex      = regexp.MustCompile(`(?i)\b(?:error|exception|unhandled|panic|uncaught|traceback)\b|\b(?:failed to|failed with|build failed|compilation failed)\b`)
+	// namedErrorRegex matches exception class names like TypeError or SyntaxError.
+	namedErrorRegex = regexp.MustCompile(`\b[A-Z]\w*Error\b`)
+	// zeroErrorsRegex matches success summaries like "0 errors" that would otherwise look like errors.
+	zeroErrorsRegex = regexp.MustCompile(`(?i)\b(?:0|no) (?:errors?|failures?)\b`)
+	warnRegex       = regexp.MustCompile(`(?i)\b(?:warn|warning|deprecated|deprecation)\b`)
+)
+
+// classifyLogLine returns the severity of a log line, using explicit level
+// markers first, then common error/warning phrasing, then the output stream.
+func classifyLogLine(text string, isStderr bool) logLevel {
+	for _, re := range []*regexp.Regexp{leadingLevelRegex, keyedLevelRegex} {
+		if m := re.FindStringSubmatch(text); m != nil {
+			if level, ok := explicitLevel(m[1]); ok {
+				return level
+			}
+		}
+	}
+	if (errorRegex.MatchString(text) || namedErrorRegex.MatchString(text)) && !zeroErrorsRegex.MatchString(text) {
+		return levelError
+	}
+	if warnRegex.MatchString(text) {
+		return levelWarn
+	}
+	if isStderr {
+		return levelWarn
+	}
+	return levelInfo
+}
+
+// explicitLevel maps a matched level marker to a logLevel.
+func explicitLevel(marker string) (logLevel, bool) {
+	marker = strings.TrimSuffix(strings.ToLower(marker), "!")
+	if marker == "verbose" {
+		return levelDebug, true
+	}
+	level, err := parseLogLevel(marker)
+	return level, err == nil
+}
+
+// messageLevel returns the severity of a broadcast message, preferring the
+// level field of structured lines.
+func messageLevel(msg BroadcastMessage, structured json.RawMessage) logLevel {
+	if level, ok := structuredLogLevel(structured); ok {
+		return level
+	}
+	return classifyLogLine(msg.Text, msg.IsStderr)
+}
+
+// structuredLogLine returns the line as raw JSON if it is a JSON object, or
+// nil for ordinary text.
+func structuredLogLine(text string) json.RawMessage {
+	trimmed := bytes.TrimSpace([]byte(text))
+	if len(trimmed) < 2 || trimmed[0] != '{' || !json.Valid(trimmed) {
+		return nil
+	}
+	return json.RawMessage(trimmed)
+}
+
+// structuredLogLevel extracts the level from a structured log line. It
+// understands string levels ("warn") and pino's numeric levels (40).
+func structuredLogLevel(raw json.RawMessage) (logLevel, bool) {
+	if raw == nil {
+		return 0, false
+	}
+	var fields struct {
+		Level    json.RawMessage `json:"level"`
+		Severity json.RawMessage `json:"severity"`
+	}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return 0, false
+	}
+	value := fields.Level
+	if value == nil {
+		value = fields.Severity
+	}
+	if value == nil {
+		return 0, false
+	}
+
+	var name string
+	if err := json.Unmarshal(value, &name); err == nil {
+		level, ok := explicitLevel(name)
+		return level, ok
+	}
+	var number float64
+	if err := json.Unmarshal(value, &number); err == nil {
+		switch {
+		case number >= 50:
+			return levelError, true
+		case number >= 40:
+			return levelWarn, true
+		case number >= 30:
+			return levelInfo, true
+		default:
+			return levelDebug, true
+		}
+	}
+	return 0, false
+}
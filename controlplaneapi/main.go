@@ -3,25 +3,37 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"maps"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
 // --- Configuration ---
@@ -29,7 +41,69 @@ var (
 	listenAddr     = ":8000"
 	appDir         = "/app/applet"
 	pidFile        = "/app/applet/.dev.pid"
+	warmPathsFile  = "/app/applet/.dev.warm-paths.json"
 	defaultAppPort = 3000
+	// adminListenAddr, when set, serves the health probes and the metrics endpoints on a
+	// second server, and the metrics endpoints leave the main one.
+	adminListenAddr = ""
+	// appSubdir is the app's directory within appDir, for monorepos: where
+	// package.json is read and the dev server and scripts run. Syncs, path
+	// checks and dependency installs stay rooted at appDir.
+	appSubdir = ""
+	// healthMode controls whether /health depends on the dev server: "plain"
+	// always reports healthy, "dev" reports unhealthy when the dev server
+	// should be running but isn't.
+	healthMode = healthModePlain
+	// readinessCheck is what /readyz requires of the dev server: "http" that
+	// its process is alive and answers readinessPath, "process" only that its
+	// process is alive.
+	readinessCheck = readinessHTTP
+	// readinessPath is the dev server path /readyz probes with "http".
+	readinessPath = "/"
+	// devCommandOverride, when set, is used instead of resolveDevCommand.
+	devCommandOverride []string
+	// collapseProgress keeps only the latest carriage-return progress update
+	// in the log history instead of every intermediate frame.
+	collapseProgress bool
+	// allowSymlinks lets /sync write and delete through symlinks that stay
+	// inside appDir. Symlinks leading outside are always refused.
+	allowSymlinks = true
+	// maxLogLineBytes caps the length of a line sent to /dev/logs clients;
+	// longer lines are truncated. Zero disables the cap.
+	maxLogLineBytes = 16 << 10
+	// logHeartbeatInterval is how long a /dev/logs stream may stay idle
+	// before a heartbeat comment is sent. Zero disables heartbeats.
+	logHeartbeatInterval = 15 * time.Second
+	// stopSignal is sent to the dev server's process group first on stop,
+	// before escalating to SIGKILL.
+	stopSignal = syscall.SIGTERM
+	// stopGracePeriod is how long the dev server gets to exit after
+	// stopSignal before it is sent SIGKILL.
+	stopGracePeriod = 5 * time.Second
+	// prewarmConcurrency caps how many paths are warmed at once.
+	prewarmConcurrency = 4
+	// stopSequence, when set, replaces stopSignal and stopGracePeriod with
+	// several signals tried in turn before SIGKILL.
+	stopSequence []stopStep
+	// startupTimeout, when positive, makes start and restart wait this long
+	// for the dev server to become ready, failing if it exits first.
+	startupTimeout time.Duration
+	// reclaimPort lets a start kill a leftover process from the app dir that
+	// holds the dev server's port, instead of failing.
+	reclaimPort bool
+	// startAtBoot starts the dev server once the control plane is up, unless
+	// one was recovered from a previous instance.
+	startAtBoot bool
+)
+
+const (
+	healthModePlain = "plain"
+	healthModeDev   = "dev"
+)
+
+const (
+	readinessHTTP    = "http"
+	readinessProcess = "process"
 )
 
 // --- State Management ---
@@ -38,43 +112,281 @@ var (
 	devOpMutex sync.Mutex
 	// logBroadcaster handles streaming dev server logs to connected clients.
 	logBroadcaster = newBroadcaster()
+	// devProcMu guards devProc.
+	devProcMu sync.Mutex
+	// devProc is the dev server started by this control plane instance, if any.
+	devProc *devProcess
+	// devServerExpected is true when the dev server was started and has not
+	// been explicitly stopped since.
+	devServerExpected atomic.Bool
+	// controlPlaneStartedAt is when this control plane process started.
+	controlPlaneStartedAt = time.Now()
+	// version is the control plane build, set with
+	// -ldflags "-X main.version=...".
+	version = "dev"
+	// lastExitMu guards lastExit.
+	lastExitMu sync.Mutex
+	// lastExit records how the most recent dev server process exited.
+	lastExit *devExitInfo
+	// shutdownStarted is closed when the control plane begins shutting down,
+	// ending long-lived streams.
+	shutdownStarted = make(chan struct{})
 )
 
+// defaultLogHistorySize is how many recent log lines are replayed to new /dev/logs clients.
+const defaultLogHistorySize = 500
+
 // --- Main Application ---
 func main() {
 	flag.StringVar(&listenAddr, "listen-addr", ":8000", "The address to listen on")
+	flag.StringVar(&adminListenAddr, "admin-listen-addr", "", "Serve /health, /healthz, /readyz, /metrics and /metrics/stream on this separate address, and no longer serve the metrics endpoints on -listen-addr (empty disables)")
 	flag.StringVar(&appDir, "app-dir", "/app/applet", "The directory of the application")
+	flag.StringVar(&appSubdir, "app-subdir", "", "Directory within -app-dir holding the app's package.json, e.g. packages/web in a monorepo; the dev server and scripts run there, while syncs and installs use -app-dir")
 	flag.IntVar(&defaultAppPort, "default-app-port", 3000, "The default port for the application")
+	flag.Int64Var(&maxPullBytes, "max-pull-bytes", 512<<20, "Maximum size in bytes of a project pulled via /sync/pull or uploaded to /sync/archive")
+	flag.DurationVar(&pullTimeout, "pull-timeout", 5*time.Minute, "How long a /sync/pull git clone or archive download may take before it is abandoned")
+	flag.Int64Var(&maxSyncBytes, "max-sync-bytes", 256<<20, "Maximum size in bytes of a /sync request body (0 disables)")
+	flag.IntVar(&syncConcurrency, "sync-concurrency", 8, "Maximum number of file writes and deletes a /sync runs at once")
+	flag.Int64Var(&maxSyncFileBytes, "max-sync-file-bytes", 64<<20, "Maximum decoded size in bytes of each file written or patched by /sync (0 disables)")
+	flag.StringVar(&healthMode, "health-mode", healthModePlain, "Health check mode: 'plain' (always healthy) or 'dev' (unhealthy if the dev server should be running but isn't)")
+	flag.StringVar(&readinessCheck, "readiness-check", readinessHTTP, "What /readyz requires of the dev server: 'http' (its process is alive and -readiness-path answers 2xx or 404) or 'process' (its process is alive)")
+	flag.StringVar(&readinessPath, "readiness-path", "/", "Dev server path /readyz requests with -readiness-check=http")
+	flag.DurationVar(&defaultMetricsStreamInterval, "metrics-stream-interval", 5*time.Second, "Default interval between /metrics/stream snapshots")
+	authTokenSpec := flag.String("auth-token", os.Getenv("AUTH_TOKEN"), "Bearer token required on mutating endpoints (defaults to $AUTH_TOKEN; empty disables auth)")
+	flag.BoolVar(&authProtectReads, "auth-protect-reads", false, "Also require the auth token on read-only endpoints (except /health, /healthz and /readyz)")
+	flag.StringVar(&accessLogFormat, "access-log", accessLogText, "Log every request's method, path, status, response size and duration: 'text', 'json' (one object per line on stderr) or 'off'")
+	flag.BoolVar(&collapseProgress, "collapse-progress", false, "Keep only the latest carriage-return progress update in the log history replayed to new /dev/logs clients")
+	flag.BoolVar(&allowSymlinks, "allow-symlinks", true, "Allow /sync and /sync/pull to write and delete through symlinks that stay inside the app dir (symlinks leaving it are always refused)")
+	flag.DurationVar(&logHeartbeatInterval, "log-heartbeat-interval", 15*time.Second, "Send an SSE heartbeat comment on /dev/logs after this long without log lines (0 disables)")
+	logFile := flag.Bool("log-file", true, "Save all log lines to .dev.log in the app dir, rotated by size and age")
+	flag.Int64Var(&logFileMaxBytes, "log-file-max-bytes", 10<<20, "Rotate .dev.log once it exceeds this many bytes (0 disables size rotation)")
+	flag.DurationVar(&logFileMaxAge, "log-file-max-age", 24*time.Hour, "Rotate .dev.log once it has been open this long (0 disables time rotation)")
+	flag.IntVar(&logFileKeep, "log-file-keep", 5, "Number of rotated .dev.log.N files to keep")
+	flag.IntVar(&maxLogLineBytes, "max-log-line-bytes", 16<<10, "Truncate log lines longer than this many bytes before streaming them to /dev/logs clients (0 disables); stdout/stderr still get the full line")
+	flag.BoolVar(&autoRestart, "auto-restart", false, "Restart the dev server with exponential backoff when it exits without /dev/stop")
+	flag.IntVar(&autoRestartMax, "auto-restart-max", 5, "Maximum consecutive auto-restart attempts before giving up")
+	flag.DurationVar(&autoRestartBackoff, "auto-restart-backoff", time.Second, "Delay before the first auto-restart; doubles per consecutive attempt up to 30s")
+	origins := flag.String("allowed-origins", "", "Comma-separated list of origins allowed by CORS (default: any origin)")
+	logHistorySize := flag.Int("log-history-size", defaultLogHistorySize, "Number of recent log lines replayed to newly connected /dev/logs clients (0 disables)")
+	flag.DurationVar(&startupTimeout, "startup-timeout", 0, "Make start and restart wait up to this long for the dev server to become ready, and fail with its output if it exits first (0 returns as soon as it is spawned); overridable per request with startup_timeout_seconds")
+	flag.BoolVar(&startAtBoot, "start-dev-server", false, "Start the dev server once the control plane is listening, as POST /dev/start with no body would, unless one recovered from a previous control plane is running")
+	flag.BoolVar(&reclaimPort, "reclaim-port", false, "When a process running in the app dir, such as a dev server orphaned by a crash, holds the app port at start, kill it instead of failing; overridable per request with reclaim_port")
+	flag.DurationVar(&stopGracePeriod, "stop-grace-period", 5*time.Second, "How long the dev server gets to exit after the stop signal before SIGKILL; overridable per request with grace_period_seconds")
+	stopSequenceSpec := flag.String("stop-sequence", "", "Signals sent to the dev server's process group on stop, each with how long to wait for it, before SIGKILL (e.g. SIGINT:3s,SIGTERM:5s); overrides -stop-signal and -stop-grace-period")
+	stopSignalName := flag.String("stop-signal", "SIGTERM", "Signal sent to the dev server's process group on stop, before SIGKILL (e.g. SIGTERM, SIGINT)")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 10*time.Second, "Maximum time to read request headers (0 disables)")
+	readTimeout := flag.Duration("read-timeout", 5*time.Minute, "Maximum time to read a whole request, including the body (0 disables)")
+	writeTimeout := flag.Duration("write-timeout", 15*time.Minute, "Maximum time to write a response; streaming endpoints are exempt (0 disables)")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "Maximum time an idle keep-alive connection is kept open (0 disables)")
+	readyPatternSpec := flag.String("ready-pattern", defaultReadyPattern, "Regular expression matched against dev server output to detect readiness before HTTP polling succeeds (empty disables)")
+	flag.IntVar(&prewarmConcurrency, "prewarm-concurrency", 4, "Maximum number of paths warmed at once, unless a request sets its own")
+	prewarmPaths := flag.String("prewarm-paths", os.Getenv("PREWARM_PATHS"), "Comma-separated paths warmed on start/restart when the request gives none, e.g. \"/,/api/health\" (defaults to $PREWARM_PATHS)")
+	devCommand := flag.String("dev-command", os.Getenv("DEV_COMMAND"), "Override the detected dev command (defaults to $DEV_COMMAND)")
+	installFlagsSpec := flag.String("install-flags", os.Getenv("INSTALL_FLAGS"), "Flags passed to npm, pnpm or yarn's install instead of its defaults (bun keeps its own), e.g. \"--no-audit --legacy-peer-deps\" (defaults to $INSTALL_FLAGS)")
+	flag.DurationVar(&reconcileDebounce, "reconcile-debounce", 500*time.Millisecond, "Wait this long after a sync changes package.json, restarting the wait on each further change, before reconciling dependencies once for all of them (0 disables)")
+	flag.BoolVar(&useNpmCI, "npm-ci", true, "Install with npm ci when package-lock.json exists and node_modules is missing or older than it, falling back to npm install if the lockfile is out of sync")
+	flag.Int64Var(&maxFileReadBytes, "max-file-read-bytes", 64<<20, "Maximum size in bytes of a file returned by /files/read (0 disables)")
+	secretEnvPattern := flag.String("secret-env-pattern", secretEnvKeyRegex.String(), "Regular expression matched against variable names whose values are redacted in logs and /dev/env")
+	flag.StringVar(&envFileName, "env-file", envFileName, "Dotenv file in the app dir whose variables are added to the dev server's environment at each start (empty disables)")
+	defaultIgnoreSpec := flag.String("default-ignore", strings.Join(defaultIgnore, ","), "Comma-separated gitignore-style patterns left out of /files and archive extraction, before the rules in the app dir's .syncignore (node_modules and the control plane's own files are always left out)")
+	flag.StringVar(&installRegistry, "npm-registry", os.Getenv("NPM_REGISTRY"), "Registry URL dependency installs fetch packages from (defaults to $NPM_REGISTRY; empty uses the package manager's configuration)")
+	flag.StringVar(&configFile, "config", "", "JSON file setting any of these flags by name, e.g. {\"app-dir\": \"/srv/app\", \"allowed_origins\": [\"https://example.com\"]}; the command line and environment variables take precedence, and allowed-origins, auth-token and install-flags are re-read on SIGHUP")
 	flag.Parse()
 
+	if err := applyConfigFile(); err != nil {
+		log.Fatalf("Invalid -config: %v", err)
+	}
+	s, err := newLiveSettings(*origins, *authTokenSpec, *installFlagsSpec)
+	if err != nil {
+		log.Fatalf("Invalid %v", err)
+	}
+	settings.Store(s)
+	if s.InstallFlags != nil {
+		log.Printf("Install flags configured: %q", s.InstallFlags)
+	}
+
+	if defaultMetricsStreamInterval <= 0 {
+		log.Fatalf("Invalid -metrics-stream-interval %s: must be positive", defaultMetricsStreamInterval)
+	}
+	if pullTimeout <= 0 {
+		log.Fatalf("Invalid -pull-timeout %s: must be positive", pullTimeout)
+	}
+	for name, d := range map[string]time.Duration{
+		"read-header-timeout":    *readHeaderTimeout,
+		"read-timeout":           *readTimeout,
+		"write-timeout":          *writeTimeout,
+		"idle-timeout":           *idleTimeout,
+		"log-heartbeat-interval": logHeartbeatInterval,
+		"reconcile-debounce":     reconcileDebounce,
+	} {
+		if d < 0 {
+			log.Fatalf("Invalid -%s %s: must not be negative", name, d)
+		}
+	}
+	if stopGracePeriod < 0 || stopGracePeriod > maxStopGracePeriod {
+		log.Fatalf("Invalid -stop-grace-period %s: must be between 0 and %s", stopGracePeriod, maxStopGracePeriod)
+	}
+	if *readyPatternSpec == "" {
+		readyPattern = nil
+	} else {
+		re, err := regexp.Compile(*readyPatternSpec)
+		if err != nil {
+			log.Fatalf("Invalid -ready-pattern: %v", err)
+		}
+		readyPattern = re
+	}
+	re, err := regexp.Compile(*secretEnvPattern)
+	if err != nil {
+		log.Fatalf("Invalid -secret-env-pattern: %v", err)
+	}
+	secretEnvKeyRegex = re
+	if logFileMaxBytes < 0 || logFileMaxAge < 0 || logFileKeep < 0 {
+		log.Fatalf("Invalid log file settings: -log-file-max-bytes, -log-file-max-age and -log-file-keep must not be negative")
+	}
+	if maxSyncBytes < 0 || maxSyncFileBytes < 0 {
+		log.Fatalf("Invalid sync limits: -max-sync-bytes and -max-sync-file-bytes must not be negative")
+	}
+	if maxFileReadBytes < 0 {
+		log.Fatalf("Invalid -max-file-read-bytes %d: must not be negative", maxFileReadBytes)
+	}
+	if syncConcurrency < 1 {
+		log.Fatalf("Invalid -sync-concurrency %d: must be at least 1", syncConcurrency)
+	}
+	if prewarmConcurrency < 1 {
+		log.Fatalf("Invalid -prewarm-concurrency %d: must be at least 1", prewarmConcurrency)
+	}
+	if autoRestartMax < 0 || autoRestartBackoff <= 0 {
+		log.Fatalf("Invalid auto-restart settings: -auto-restart-max must not be negative and -auto-restart-backoff must be positive")
+	}
+	if *logHistorySize < 0 {
+		log.Fatalf("Invalid -log-history-size %d: must not be negative", *logHistorySize)
+	}
+	logBroadcaster.SetHistorySize(*logHistorySize)
+
+	sig, err := parseSignal(*stopSignalName)
+	if err != nil {
+		log.Fatalf("Invalid -stop-signal: %v", err)
+	}
+	stopSignal = sig
+	if stopSequence, err = parseStopSequence(*stopSequenceSpec); err != nil {
+		log.Fatalf("Invalid -stop-sequence: %v", err)
+	}
+
+	if defaultPrewarmPaths, err = parsePrewarmPaths(*prewarmPaths); err != nil {
+		log.Fatalf("Invalid -prewarm-paths: %v", err)
+	}
+
+	if *devCommand != "" {
+		argv, err := splitCommandLine(*devCommand)
+		if err != nil || len(argv) == 0 {
+			log.Fatalf("Invalid -dev-command %q: %v", *devCommand, err)
+		}
+		devCommandOverride = argv
+		log.Printf("Dev command override configured: %q", argv)
+	}
+
+	if installRegistry != "" {
+		u, err := url.Parse(installRegistry)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("Invalid -npm-registry: must be an http or https URL")
+		}
+		log.Printf("Install registry configured: %s", u.Redacted())
+	}
+
+	if _, err := parseIgnoreList(*defaultIgnoreSpec); err != nil {
+		log.Fatalf("Invalid -default-ignore: %v", err)
+	}
+	defaultIgnore = nil
+	for _, p := range strings.Split(*defaultIgnoreSpec, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			defaultIgnore = append(defaultIgnore, p)
+		}
+	}
+
+	if appSubdir != "" {
+		if !filepath.IsLocal(appSubdir) {
+			log.Fatalf("Invalid -app-subdir %q: must be a relative path within -app-dir", appSubdir)
+		}
+		if appSubdir = filepath.Clean(appSubdir); appSubdir == "." {
+			appSubdir = ""
+		}
+	}
+
+	if adminListenAddr != "" && adminListenAddr == listenAddr {
+		log.Fatalf("Invalid -admin-listen-addr %q: must differ from -listen-addr", adminListenAddr)
+	}
+
+	switch accessLogFormat {
+	case accessLogOff, accessLogText, accessLogJSON:
+	default:
+		log.Fatalf("Invalid -access-log %q: must be %q, %q or %q", accessLogFormat, accessLogText, accessLogJSON, accessLogOff)
+	}
+
+	if healthMode != healthModePlain && healthMode != healthModeDev {
+		log.Fatalf("Invalid -health-mode %q: must be %q or %q", healthMode, healthModePlain, healthModeDev)
+	}
+	if readinessCheck != readinessHTTP && readinessCheck != readinessProcess {
+		log.Fatalf("Invalid -readiness-check %q: must be %q or %q", readinessCheck, readinessHTTP, readinessProcess)
+	}
+	if !strings.HasPrefix(readinessPath, "/") {
+		log.Fatalf("Invalid -readiness-path %q: must start with '/'", readinessPath)
+	}
+
 	pidFile = filepath.Join(appDir, ".dev.pid")
+	warmPathsFile = filepath.Join(appDir, ".dev.warm-paths.json")
+	runLogFile = filepath.Join(appDir, ".dev.run.log")
+	runLogs = startRotatingLog(runLogFile, 0, 0, 1)
+	if *logFile {
+		logFilePath = filepath.Join(appDir, ".dev.log")
+		persistentLog = startRotatingLog(logFilePath, logFileMaxBytes, logFileMaxAge, logFileKeep)
+	}
+	recoverDevServer()
+	removeStaleStaging()
 
 	// Start the log broadcaster in a separate goroutine.
 	go logBroadcaster.run()
 
-	// Register all HTTP handlers.
-	mux := http.NewServeMux()
-	mux.HandleFunc("/sync", syncHandler)
-	mux.HandleFunc("/fs/read", fsReadHandler)
-	mux.HandleFunc("/fs/list", fsListHandler)
-	mux.HandleFunc("/dev/install", dependenciesInstallHandler)
-	mux.HandleFunc("/dev/status", statusHandler)
-	mux.HandleFunc("/dev/start", startHandler)
-	mux.HandleFunc("/dev/stop", stopHandler)
-	mux.HandleFunc("/dev/restart", restartHandler)
-	mux.HandleFunc("/dev/logs", logsHandler)
-	mux.HandleFunc("/health", healthHandler)
-
-	server := &http.Server{
-		Addr:    listenAddr,
-		Handler: corsMiddleware(mux),
-	}
-
-	// Run server in a goroutine so it doesn't block.
+	mux, adminMux := newMuxes()
+
+	newServer := func(addr string, mux *http.ServeMux) *http.Server {
+		return &http.Server{
+			Addr:              addr,
+			Handler:           accessLogMiddleware(corsMiddleware(mux)),
+			ReadHeaderTimeout: *readHeaderTimeout,
+			ReadTimeout:       *readTimeout,
+			WriteTimeout:      *writeTimeout,
+			IdleTimeout:       *idleTimeout,
+		}
+	}
+	servers := []*http.Server{newServer(listenAddr, mux)}
+	if adminListenAddr != "" {
+		servers = append(servers, newServer(adminListenAddr, adminMux))
+	}
+
+	// Run servers in goroutines so they don't block.
+	for i, server := range servers {
+		name := "Control Plane API"
+		if i > 0 {
+			name = "Admin server"
+		}
+		go func() {
+			log.Printf("%s listening on %s", name, server.Addr)
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatalf("%s error: %v", name, err)
+			}
+		}()
+	}
+	if startAtBoot {
+		go startDevServerAtBoot()
+	}
+
+	// SIGHUP reloads the live settings; the dev server keeps running.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		log.Printf("Control Plane API listening on %s", listenAddr)
-		if err := server.ListenAndServe(); err != http.ErrServerClosed {
-			log.Fatalf("HTTP server error: %v", err)
+		for range hup {
+			log.Println("Received SIGHUP, reloading configuration...")
+			reloadSettings()
 		}
 	}()
 
@@ -90,875 +402,4264 @@ func main() {
 	// Ensure the dev server is stopped cleanly on shutdown.
 	if pid, err := readPID(); err == nil && isProcessAlive(pid) {
 		log.Println("Stopping dev server during shutdown...")
-		stopDevServer()
+		devServerExpected.Store(false)
+		stopDevServer(stopSteps())
 	}
 
-	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+	// Release the log and metrics streams first: Shutdown waits for every
+	// active request, and they would otherwise run until ctx expires.
+	if n := logBroadcaster.Shutdown(); n > 0 {
+		log.Printf("Disconnected %d log stream clients", n)
+	}
+	close(shutdownStarted)
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Fatalf("Server on %s forced to shutdown: %v", server.Addr, err)
+			}
+		}()
 	}
+	wg.Wait()
 
+	runLogs.Close()
+	if persistentLog != nil {
+		persistentLog.Close()
+	}
 	log.Println("Server exiting.")
 }
 
+// newMuxes registers every route on mux, and the health and metrics routes on
+// adminMux. Without -admin-listen-addr, adminMux is mux.
+func newMuxes() (mux, adminMux *http.ServeMux) {
+	mux = http.NewServeMux()
+	handle(mux, "/sync", requireAuth(pausable(countSync("/sync", syncHandler))), http.MethodPost)
+	handle(mux, "/sync/pull", requireAuth(pausable(countSync("/sync/pull", pullHandler))), http.MethodPost)
+	handle(mux, "/sync/archive", requireAuth(pausable(countSync("/sync/archive", archiveHandler))), http.MethodPost)
+	handle(mux, "/sync/changes", readAuth(syncChangesHandler), http.MethodGet)
+	handle(mux, "/fs/read", readAuth(fsReadHandler), http.MethodGet)
+	handle(mux, "/fs/list", readAuth(fsListHandler), http.MethodGet)
+	handle(mux, "/files", readAuth(filesHandler), http.MethodGet)
+	handle(mux, "/files/read", readAuth(fileReadHandler), http.MethodGet)
+	handle(mux, "/dev/install", requireAuth(pausable(dependenciesInstallHandler)), http.MethodPost)
+	handle(mux, "/dev/install/cancel", requireAuth(installCancelHandler), http.MethodPost)
+	handle(mux, "/dev/run", requireAuth(pausable(runScriptHandler)), http.MethodPost)
+	handle(mux, "/dev/status", readAuth(statusHandler), http.MethodGet)
+	handle(mux, "/dev/resolve", readAuth(resolveHandler), http.MethodGet)
+	handle(mux, "/dev/command", readAuth(devCommandHandler), http.MethodGet)
+	handle(mux, "/dev/env", requireAuth(devEnvHandler), http.MethodGet)
+	handle(mux, "/dev/health-check", readAuth(appHealthCheckHandler), http.MethodGet)
+	handle(mux, "/dev/start", requireAuth(pausable(startHandler)), http.MethodPost)
+	handle(mux, "/dev/stop", requireAuth(pausable(stopHandler)), http.MethodPost)
+	handle(mux, "/dev/restart", requireAuth(pausable(restartHandler)), http.MethodPost)
+	handle(mux, "/dev/logs", readAuth(logsHandler), http.MethodGet)
+	handle(mux, "/dev/logs/download", readAuth(logsDownloadHandler), http.MethodGet)
+	handle(mux, "/dev/logs/clear", requireAuth(pausable(logsClearHandler)), http.MethodPost)
+	handle(mux, "/health", healthHandler, http.MethodGet)
+	handle(mux, "/healthz", healthzHandler, http.MethodGet)
+	handle(mux, "/readyz", readyzHandler, http.MethodGet)
+	handle(mux, "/admin/maintenance", requireAuth(maintenanceHandler), http.MethodGet, http.MethodPost)
+	handle(mux, "/debug/snapshot", requireAuth(snapshotHandler), http.MethodGet)
+
+	// The admin server shares all state with the main one; only the routes
+	// differ.
+	adminMux = mux
+	if adminListenAddr != "" {
+		adminMux = http.NewServeMux()
+		handle(adminMux, "/health", healthHandler, http.MethodGet)
+		handle(adminMux, "/healthz", healthzHandler, http.MethodGet)
+		handle(adminMux, "/readyz", readyzHandler, http.MethodGet)
+	}
+	handle(adminMux, "/metrics", readAuth(prometheusHandler), http.MethodGet)
+	handle(adminMux, "/metrics/stream", readAuth(metricsStreamHandler), http.MethodGet)
+	return mux, adminMux
+}
+
 // --- Log Broadcasting (for /dev/logs) ---
 
 // Broadcaster manages active clients for log streaming.
 type Broadcaster struct {
-	clients    map[chan string]bool
-	register   chan chan string
-	unregister chan chan string
+	clients    map[chan BroadcastMessage]*logClient
+	unregister chan chan BroadcastMessage
 	messages   chan BroadcastMessage
 	mu         sync.Mutex
+	// history is a ring buffer of the most recent messages, replayed to newly
+	// connected clients. historyStart indexes the oldest entry.
+	history      []BroadcastMessage
+	historyStart int
+	historyLen   int
+	// lastID is the id given to the latest message. evictedThrough is the
+	// highest id that has been pushed out of the history.
+	lastID         int64
+	evictedThrough int64
+	// errorLines counts broadcast lines classified as errors.
+	errorLines atomic.Int64
+	// droppedLines counts lines not delivered to slow clients.
+	droppedLines atomic.Int64
+	// shuttingDown is set by Shutdown, after which no client is kept.
+	shuttingDown atomic.Bool
+	// osLines queues lines for writeOSStreams, so a stdout or stderr nobody
+	// drains can't stall the run loop. osDropped counts lines dropped
+	// because the queue was full.
+	osLines   chan osStreamLine
+	osDropped atomic.Int64
+	// noteMu guards lastNote and suppressedNotes, which rate-limit the notes
+	// logged about slow clients.
+	noteMu          sync.Mutex
+	lastNote        time.Time
+	suppressedNotes int
+	// unpublished counts lines Publish dropped since it last reported them;
+	// publishDropped counts them all.
+	unpublished    atomic.Int64
+	publishDropped atomic.Int64
 }
 
+// messageQueueSize is how many published lines can wait for the run loop
+// before Publish starts dropping them.
+const messageQueueSize = 4096
+
+// osStreamQueueSize is how many lines can wait to be written to the control
+// plane's stdout and stderr before new ones are dropped.
+const osStreamQueueSize = 1000
+
+// osStreamLine is a whole broadcast line bound for stdout or stderr, or, with
+// note set, a control plane log message.
+type osStreamLine struct {
+	text   string
+	stderr bool
+	note   bool
+}
+
+// slowClientNoteInterval is the least time between two logged notes about
+// messages dropped or clients disconnected for being slow.
+const slowClientNoteInterval = time.Second
+
 // BroadcastMessage represents a log line with its output stream.
 type BroadcastMessage struct {
+	// ID increases by one per broadcast line, starting at 1 for each control
+	// plane instance. It is sent as the SSE event id.
+	ID       int64
 	Text     string
 	IsStderr bool
+	Time     time.Time
+	// Progress marks a line that was terminated by a bare carriage return,
+	// i.e. one the process intends to overwrite (progress bars, spinners).
+	Progress bool
+	// DroppedBefore is set per client: how many messages were dropped for
+	// that client since the last one it received.
+	DroppedBefore int64
+	// System, when set, makes this a system message (e.g. "CLEARED") sent
+	// only to connected clients, never kept in history or written out.
+	System string
+	// Phase says what produced the line: phaseInstall, phasePrune, phaseApp
+	// or phaseSystem.
+	Phase string
+	// writtenOut marks a line already written whole to the OS stream and
+	// log files by publishLine, so the run loop only broadcasts it.
+	writtenOut bool
+}
+
+// Log phases, so clients can set dependency work apart from app output.
+const (
+	// phaseInstall is the output of a dependency install.
+	phaseInstall = "install"
+	// phasePrune is the output of removing extraneous dependencies.
+	phasePrune = "prune"
+	// phaseApp is the output of the dev server and package.json scripts.
+	phaseApp = "app"
+	// phaseSystem is the control plane's own markers and other commands.
+	phaseSystem = "system"
+)
+
+// commandPhase returns the phase of a command's output from its first
+// argument, e.g. "install" for "npm install --no-audit".
+func commandPhase(args []string) string {
+	if len(args) == 0 {
+		return phaseSystem
+	}
+	switch args[0] {
+	case "install", "i", "ci", "add":
+		return phaseInstall
+	case "prune":
+		return phasePrune
+	case "run":
+		return phaseApp
+	}
+	return phaseSystem
+}
+
+// logClient is a subscriber's delivery state. Callers must hold b.mu.
+type logClient struct {
+	policy overflowPolicy
+	// dropped counts messages not delivered since the last one that was.
+	dropped int64
+	// queue and stop are set for overflowBlock clients, whose messages go
+	// through their own pump goroutine so waiting on one never holds up the
+	// run loop or other clients. Closing stop ends the pump, which then
+	// closes the client's channel.
+	queue chan BroadcastMessage
+	stop  chan struct{}
 }
 
+// logClientQueueSize is how many messages can wait for an overflowBlock
+// client's pump before new ones are dropped.
+const logClientQueueSize = 256
+
 func newBroadcaster() *Broadcaster {
 	return &Broadcaster{
-		clients:    make(map[chan string]bool),
-		register:   make(chan chan string),
-		unregister: make(chan chan string),
-		messages:   make(chan BroadcastMessage, 100), // Buffered channel
+		clients:    make(map[chan BroadcastMessage]*logClient),
+		unregister: make(chan chan BroadcastMessage),
+		messages:   make(chan BroadcastMessage, messageQueueSize),
+		history:    make([]BroadcastMessage, defaultLogHistorySize),
+		osLines:    make(chan osStreamLine, osStreamQueueSize),
 	}
 }
 
 // run is the central loop that manages clients and broadcasts messages.
 func (b *Broadcaster) run() {
+	go b.writeOSStreams(os.Stdout, os.Stderr)
+	b.loop()
+}
+
+// loop manages clients and broadcasts messages. Nothing in it waits on a
+// client, the OS streams or a log file: each has its own queue and goroutine.
+func (b *Broadcaster) loop() {
 	for {
 		select {
-		case client := <-b.register:
-			b.mu.Lock()
-			b.clients[client] = true
-			b.mu.Unlock()
-			log.Println("Log stream client registered.")
 		case client := <-b.unregister:
 			b.mu.Lock()
-			if _, ok := b.clients[client]; ok {
-				delete(b.clients, client)
-				close(client)
+			if state, ok := b.clients[client]; ok {
+				b.closeClient(client, state)
 			}
 			b.mu.Unlock()
-			log.Println("Log stream client unregistered.")
+			b.note("Log stream client unregistered.")
 		case msg := <-b.messages:
+			// Clients get a bounded line; the OS stream below gets it whole.
+			// publishLine has already done both for writtenOut lines.
+			full := msg.Text
+			if !msg.writtenOut {
+				msg.Text = truncateLogLine(full)
+			}
+			if messageLevel(msg, structuredLogLine(msg.Text)) == levelError {
+				b.errorLines.Add(1)
+			}
 			b.mu.Lock()
-			for client := range b.clients {
-				// Non-blocking send to prevent one slow client from blocking all others.
-				select {
-				case client <- msg.Text:
-				default:
-					log.Println("Log stream client channel is full. Dropping message.")
+			b.lastID++
+			msg.ID = b.lastID
+			b.appendHistory(msg)
+			var notes []string
+			for client, state := range b.clients {
+				if note := b.deliver(client, state, msg); note != "" {
+					notes = append(notes, note)
 				}
 			}
 			b.mu.Unlock()
-			// Also write to the appropriate OS stream.
-			if msg.IsStderr {
-				fmt.Fprintln(os.Stderr, msg.Text)
-			} else {
-				fmt.Fprintln(os.Stdout, msg.Text)
+			for _, note := range notes {
+				b.slowClientNote(note)
+			}
+			if !msg.writtenOut {
+				b.writeOut(msg, full)
 			}
 		}
 	}
 }
 
-// Submit sends a message to all connected clients.
-func (b *Broadcaster) Submit(msg string) {
-	b.messages <- BroadcastMessage{Text: msg, IsStderr: false}
+// writeOut queues text, msg's whole line, for the OS stream and the log
+// files.
+func (b *Broadcaster) writeOut(msg BroadcastMessage, text string) {
+	select {
+	case b.osLines <- osStreamLine{text: text, stderr: msg.IsStderr}:
+	default:
+		b.osDropped.Add(1)
+	}
+	line := formatLogFileLine(msg, text)
+	if runLogs != nil {
+		runLogs.Write(line)
+	}
+	if persistentLog != nil {
+		persistentLog.Write(line)
+	}
 }
 
-// SubmitStderr sends a stderr-classified message to all connected clients.
-func (b *Broadcaster) SubmitStderr(msg string) {
-	b.messages <- BroadcastMessage{Text: msg, IsStderr: true}
+// publishLine publishes a line read from a process. A line over
+// maxLogLineBytes is written out whole right away and only queued for
+// clients truncated, so a process printing huge lines can't fill the queue
+// with up to maxScannedLineBytes each. Such a line can reach the log files
+// slightly ahead of shorter ones still queued.
+func (b *Broadcaster) publishLine(msg BroadcastMessage) {
+	if maxLogLineBytes > 0 && len(msg.Text) > maxLogLineBytes {
+		b.writeOut(msg, msg.Text)
+		msg.Text = truncateLogLine(msg.Text)
+		msg.writtenOut = true
+	}
+	b.Publish(msg)
 }
 
-func logsHandler(w http.ResponseWriter, r *http.Request) {
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
-		return
+// SubscribeAfter registers a new client and returns its channel along with a
+// copy of the buffered history. Both happen under the same lock as
+// broadcasting, so the replay and the live stream neither overlap nor leave a
+// gap. A client resuming after the message with id afterID only gets the
+// history after it; zero means a fresh client. gap reports that some of the
+// messages the client missed are no longer buffered, or that afterID came
+// from before a control plane restart (in which case all history is
+// returned).
+func (b *Broadcaster) SubscribeAfter(afterID int64, policy overflowPolicy) (client chan BroadcastMessage, history []BroadcastMessage, gap bool) {
+	client = make(chan BroadcastMessage, 10)
+	b.mu.Lock()
+	history = b.historySnapshot()
+	if afterID > b.lastID {
+		gap = true
+	} else if afterID > 0 {
+		gap = afterID < b.evictedThrough
+		i := 0
+		for i < len(history) && history[i].ID <= afterID {
+			i++
+		}
+		history = history[i:]
+	}
+	if b.shuttingDown.Load() {
+		close(client)
+	} else {
+		state := &logClient{policy: policy}
+		if policy == overflowBlock {
+			state.queue = make(chan BroadcastMessage, logClientQueueSize)
+			state.stop = make(chan struct{})
+			go b.pump(client, state.queue, state.stop)
+		}
+		b.clients[client] = state
 	}
+	b.mu.Unlock()
+	log.Println("Log stream client registered.")
+	return client, history, gap
+}
 
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+// overflowPolicy decides what happens when a client's channel is full.
+type overflowPolicy string
 
-	clientChan := make(chan string, 10)
-	logBroadcaster.register <- clientChan
-	defer func() {
-		logBroadcaster.unregister <- clientChan
-	}()
+const (
+	// overflowDrop skips the message for that client, so one slow client
+	// never holds up the others.
+	overflowDrop overflowPolicy = "drop"
+	// overflowBlock waits up to logClientBlockTimeout for room, then drops
+	// the message. The wait happens in the client's own goroutine, so it
+	// only delays that client.
+	overflowBlock overflowPolicy = "block-with-timeout"
+	// overflowClose disconnects the client, which is told why.
+	overflowClose overflowPolicy = "close-slow-client"
+)
 
-	type logEntry struct {
-		Log           string `json:"log"`
-		Error         bool   `json:"error"`
-		SystemMessage string `json:"system_message"`
+// logClientBlockTimeout is how long overflowBlock waits for a slow client.
+const logClientBlockTimeout = time.Second
+
+// parseOverflowPolicy parses the ?overflow= parameter; empty means drop.
+func parseOverflowPolicy(s string) (overflowPolicy, error) {
+	switch p := overflowPolicy(s); p {
+	case "":
+		return overflowDrop, nil
+	case overflowDrop, overflowBlock, overflowClose:
+		return p, nil
 	}
+	return "", fmt.Errorf("overflow must be %q, %q or %q", overflowDrop, overflowBlock, overflowClose)
+}
 
-	errorRegex := regexp.MustCompile(`(?i)error|exception|failed|unhandled`)
+// writeOSStreams writes queued lines to stdout or stderr, one at a time, for
+// as long as the process runs. Notes are logged to stderr.
+func (b *Broadcaster) writeOSStreams(stdout, stderr io.Writer) {
+	notes := log.New(stderr, "", log.LstdFlags)
+	for line := range b.osLines {
+		if line.note {
+			notes.Print(line.text)
+		} else if line.stderr {
+			fmt.Fprintln(stderr, line.text)
+		} else {
+			fmt.Fprintln(stdout, line.text)
+		}
+	}
+}
 
-	initialEntry := logEntry{SystemMessage: "CONNECTED"}
-	initialData, err := json.Marshal(initialEntry)
-	if err == nil {
-		fmt.Fprintf(w, "data: %s\n\n", initialData)
-		flusher.Flush()
+// note queues a control plane log message for writeOSStreams, so logging
+// never holds up the run loop. It is dropped and counted in osDropped if the
+// queue is full.
+func (b *Broadcaster) note(text string) {
+	select {
+	case b.osLines <- osStreamLine{text: text, note: true}:
+	default:
+		b.osDropped.Add(1)
 	}
+}
 
-	ctx := r.Context()
+// slowClientNote notes a message dropped or a client disconnected for being
+// slow, at most once per slowClientNoteInterval; the next note that gets
+// through says how many were suppressed.
+func (b *Broadcaster) slowClientNote(text string) {
+	b.noteMu.Lock()
+	now := time.Now()
+	if !b.lastNote.IsZero() && now.Sub(b.lastNote) < slowClientNoteInterval {
+		b.suppressedNotes++
+		b.noteMu.Unlock()
+		return
+	}
+	suppressed := b.suppressedNotes
+	b.lastNote, b.suppressedNotes = now, 0
+	b.noteMu.Unlock()
+	if suppressed > 0 {
+		text = fmt.Sprintf("%s (%d similar notes suppressed)", text, suppressed)
+	}
+	b.note(text)
+}
+
+// deliver sends msg to client, applying its overflow policy if the channel
+// is full. A delivered message carries the count of those dropped before it.
+// Callers must hold b.mu, and pass the returned note, if any, to
+// slowClientNote once they have released it.
+func (b *Broadcaster) deliver(client chan BroadcastMessage, state *logClient, msg BroadcastMessage) (note string) {
+	msg.DroppedBefore = state.dropped
+	if state.queue != nil {
+		// Everything goes through the pump: sending straight to client when
+		// it has room would overtake the messages the pump still holds.
+		select {
+		case state.queue <- msg:
+			state.dropped = 0
+			return ""
+		default:
+			state.dropped++
+			b.droppedLines.Add(1)
+			return "Log stream client queue is full. Dropping message."
+		}
+	}
+	select {
+	case client <- msg:
+		state.dropped = 0
+		return ""
+	default:
+	}
+	switch state.policy {
+	case overflowClose:
+		// Closing the channel tells the handler, after it drains what is
+		// buffered, that the client was disconnected for being slow.
+		b.closeClient(client, state)
+		b.droppedLines.Add(1)
+		return "Log stream client channel is full. Disconnecting slow client."
+	default:
+		state.dropped++
+		b.droppedLines.Add(1)
+		return "Log stream client channel is full. Dropping message."
+	}
+}
+
+// pump delivers an overflowBlock client's queued messages, waiting up to
+// logClientBlockTimeout for each. It closes client once stop is closed.
+func (b *Broadcaster) pump(client chan BroadcastMessage, queue chan BroadcastMessage, stop chan struct{}) {
+	defer close(client)
+	timer := time.NewTimer(logClientBlockTimeout)
+	timer.Stop()
+	// dropped counts messages that timed out since one was delivered; deliver
+	// already counted those dropped before msg was queued.
+	var dropped int64
 	for {
+		var msg BroadcastMessage
 		select {
-		case <-ctx.Done():
-			closedEntry := logEntry{SystemMessage: "DISCONNECTED"}
-			jsonData, err := json.Marshal(closedEntry)
-			if err != nil {
-				continue
-			}
-			fmt.Fprintf(w, "data: %s\n\n", jsonData)
-			flusher.Flush()
+		case msg = <-queue:
+		case <-stop:
 			return
-		case msg := <-clientChan:
-			isError := errorRegex.MatchString(msg)
-			entry := logEntry{
-				Log:   msg,
-				Error: isError,
-			}
-			jsonData, err := json.Marshal(entry)
-			if err != nil {
-				continue
+		}
+		msg.DroppedBefore += dropped
+		select {
+		case client <- msg:
+			dropped = 0
+			continue
+		default:
+		}
+		timer.Reset(logClientBlockTimeout)
+		select {
+		case client <- msg:
+			dropped = 0
+		case <-timer.C:
+			dropped++
+			b.droppedLines.Add(1)
+			b.slowClientNote(fmt.Sprintf("Log stream client still full after %s. Dropping message.", logClientBlockTimeout))
+		case <-stop:
+			return
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
 			}
-			fmt.Fprintf(w, "data: %s\n\n", jsonData)
-			flusher.Flush()
 		}
 	}
 }
 
-type SyncRequest struct {
-	Files            map[string]string `json:"files"`
-	DeletedFilePaths []string          `json:"deleted_file_paths"`
+// closeClient unregisters client and closes its channel, through its pump if
+// it has one. Callers must hold b.mu.
+func (b *Broadcaster) closeClient(client chan BroadcastMessage, state *logClient) {
+	delete(b.clients, client)
+	if state.stop != nil {
+		close(state.stop)
+	} else {
+		close(client)
+	}
 }
 
-// runCommandAndStreamOutput executes a command and streams its output to the log broadcaster.
-func runCommandAndStreamOutput(command string, args []string) error {
-	cmd := exec.Command(command, args...)
-	cmd.Dir = appDir
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("failed to get stdout pipe for %s: %w", command, err)
+// Clear empties the history and sends a CLEARED system message to every
+// connected client, so their views can reset. Everything broadcast so far
+// counts as evicted, so a client resuming from before the clear gets a GAP.
+// It returns how many buffered lines were discarded.
+func (b *Broadcaster) Clear() int {
+	b.mu.Lock()
+	n := b.historyLen
+	clear(b.history)
+	b.historyStart, b.historyLen = 0, 0
+	b.evictedThrough = b.lastID
+	msg := BroadcastMessage{Text: "Log history was cleared", Time: time.Now(), System: "CLEARED"}
+	var notes []string
+	for client, state := range b.clients {
+		if note := b.deliver(client, state, msg); note != "" {
+			notes = append(notes, note)
+		}
 	}
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("failed to get stderr pipe for %s: %w", command, err)
+	b.mu.Unlock()
+	for _, note := range notes {
+		b.slowClientNote(note)
 	}
+	return n
+}
 
-	log.Printf("Running: %s %s in %s", command, strings.Join(args, " "), appDir)
-	logBroadcaster.Submit(fmt.Sprintf("--- Running: %s %s ---", command, strings.Join(args, " ")))
-
-	if err := cmd.Start(); err != nil {
-		logBroadcaster.Submit(fmt.Sprintf("--- Failed to start command: %s ---", command))
-		return fmt.Errorf("failed to start command %s: %w", command, err)
+// Shutdown closes every client's channel, and those of clients subscribing
+// later, so their handlers tell them the control plane is shutting down and
+// return instead of holding up the HTTP server's shutdown. It returns how many
+// clients were connected.
+func (b *Broadcaster) Shutdown() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.shuttingDown.Store(true)
+	n := len(b.clients)
+	for client, state := range b.clients {
+		b.closeClient(client, state)
 	}
+	return n
+}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		streamPipeToBroadcaster(stdout, "STDOUT")
-	}()
-	go func() {
-		defer wg.Done()
-		streamPipeToBroadcaster(stderr, "STDERR")
-	}()
-
-	wg.Wait() // Wait for pipes to be fully drained to capture all output.
-
-	err = cmd.Wait()
-	if err != nil {
-		logBroadcaster.Submit(fmt.Sprintf("--- Command failed: %s %s (%v) ---", command, strings.Join(args, " "), err))
-		return err
+// SetHistorySize resizes the history buffer, keeping the most recent entries.
+// A size of zero disables history.
+func (b *Broadcaster) SetHistorySize(size int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entries := b.historySnapshot()
+	if len(entries) > size {
+		if dropped := entries[len(entries)-size-1].ID; dropped > b.evictedThrough {
+			b.evictedThrough = dropped
+		}
+		entries = entries[len(entries)-size:]
 	}
-
-	logBroadcaster.Submit(fmt.Sprintf("--- Command finished successfully: %s %s ---", command, strings.Join(args, " ")))
-	return nil
+	b.history = make([]BroadcastMessage, size)
+	b.historyStart = 0
+	b.historyLen = copy(b.history, entries)
 }
 
-func syncHandler(w http.ResponseWriter, r *http.Request) {
-	var req SyncRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		httpError(w, "Invalid JSON body", http.StatusBadRequest)
+// appendHistory adds msg to the history ring buffer. Callers must hold b.mu.
+func (b *Broadcaster) appendHistory(msg BroadcastMessage) {
+	size := len(b.history)
+	if size == 0 {
+		b.evictedThrough = msg.ID
 		return
 	}
-
-	// Check if package.json is being modified before applying changes.
-	packageJsonModified := false
-	for p := range req.Files {
-		if filepath.Clean(p) == "package.json" {
-			packageJsonModified = true
-			break
+	if collapseProgress && b.historyLen > 0 {
+		// A line following a progress update on the same stream overwrites it,
+		// so keep only the latest state of the updating line.
+		last := (b.historyStart + b.historyLen - 1) % size
+		if prev := b.history[last]; prev.Progress && prev.IsStderr == msg.IsStderr {
+			b.history[last] = msg
+			return
 		}
 	}
-
-	var wg sync.WaitGroup
-	errs := make(chan error, len(req.Files)+len(req.DeletedFilePaths))
-
-	// Apply file changes concurrently.
-	for p, b64 := range req.Files {
-		wg.Add(1)
-		go func(p, b64 string) {
-			defer wg.Done()
-			if err := writeFileBase64(p, b64); err != nil {
-				errs <- fmt.Errorf("failed to write %s: %w", p, err)
-			}
-		}(p, b64)
+	if b.historyLen < size {
+		b.history[(b.historyStart+b.historyLen)%size] = msg
+		b.historyLen++
+		return
 	}
+	b.evictedThrough = b.history[b.historyStart].ID
+	b.history[b.historyStart] = msg
+	b.historyStart = (b.historyStart + 1) % size
+}
 
-	for _, p := range req.DeletedFilePaths {
-		wg.Add(1)
-		go func(p string) {
-			defer wg.Done()
-			if err := deletePath(p); err != nil {
-				errs <- fmt.Errorf("failed to delete %s: %w", p, err)
-			}
-		}(p)
+// historySnapshot returns the buffered history, oldest first. Callers must hold b.mu.
+func (b *Broadcaster) historySnapshot() []BroadcastMessage {
+	entries := make([]BroadcastMessage, b.historyLen)
+	for i := range entries {
+		entries[i] = b.history[(b.historyStart+i)%len(b.history)]
 	}
+	return entries
+}
 
-	wg.Wait()
-	close(errs)
+// ClientCount returns the number of connected log stream clients.
+func (b *Broadcaster) ClientCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.clients)
+}
 
-	var allErrors []string
-	for err := range errs {
-		allErrors = append(allErrors, err.Error())
+// Publish sends a fully populated message to all connected clients. It never
+// blocks, so the goroutines reading the dev server's output can't stall it:
+// if the queue is full the line is dropped and counted, and the next line to
+// get through is preceded by a notice saying how many were lost.
+func (b *Broadcaster) Publish(msg BroadcastMessage) {
+	if n := b.unpublished.Swap(0); n > 0 {
+		notice := BroadcastMessage{
+			Text:     fmt.Sprintf("--- %d log lines were dropped because the log stream was backed up ---", n),
+			IsStderr: true,
+			Time:     time.Now(),
+			Phase:    phaseSystem,
+		}
+		select {
+		case b.messages <- notice:
+		default:
+			b.unpublished.Add(n)
+		}
 	}
-
-	// If file operations failed, stop here.
-	if len(allErrors) > 0 {
-		httpError(w, strings.Join(allErrors, "; "), http.StatusInternalServerError)
-		return
+	select {
+	case b.messages <- msg:
+	default:
+		b.unpublished.Add(1)
+		b.publishDropped.Add(1)
 	}
+}
 
-	// If package.json was changed, run npm install and prune.
-	var depMessages []string
-	if packageJsonModified {
-		log.Println("package.json modified, running dependency reconciliation.")
-		logBroadcaster.Submit("--- package.json updated. Reconciling dependencies... ---")
+// Submit sends a control plane message to all connected clients.
+func (b *Broadcaster) Submit(msg string) {
+	b.Publish(BroadcastMessage{Text: msg, IsStderr: false, Time: time.Now(), Phase: phaseSystem})
+}
 
-		// Install dependencies.
-		installArgs := []string{"install", "--no-fund", "--prefer-offline", "--no-optional", "--no-audit"}
-		if err := runCommandAndStreamOutput("npm", installArgs); err != nil {
-			msg := fmt.Sprintf("npm install failed: %v", err)
-			log.Println(msg)
-			allErrors = append(allErrors, msg)
-		} else {
-			depMessages = append(depMessages, "npm install completed successfully.")
-			// Prune unused dependencies after install.
-			pruneArgs := []string{"prune"}
-			if err := runCommandAndStreamOutput("npm", pruneArgs); err != nil {
-				msg := fmt.Sprintf("npm prune failed: %v", err)
-				log.Println(msg)
-				allErrors = append(allErrors, msg)
-			} else {
-				depMessages = append(depMessages, "npm prune completed successfully.")
-			}
-		}
-		logBroadcaster.Submit("--- Dependency reconciliation finished. ---")
-	}
+// SubmitStderr sends a stderr-classified control plane message to all
+// connected clients.
+func (b *Broadcaster) SubmitStderr(msg string) {
+	b.Publish(BroadcastMessage{Text: msg, IsStderr: true, Time: time.Now(), Phase: phaseSystem})
+}
 
-	if len(allErrors) > 0 {
-		httpError(w, strings.Join(allErrors, "; "), http.StatusInternalServerError)
+func logsHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
 		return
 	}
 
-	finalMessage := "Files synced successfully"
-	if len(depMessages) > 0 {
-		finalMessage = fmt.Sprintf("%s. %s", finalMessage, strings.Join(depMessages, " "))
+	// Optional minimum severity, e.g. ?level=warn. System messages always pass.
+	minLevel := levelDebug
+	if levelParam := r.URL.Query().Get("level"); levelParam != "" {
+		level, err := parseLogLevel(levelParam)
+		if err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		minLevel = level
 	}
-	jsonResponse(w, http.StatusOK, map[string]interface{}{"success": true, "message": finalMessage})
-}
 
-func fsReadHandler(w http.ResponseWriter, r *http.Request) {
-	filePath := r.URL.Query().Get("path")
-	if filePath == "" {
-		http.Error(w, "Query parameter 'path' is required", http.StatusBadRequest)
-		return
+	// Optional line matching, e.g. ?filter=database or ?regex=^GET\s. Both
+	// must match when given together.
+	filter := r.URL.Query().Get("filter")
+	var lineRegex *regexp.Regexp
+	if expr := r.URL.Query().Get("regex"); expr != "" {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			httpError(w, fmt.Sprintf("Invalid regex: %v", err), http.StatusBadRequest)
+			return
+		}
+		lineRegex = re
 	}
 
-	resolvedPath, err := resolveWithinAppDir(filePath)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	// What to do when this client falls behind, e.g. ?overflow=close-slow-client.
+	overflow, err := parseOverflowPolicy(r.URL.Query().Get("overflow"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusForbidden)
+		httpError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	info, err := os.Stat(resolvedPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			http.Error(w, "File not found", http.StatusNotFound)
-		} else {
-			http.Error(w, "Failed to access path", http.StatusInternalServerError)
+	// EventSource sends Last-Event-ID when it reconnects; ?last_event_id= is
+	// for clients that can't set headers.
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var afterID int64
+	if lastEventID != "" {
+		id, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || id < 0 {
+			httpError(w, "Last-Event-ID must be a non-negative log line id", http.StatusBadRequest)
+			return
 		}
-		return
+		afterID = id
 	}
 
-	if info.IsDir() {
-		http.Error(w, "Path is a directory, not a file", http.StatusBadRequest)
-		return
+	// ?tail=N replays only the last N buffered lines, like docker logs
+	// --tail; tail=0 streams live lines only. Without it, all are replayed.
+	tail := -1
+	if v := r.URL.Query().Get("tail"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			httpError(w, "Query parameter 'tail' must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		tail = n
 	}
 
-	http.ServeFile(w, r, resolvedPath)
-}
-
-type FsEntry struct {
-	RelativePath string `json:"relative_path"`
-	Type         string `json:"type"` // "file" or "directory"
-}
+	clientChan, history, gap := logBroadcaster.SubscribeAfter(afterID, overflow)
+	if tail >= 0 && tail < len(history) {
+		history = history[len(history)-tail:]
+		// A reconnecting client wasn't sent the lines skipped over.
+		gap = gap || afterID > 0
+	}
+	defer func() {
+		logBroadcaster.unregister <- clientChan
+	}()
 
-func fsListHandler(w http.ResponseWriter, r *http.Request) {
-	dirPath := r.URL.Query().Get("path")
-	if dirPath == "" {
-		dirPath = "."
+	type logEntry struct {
+		Log           string `json:"log"`
+		Error         bool   `json:"error"`
+		Level         string `json:"level,omitempty"`
+		SystemMessage string `json:"system_message"`
+		Timestamp     string `json:"timestamp,omitempty"`
+		// Progress is set for lines the process will overwrite; clients may
+		// replace the previous progress entry instead of appending.
+		Progress bool `json:"progress,omitempty"`
+		// Structured holds lines that are themselves JSON objects (e.g. pino
+		// or winston output), passed through instead of being re-encoded in Log.
+		Structured json.RawMessage `json:"structured,omitempty"`
+		// DroppedSinceLast counts lines this client missed because it fell
+		// behind, since the previous entry it was sent.
+		DroppedSinceLast int64 `json:"dropped_since_last,omitempty"`
+		// Phase is "install", "prune", "app" or "system"; see commandPhase.
+		Phase string `json:"phase,omitempty"`
 	}
 
-	recursiveParam := r.URL.Query().Get("recursive")
-	isRecursive, _ := strconv.ParseBool(recursiveParam)
+	// Flushing via the ResponseController surfaces write errors, so a client
+	// that has gone away is detected on the next event rather than only when
+	// the request context is cancelled.
+	rc := http.NewResponseController(w)
+	clearStreamDeadlines(rc)
 
-	resolvedPath, err := resolveWithinAppDir(dirPath)
-	if err != nil {
-		httpError(w, err.Error(), http.StatusForbidden)
-		return
+	initialEntry := logEntry{SystemMessage: "CONNECTED", Timestamp: formatLogTime(time.Now())}
+	initialData, err := json.Marshal(initialEntry)
+	if err == nil {
+		if err := writeSSEEvent(w, rc, initialData); err != nil {
+			log.Printf("Log stream client write failed: %v", err)
+			return
+		}
+	}
+	if gap {
+		gapEntry := logEntry{
+			Log:           "Some log lines since the last received event are no longer available",
+			SystemMessage: "GAP",
+			Timestamp:     formatLogTime(time.Now()),
+		}
+		if gapData, err := json.Marshal(gapEntry); err == nil {
+			if err := writeSSEEvent(w, rc, gapData); err != nil {
+				log.Printf("Log stream client write failed: %v", err)
+				return
+			}
+		}
 	}
 
-	var fsEntries []FsEntry
-
-	if isRecursive {
-		err := filepath.WalkDir(resolvedPath, func(path string, d fs.DirEntry, err error) error {
-			if err != nil {
-				return err
+	// Drops reported on a line this client filters out are carried over to
+	// the next line it is sent.
+	var dropped int64
+	sendLine := func(msg BroadcastMessage) error {
+		dropped += msg.DroppedBefore
+		if msg.System != "" {
+			entry := logEntry{
+				Log:              msg.Text,
+				SystemMessage:    msg.System,
+				Timestamp:        formatLogTime(msg.Time),
+				DroppedSinceLast: dropped,
 			}
-			if path == resolvedPath {
+			dropped = 0
+			jsonData, err := json.Marshal(entry)
+			if err != nil {
 				return nil
 			}
+			return writeSSEEvent(w, rc, jsonData)
+		}
+		structured := structuredLogLine(msg.Text)
+		level := messageLevel(msg, structured)
+		if level < minLevel {
+			return nil
+		}
+		if filter != "" && !strings.Contains(msg.Text, filter) {
+			return nil
+		}
+		if lineRegex != nil && !lineRegex.MatchString(msg.Text) {
+			return nil
+		}
+		entry := logEntry{
+			Log:              msg.Text,
+			Error:            level == levelError,
+			Level:            level.String(),
+			Timestamp:        formatLogTime(msg.Time),
+			Progress:         msg.Progress,
+			Structured:       structured,
+			DroppedSinceLast: dropped,
+			Phase:            msg.Phase,
+		}
+		dropped = 0
+		if structured != nil {
+			entry.Log = ""
+		}
+		jsonData, err := json.Marshal(entry)
+		if err != nil {
+			return nil
+		}
+		return writeSSEEventID(w, rc, msg.ID, jsonData)
+	}
 
-			relativePath, err := filepath.Rel(resolvedPath, path)
-			if err != nil {
-				return err
-			}
+	// Replay recent history so late joiners see startup output.
+	for _, msg := range history {
+		if err := sendLine(msg); err != nil {
+			log.Printf("Log stream client write failed, disconnecting: %v", err)
+			return
+		}
+	}
 
-			entryType := "file"
-			if d.IsDir() {
-				entryType = "directory"
-			}
-			fsEntries = append(fsEntries, FsEntry{RelativePath: relativePath, Type: entryType})
-			return nil
-		})
+	// A comment line keeps idle connections from being dropped by proxies.
+	// It is only sent after logHeartbeatInterval without any other event.
+	var heartbeat <-chan time.Time
+	var heartbeatTimer *time.Timer
+	if logHeartbeatInterval > 0 {
+		heartbeatTimer = time.NewTimer(logHeartbeatInterval)
+		defer heartbeatTimer.Stop()
+		heartbeat = heartbeatTimer.C
+	}
 
-		if err != nil {
-			httpError(w, fmt.Sprintf("Failed during recursive directory scan: %v", err), http.StatusInternalServerError)
+	ctx := r.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			closedEntry := logEntry{SystemMessage: "DISCONNECTED", Timestamp: formatLogTime(time.Now())}
+			jsonData, err := json.Marshal(closedEntry)
+			if err != nil {
+				continue
+			}
+			writeSSEEvent(w, rc, jsonData)
 			return
+		case msg, ok := <-clientChan:
+			if !ok && logBroadcaster.shuttingDown.Load() {
+				shutdownEntry := logEntry{
+					Log:           "The control plane is shutting down",
+					SystemMessage: "SHUTTING_DOWN",
+					Timestamp:     formatLogTime(time.Now()),
+				}
+				if jsonData, err := json.Marshal(shutdownEntry); err == nil {
+					writeSSEEvent(w, rc, jsonData)
+				}
+				return
+			}
+			if !ok {
+				slowEntry := logEntry{
+					Log:           "Disconnected: the client did not keep up with the log stream",
+					SystemMessage: "DISCONNECTED_SLOW_CLIENT",
+					Timestamp:     formatLogTime(time.Now()),
+				}
+				if jsonData, err := json.Marshal(slowEntry); err == nil {
+					writeSSEEvent(w, rc, jsonData)
+				}
+				return
+			}
+			if err := sendLine(msg); err != nil {
+				log.Printf("Log stream client write failed, disconnecting: %v", err)
+				return
+			}
+		case <-heartbeat:
+			if err := writeSSEComment(w, rc, "heartbeat"); err != nil {
+				log.Printf("Log stream client write failed, disconnecting: %v", err)
+				return
+			}
+		}
+		if heartbeatTimer != nil {
+			if !heartbeatTimer.Stop() {
+				select {
+				case <-heartbeatTimer.C:
+				default:
+				}
+			}
+			heartbeatTimer.Reset(logHeartbeatInterval)
 		}
+	}
+}
 
-	} else {
-		entries, err := os.ReadDir(resolvedPath)
+// logsClearHandler empties the log history replayed to new clients and tells
+// connected ones to reset. Saved log files are kept unless ?files=true, which
+// also empties the current run's file and the persistent log file.
+func logsClearHandler(w http.ResponseWriter, r *http.Request) {
+	clearFiles := false
+	if v := r.URL.Query().Get("files"); v != "" {
+		b, err := strconv.ParseBool(v)
 		if err != nil {
-			httpError(w, fmt.Sprintf("Could not read directory: %v", err), http.StatusInternalServerError)
+			httpError(w, "Query parameter 'files' must be a boolean", http.StatusBadRequest)
 			return
 		}
+		clearFiles = b
+	}
 
-		for _, entry := range entries {
-			entryType := "file"
-			if entry.IsDir() {
-				entryType = "directory"
-			}
-			fsEntries = append(fsEntries, FsEntry{RelativePath: entry.Name(), Type: entryType})
+	n := logBroadcaster.Clear()
+	if clearFiles {
+		if runLogs != nil {
+			runLogs.Truncate()
+		}
+		if persistentLog != nil {
+			persistentLog.Truncate()
 		}
 	}
-
-	jsonResponse(w, http.StatusOK, fsEntries)
+	log.Printf("Log history cleared (%d lines, files: %t)", n, clearFiles)
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"success":       true,
+		"cleared_lines": n,
+		"files_cleared": clearFiles,
+	})
 }
 
-type InstallRequest struct {
-	ExtraArgs []string `json:"extra_args"`
+// formatLogTime formats a log line timestamp as RFC3339 with milliseconds.
+func formatLogTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z07:00")
 }
 
-func dependenciesInstallHandler(w http.ResponseWriter, r *http.Request) {
-	var req InstallRequest
-	if r.ContentLength > 0 {
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			httpError(w, "Invalid request body", http.StatusBadRequest)
-			return
-		}
+// clearStreamDeadlines lifts the server's read and write timeouts for a
+// long-lived streaming response, which would otherwise be cut off once
+// -write-timeout elapses.
+func clearStreamDeadlines(rc *http.ResponseController) {
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Failed to clear write deadline for stream: %v", err)
 	}
+	if err := rc.SetReadDeadline(time.Time{}); err != nil {
+		log.Printf("Failed to clear read deadline for stream: %v", err)
+	}
+}
 
-	args := append([]string{"install", "--no-fund", "--prefer-offline", "--no-optional", "--no-audit"}, req.ExtraArgs...)
-	cmd := exec.Command("npm", args...)
-	cmd.Dir = appDir
-
-	log.Printf("Running: npm %s in %s", strings.Join(args, " "), appDir)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		exitCode := -1
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			exitCode = exitErr.ExitCode()
-		}
-		log.Printf("npm install failed: %s", string(output))
-		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{
-			"success":       false,
-			"exit_code":     exitCode,
-			"error_message": string(output),
-		})
-		return
+// writeSSEComment writes an SSE comment line, which clients ignore, and flushes it.
+func writeSSEComment(w http.ResponseWriter, rc *http.ResponseController, comment string) error {
+	if _, err := fmt.Fprintf(w, ": %s\n\n", comment); err != nil {
+		return err
 	}
+	return rc.Flush()
+}
 
-	log.Println("npm install completed successfully")
-	jsonResponse(w, http.StatusOK, map[string]interface{}{"success": true, "exit_code": 0})
+// writeSSEEventID writes an SSE data event with an id, which the client sends
+// back as Last-Event-ID when it reconnects, and flushes it.
+func writeSSEEventID(w http.ResponseWriter, rc *http.ResponseController, id int64, data []byte) error {
+	if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", id, data); err != nil {
+		return err
+	}
+	return rc.Flush()
 }
 
-func statusHandler(w http.ResponseWriter, r *http.Request) {
-	pid, err := readPID()
-	if err != nil || !isProcessAlive(pid) {
-		jsonResponse(w, http.StatusOK, map[string]interface{}{"running": false, "pid": nil})
-		return
+// writeSSEEvent writes a single SSE data event and flushes it to the client.
+func writeSSEEvent(w http.ResponseWriter, rc *http.ResponseController, data []byte) error {
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+		return err
 	}
-	jsonResponse(w, http.StatusOK, map[string]interface{}{"running": true, "pid": pid})
+	return rc.Flush()
 }
 
-func startHandler(w http.ResponseWriter, r *http.Request) {
-	handleDevOperation(w, r, "start")
+var (
+	// maxSyncBytes caps the size of a /sync request body. Zero disables the
+	// limit.
+	maxSyncBytes int64 = 256 << 20
+	// maxSyncFileBytes caps the decoded size of each file written or patched
+	// by /sync. Zero disables the limit.
+	maxSyncFileBytes int64 = 64 << 20
+)
+
+// errSyncFileTooLarge is returned when a synced file exceeds maxSyncFileBytes.
+var errSyncFileTooLarge = errors.New("file exceeds the size limit")
+
+// SyncRequest is the /sync body. Files is never populated by
+// decodeSyncRequest; entries are streamed to a callback instead.
+type SyncRequest struct {
+	Files            map[string]SyncFile  `json:"files"`
+	Patches          map[string]SyncPatch `json:"patches"`
+	DeletedFilePaths []string             `json:"deleted_file_paths"`
+	// SkipInstall applies the changes, package.json included, without the
+	// dependency reconciliation a package.json change would trigger.
+	SkipInstall bool `json:"skip_install,omitempty"`
+	// Mode "mirror" also deletes every file under appDir that isn't in Files
+	// or Patches and isn't ignored, so the app dir matches the client.
+	Mode string `json:"mode,omitempty"`
 }
 
-func stopHandler(w http.ResponseWriter, r *http.Request) {
-	handleDevOperation(w, r, "stop")
+// syncModeMirror is the SyncRequest.Mode that deletes files not in the sync.
+const syncModeMirror = "mirror"
+
+// SyncFile is one entry of SyncRequest.Files. It is either a plain base64
+// string or an object with "content" and an optional hex "sha256" of the
+// decoded content; a matching checksum lets the write be skipped without
+// decoding.
+type SyncFile struct {
+	Content string `json:"content"`
+	SHA256  string `json:"sha256,omitempty"`
+	// Encoding is "gzip" when Content is the base64 of the gzipped file.
+	// sha256 and size limits refer to the uncompressed content.
+	Encoding string `json:"encoding,omitempty"`
+	// Mode sets the file's permissions. Without it, an existing file keeps
+	// its mode and a new one gets 0644.
+	Mode *fileMode `json:"mode,omitempty"`
+	// stream, when set instead of Content, yields the base64 content of a
+	// large file straight from the request body; see decodeSyncRequest.
+	stream io.Reader
 }
 
-func restartHandler(w http.ResponseWriter, r *http.Request) {
-	handleDevOperation(w, r, "restart")
+func (f *SyncFile) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*f = SyncFile{}
+		return json.Unmarshal(data, &f.Content)
+	}
+	type plain SyncFile
+	return json.Unmarshal(data, (*plain)(f))
 }
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	jsonResponse(w, http.StatusOK, map[string]interface{}{
-		"status":    "healthy",
-		"timestamp": time.Now().UTC().Format(time.RFC3339),
-	})
+// commandTailBytes bounds how much of each output stream a command result keeps.
+const commandTailBytes = 64 << 10
+
+// commandOutput is the result of a streamed command: its exit code and the
+// tail of each output stream, for callers that need to parse the output.
+type commandOutput struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
 }
 
-type DevOpRequest struct {
-	Prewarm *PrewarmConfig `json:"prewarm,omitempty"`
+// tailBuffer is an io.Writer that keeps only the last max bytes written. It is
+// safe for concurrent use.
+type tailBuffer struct {
+	mu  sync.Mutex
+	max int
+	buf []byte
 }
 
-type PrewarmConfig struct {
-	Paths             []string `json:"paths"`
-	WaitForCompletion bool     `json:"wait_for_completion"`
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.max; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+	}
+	return len(p), nil
 }
 
-type DevOpResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
-	// Included only for start/restart operations
-	PID         int  `json:"pid,omitempty"`
-	ForceKilled bool `json:"force_killed,omitempty"`
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.buf)
 }
 
-func sendJSONResponse(w http.ResponseWriter, statusCode int, payload DevOpResponse) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	if err := json.NewEncoder(w).Encode(payload); err != nil {
-		log.Printf("Error encoding JSON response: %v", err)
+// lastLines returns up to n of the last complete or trailing lines held,
+// dropping a first line that may have been cut by the byte cap.
+func (t *tailBuffer) lastLines(n int) []string {
+	t.mu.Lock()
+	full := len(t.buf) >= t.max
+	t.mu.Unlock()
+	text := strings.TrimRight(t.String(), "\r\n")
+	if text == "" {
+		return nil
+	}
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	if full && len(lines) > 1 {
+		lines = lines[1:]
 	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
 }
 
-// performPrewarming sends GET requests to a list of paths to warm up the dev server.
-func performPrewarming(config PrewarmConfig, port int) {
-	log.Printf("Starting pre-warming for %d paths...", len(config.Paths))
+// runCommandAndStreamOutput executes a command in appDir and streams its output to the log broadcaster.
+func runCommandAndStreamOutput(command string, args []string) (commandOutput, error) {
+	return runCommandInDirAndStreamOutput(appDir, command, args)
+}
 
-	// Wait for the dev server to accept connections before prewarming.
-	// Treat either 2xx or 404 responses as "ready" (mirrors Node helper).
-	if !waitForServerReady(port, 20*time.Second) {
-		log.Printf("Dev server on port %d did not become ready within timeout; proceeding anyway", port)
+// runCommandInDirAndStreamOutput executes a command in dir and streams its
+// output to the log broadcaster. The returned commandOutput holds the exit
+// code (-1 if the command didn't run to completion) and the last
+// commandTailBytes of stdout and stderr.
+func runCommandInDirAndStreamOutput(dir, command string, args []string) (commandOutput, error) {
+	cmd := exec.Command(command, args...)
+	cmd.Dir = dir
+	return streamCommandOutput(cmd, nil)
+}
+
+// streamCommandOutput runs a prepared command like
+// runCommandInDirAndStreamOutput, calling started (if set) once it is running.
+func streamCommandOutput(cmd *exec.Cmd, started func()) (commandOutput, error) {
+	out := commandOutput{ExitCode: -1}
+	command, args, dir := cmd.Args[0], cmd.Args[1:], cmd.Dir
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return out, fmt.Errorf("failed to get stdout pipe for %s: %w", command, err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return out, fmt.Errorf("failed to get stderr pipe for %s: %w", command, err)
 	}
 
-	client := &http.Client{
-		Timeout: 10 * time.Second, // Timeout for each pre-warm request.
+	log.Printf("Running: %s %s in %s", command, strings.Join(args, " "), dir)
+	logBroadcaster.Submit(fmt.Sprintf("--- Running: %s %s ---", command, strings.Join(args, " ")))
+
+	if err := cmd.Start(); err != nil {
+		logBroadcaster.Submit(fmt.Sprintf("--- Failed to start command: %s ---", command))
+		return out, fmt.Errorf("failed to start command %s: %w", command, err)
+	}
+	if started != nil {
+		started()
 	}
+
+	phase := commandPhase(args)
+	stdoutTail := &tailBuffer{max: commandTailBytes}
+	stderrTail := &tailBuffer{max: commandTailBytes}
 	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		streamPipeToBroadcaster(io.TeeReader(stdout, stdoutTail), "STDOUT", phase)
+	}()
+	go func() {
+		defer wg.Done()
+		streamPipeToBroadcaster(io.TeeReader(stderr, stderrTail), "STDERR", phase)
+	}()
 
-	for _, path := range config.Paths {
-		if !strings.HasPrefix(path, "/") {
-			log.Printf("Skipping invalid pre-warm path: %s", path)
-			continue
-		}
+	wg.Wait() // Wait for pipes to be fully drained to capture all output.
 
-		wg.Add(1)
-		go func(p string) {
-			defer wg.Done()
-			url := fmt.Sprintf("http://localhost:%d%s", port, p)
-			log.Printf("Pre-warming path: %s", url)
-			resp, err := client.Get(url)
-			if err != nil {
-				log.Printf("Pre-warm request to %s failed: %v", url, err)
-				return
-			}
-			defer resp.Body.Close()
-			_, _ = io.Copy(io.Discard, resp.Body)
-			log.Printf("Pre-warmed %s - Status: %s", url, resp.Status)
-		}(path)
+	err = cmd.Wait()
+	out.Stdout = stdoutTail.String()
+	out.Stderr = stderrTail.String()
+	if cmd.ProcessState != nil {
+		out.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	if err != nil {
+		logBroadcaster.Submit(fmt.Sprintf("--- Command failed: %s %s (%v) ---", command, strings.Join(args, " "), err))
+		return out, err
 	}
 
-	wg.Wait()
-	log.Println("Pre-warming completed.")
+	logBroadcaster.Submit(fmt.Sprintf("--- Command finished successfully: %s %s ---", command, strings.Join(args, " ")))
+	return out, nil
 }
 
-// waitForServerReady polls the base URL until it responds (2xx or 404) or times out.
-func waitForServerReady(port int, timeout time.Duration) bool {
-	baseURL := fmt.Sprintf("http://localhost:%d", port)
-	deadline := time.Now().Add(timeout)
-	client := &http.Client{Timeout: 2 * time.Second}
-	for time.Now().Before(deadline) {
-		resp, err := client.Get(baseURL)
-		if err == nil {
-			status := resp.StatusCode
-			io.Copy(io.Discard, resp.Body)
-			resp.Body.Close()
-			if (status >= 200 && status < 300) || status == http.StatusNotFound {
-				return true
+// syncConcurrency bounds how many file operations /sync runs at once, and so
+// how many files it holds in memory and open.
+var syncConcurrency = 8
+
+// SyncFileResult is the outcome of a single /sync file operation.
+type SyncFileResult struct {
+	// Status is "written", "unchanged", "deleted", "failed", "conflict"
+	// when a patch's base checksum didn't match the file on disk, or
+	// "too_large" when the file exceeds -max-sync-file-bytes.
+	Status string `json:"status"`
+	// Change is "created", "modified", or "mode" when only the permissions
+	// changed, for written files.
+	Change string `json:"change,omitempty"`
+	// Mode is the resulting octal permission, e.g. "0755".
+	Mode  string `json:"mode,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// SyncResponse is the /sync response. Files maps each requested path to its
+// result so clients can retry only the paths that failed.
+type SyncResponse struct {
+	Success bool                      `json:"success"`
+	Message string                    `json:"message,omitempty"`
+	Error   string                    `json:"error,omitempty"`
+	Files   map[string]SyncFileResult `json:"files"`
+	// Reconcile reports whether dependency reconciliation ran (or, in a dry
+	// run, would run).
+	Reconcile bool `json:"reconcile,omitempty"`
+	// ReconcileSkipped reports that reconciliation was needed but not run
+	// because the request set skip_install.
+	ReconcileSkipped bool `json:"reconcile_skipped,omitempty"`
+	// DryRun is set when nothing was written; statuses describe what would
+	// have happened.
+	DryRun bool `json:"dry_run,omitempty"`
+	// SyncID identifies this sync in /sync/changes.
+	SyncID int64 `json:"sync_id,omitempty"`
+	// MirrorDeleted lists the files a mirror sync deleted (or, in a dry run,
+	// would delete) because the request didn't include them. They are also
+	// in Files.
+	MirrorDeleted []string `json:"mirror_deleted,omitempty"`
+	// Partial is set when the request failed partway through, after the
+	// files in Files marked written had already been written. They are kept,
+	// so a client can retry just the rest.
+	Partial bool `json:"partial,omitempty"`
+}
+
+func syncHandler(w http.ResponseWriter, r *http.Request) {
+	// ?dry_run=true validates and diffs every operation without touching disk
+	// or running the package manager.
+	dryRun := false
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			httpError(w, "Query parameter 'dry_run' must be a boolean", http.StatusBadRequest)
+			return
+		}
+		dryRun = b
+	}
+	w.Header().Set("Accept-Encoding", syncContentEncodings)
+	if maxSyncBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxSyncBytes)
+	}
+	body, err := decompressBody(r)
+	if err != nil {
+		code := http.StatusBadRequest
+		if errors.Is(err, errUnsupportedEncoding) {
+			code = http.StatusUnsupportedMediaType
+		}
+		httpError(w, err.Error(), code)
+		return
+	}
+	if body != r.Body && maxSyncBytes > 0 {
+		// The limit applies to the decompressed body too.
+		body = http.MaxBytesReader(w, io.NopCloser(body), maxSyncBytes)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		results   = make(map[string]SyncFileResult)
+		failed    int
+		conflicts int
+		tooLarge  int
+		// reconcileDirs holds the directories whose dependencies changed,
+		// as installDir gives them.
+		reconcileDirs = make(map[string]bool)
+		sem           = make(chan struct{}, syncConcurrency)
+		// keep holds the absolute paths the request includes, for mirror mode.
+		keep = make(map[string]bool)
+	)
+	record := func(p string, result SyncFileResult, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			log.Printf("Sync: operation on %s failed: %v", p, err)
+			status := "failed"
+			if errors.Is(err, errPatchConflict) {
+				status = "conflict"
+				conflicts++
+			} else if errors.Is(err, errSyncFileTooLarge) {
+				status = "too_large"
+				tooLarge++
 			}
+			results[p] = SyncFileResult{Status: status, Error: err.Error()}
+			failed++
+			return
 		}
-		time.Sleep(250 * time.Millisecond)
+		results[p] = result
+	}
+	// apply runs a file write or patch and records its outcome, noting
+	// whether a package.json change needs an install.
+	apply := func(p string, op func() (fileWrite, error)) {
+		isPackageJSON := slices.Contains(dependencyManifests(), filepath.Clean(p))
+		var before *PackageJSON
+		if isPackageJSON {
+			before, _ = readPackageJSON(filepath.Join(appDir, filepath.Dir(filepath.Clean(p))))
+		}
+		fw, err := op()
+		result := SyncFileResult{Status: "written", Change: fw.Change, Mode: formatFileMode(fw.Mode)}
+		if fw.Change == "" {
+			result.Status = "unchanged"
+		}
+		record(p, result, err)
+		if isPackageJSON && err == nil {
+			if shouldReconcile(before, fw.Data) {
+				mu.Lock()
+				reconcileDirs[installDir(p)] = true
+				mu.Unlock()
+			}
+		}
+	}
+	// spawn runs fn in the background, at most syncConcurrency at once.
+	spawn := func(fn func()) {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn()
+		}()
+	}
+	write := func(p string, op func() (fileWrite, error)) {
+		spawn(func() { apply(p, op) })
 	}
-	return false
-}
 
-func handleDevOperation(w http.ResponseWriter, r *http.Request, operation string) {
-	devOpMutex.Lock()
-	defer devOpMutex.Unlock()
+	// Apply file changes concurrently as they are decoded.
+	req, err := decodeSyncRequest(body, func(p string, file SyncFile) {
+		if dest, err := resolveWithinAppDir(p); err == nil {
+			keep[dest] = true
+		}
+		op := func() (fileWrite, error) {
+			return writeFileBase64(p, file, dryRun)
+		}
+		if file.stream != nil {
+			// It is read from the body, so it must be written before
+			// decoding moves on.
+			apply(p, op)
+			return
+		}
+		write(p, op)
+	})
+	// fail reports a request that failed after decoding started. Files
+	// decoded before the failure have been written by then; they are listed
+	// and recorded as a partial sync rather than left unreported.
+	fail := func(code int, msg string, err error) {
+		wg.Wait()
+		resp := SyncResponse{Error: msg, Files: results, DryRun: dryRun}
+		written := 0
+		for _, result := range results {
+			if result.Status == "written" {
+				written++
+			}
+		}
+		if written > 0 && !dryRun {
+			resp.Partial = true
+			resp.Error = fmt.Sprintf("%s; %d files written before the error were kept", msg, written)
+			resp.SyncID = syncChanges.recordResults(results)
+		}
+		if err != nil {
+			log.Printf("HTTP Error %d: %s: %v", code, resp.Error, err)
+		} else {
+			log.Printf("HTTP Error %d: %s", code, resp.Error)
+		}
+		jsonResponse(w, code, resp)
+	}
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			fail(http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds the %d byte limit; sync fewer files at once", maxErr.Limit), nil)
+			return
+		}
+		if errors.Is(err, errCompressedBody) {
+			fail(http.StatusBadRequest, "Invalid compressed body", err)
+			return
+		}
+		fail(http.StatusBadRequest, "Invalid JSON body", err)
+		return
+	}
+	if req.Mode != "" && req.Mode != syncModeMirror {
+		fail(http.StatusBadRequest, fmt.Sprintf("Field 'mode' must be %q when set", syncModeMirror), nil)
+		return
+	}
+	// Patches arrive outside the streamed "files" object, so they start once
+	// the body has been read.
+	for p, patch := range req.Patches {
+		if dest, err := resolveWithinAppDir(p); err == nil {
+			keep[dest] = true
+		}
+		write(p, func() (fileWrite, error) {
+			return applyPatch(p, patch, dryRun)
+		})
+	}
+	wg.Wait()
 
-	pid, err := readPID()
-	isAlive := err == nil && isProcessAlive(pid)
+	for _, p := range req.DeletedFilePaths {
+		spawn(func() {
+			if dryRun {
+				result, err := planDelete(p)
+				record(p, result, err)
+				return
+			}
+			record(p, SyncFileResult{Status: "deleted"}, deletePath(p))
+		})
+	}
+	wg.Wait()
 
-	// Optional request body for pre-warming config.
-	var req DevOpRequest
-	if r.ContentLength > 0 {
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
-			sendJSONResponse(w, http.StatusBadRequest, DevOpResponse{
-				Success: false,
-				Message: fmt.Sprintf("Invalid JSON body: %v", err),
-			})
+	var mirrorDeleted []string
+	if req.Mode == syncModeMirror {
+		extraneous, err := mirrorExtraneous(keep)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to list files to mirror: %v", err)
+			log.Printf("HTTP Error %d: %s", http.StatusInternalServerError, msg)
+			jsonResponse(w, http.StatusInternalServerError, SyncResponse{Error: msg, Files: results, DryRun: dryRun})
 			return
 		}
+		if len(extraneous) > 0 && !dryRun {
+			logBroadcaster.Submit(fmt.Sprintf("--- Mirror sync: deleting %d files not in the sync ---", len(extraneous)))
+		}
+		for _, p := range extraneous {
+			spawn(func() {
+				if dryRun {
+					result, err := planDelete(p)
+					record(p, result, err)
+					return
+				}
+				record(p, SyncFileResult{Status: "deleted"}, deletePath(p))
+			})
+		}
+		wg.Wait()
+		for _, p := range extraneous {
+			if results[p].Status == "deleted" {
+				mirrorDeleted = append(mirrorDeleted, p)
+			}
+		}
+		if !dryRun {
+			removeEmptyParents(mirrorDeleted)
+		}
 	}
 
-	switch operation {
-	case "stop":
-		if !isAlive {
-			sendJSONResponse(w, http.StatusOK, DevOpResponse{
-				Success: true,
-				Message: "Dev server not running",
+	reconcile := len(reconcileDirs) > 0
+	reconcileSkipped := reconcile && req.SkipInstall
+	if reconcileSkipped {
+		reconcile = false
+	}
+
+	// Nothing succeeded: report a plain failure.
+	if failed > 0 && failed == len(results) {
+		code := http.StatusInternalServerError
+		if conflicts == failed {
+			code = http.StatusConflict
+		} else if tooLarge == failed {
+			code = http.StatusRequestEntityTooLarge
+		}
+		jsonResponse(w, code, SyncResponse{
+			Error:  fmt.Sprintf("All %d file operations failed", failed),
+			Files:  results,
+			DryRun: dryRun,
+		})
+		return
+	}
+
+	if dryRun {
+		code := http.StatusOK
+		if failed > 0 {
+			code = http.StatusMultiStatus
+		}
+		jsonResponse(w, code, SyncResponse{
+			Success:          failed == 0,
+			Message:          fmt.Sprintf("Dry run: %d file operations checked, %d would fail", len(results), failed),
+			Files:            results,
+			Reconcile:        reconcile,
+			ReconcileSkipped: reconcileSkipped,
+			DryRun:           true,
+			MirrorDeleted:    mirrorDeleted,
+		})
+		return
+	}
+
+	syncID := syncChanges.recordResults(results)
+
+	// If package.json was changed, run npm install and prune.
+	var depMessages []string
+	if reconcileSkipped {
+		log.Println("Skipping dependency reconciliation: the sync set skip_install.")
+		logBroadcaster.Submit("--- package.json updated. Skipping dependency reconciliation (skip_install) ---")
+	}
+	if reconcile {
+		logBroadcaster.Submit("--- package.json updated. Reconciling dependencies... ---")
+		var depErrors []string
+		depMessages, depErrors = requestReconciles(reconcileDirs)
+		if len(depErrors) > 0 {
+			jsonResponse(w, http.StatusInternalServerError, SyncResponse{
+				Error:  strings.Join(depErrors, "; "),
+				Files:  results,
+				SyncID: syncID,
 			})
 			return
 		}
-		forceKilled, err := stopDevServer()
+	}
+
+	code := http.StatusOK
+	finalMessage := "Files synced successfully"
+	if failed > 0 {
+		// Some operations succeeded and some failed.
+		code = http.StatusMultiStatus
+		finalMessage = fmt.Sprintf("%d of %d file operations failed", failed, len(results))
+	}
+	if len(depMessages) > 0 {
+		finalMessage = fmt.Sprintf("%s. %s", finalMessage, strings.Join(depMessages, " "))
+	}
+	jsonResponse(w, code, SyncResponse{
+		Success:          failed == 0,
+		Message:          finalMessage,
+		Files:            results,
+		Reconcile:        reconcile,
+		ReconcileSkipped: reconcileSkipped,
+		SyncID:           syncID,
+		MirrorDeleted:    mirrorDeleted,
+	})
+}
+
+// shouldReconcile decides whether a synced package.json requires a dependency
+// install, given the manifest as it was before the write and the new content
+// (nil if unchanged). Only changes to dependencies or devDependencies count;
+// edits to scripts, version and so on don't. The decision is logged either way.
+func shouldReconcile(before *PackageJSON, data []byte) bool {
+	if data == nil {
+		log.Println("package.json content unchanged; skipping dependency reconciliation.")
+		return false
+	}
+	if before == nil {
+		log.Println("package.json is new or was unreadable; reconciling dependencies.")
+		return true
+	}
+	var after PackageJSON
+	if err := json.Unmarshal(data, &after); err != nil {
+		log.Printf("package.json could not be parsed (%v); reconciling dependencies.", err)
+		return true
+	}
+	if !maps.Equal(before.Dependencies, after.Dependencies) {
+		log.Println("package.json dependencies changed; reconciling dependencies.")
+		return true
+	}
+	if !maps.Equal(before.DevDependencies, after.DevDependencies) {
+		log.Println("package.json devDependencies changed; reconciling dependencies.")
+		return true
+	}
+	log.Println("package.json changed outside dependencies/devDependencies; skipping dependency reconciliation.")
+	return false
+}
+
+// reconcileDependencies runs the detected package manager's install followed
+// by a prune in dir, streaming output to the log broadcaster. It returns
+// success messages and errors. The files it reconciles have already been
+// written, so rather than failing it waits for any install already running.
+func reconcileDependencies(dir string) (messages []string, errs []string) {
+	if !installMu.TryLock() {
+		log.Println("Waiting for the running install to finish before reconciling dependencies")
+		logBroadcaster.Submit("--- Waiting for the running install to finish... ---")
+		installMu.Lock()
+	}
+	defer installMu.Unlock()
+
+	pm := detectPackageManager(dir)
+	where := ""
+	if rel, err := filepath.Rel(appDir, dir); err == nil && rel != "." {
+		where = fmt.Sprintf(" in %s", rel)
+	}
+	log.Printf("Reconciling dependencies%s with %s", where, pm.Name)
+
+	// Install dependencies.
+	if out, cancelled, err := runDependencyInstall(dir, pm, nil); err != nil {
+		msg := fmt.Sprintf("%s install failed: %v", pm.Name, err)
+		if cancelled {
+			msg = fmt.Sprintf("%s install was cancelled", pm.Name)
+		}
+		if diag := diagnoseInstallFailure(out.Stderr + "\n" + out.Stdout); diag != nil {
+			msg = fmt.Sprintf("%s (%s: %s)", msg, diag.Category, diag.Hint)
+		}
+		log.Println(msg)
+		errs = append(errs, msg)
+	} else {
+		messages = append(messages, fmt.Sprintf("%s install%s completed successfully.", pm.Name, where))
+		// Prune unused dependencies after install.
+		if pm.PruneArgs != nil {
+			if _, cancelled, err := runInstallCommandIn(dir, pm.Name, pm.PruneArgs); err != nil {
+				msg := fmt.Sprintf("%s prune failed: %v", pm.Name, err)
+				if cancelled {
+					msg = fmt.Sprintf("%s prune was cancelled", pm.Name)
+				}
+				log.Println(msg)
+				errs = append(errs, msg)
+			} else {
+				messages = append(messages, fmt.Sprintf("%s prune completed successfully.", pm.Name))
+			}
+		}
+	}
+	logBroadcaster.Submit("--- Dependency reconciliation finished. ---")
+	result := "success"
+	if len(errs) > 0 {
+		result = "failure"
+	}
+	reconcilesTotal.Add(1, "result", result)
+	return messages, errs
+}
+
+func fsReadHandler(w http.ResponseWriter, r *http.Request) {
+	filePath := r.URL.Query().Get("path")
+	if filePath == "" {
+		http.Error(w, "Query parameter 'path' is required", http.StatusBadRequest)
+		return
+	}
+
+	resolvedPath, err := resolveWithinAppDir(filePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	info, err := os.Stat(resolvedPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "File not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to access path", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if info.IsDir() {
+		http.Error(w, "Path is a directory, not a file", http.StatusBadRequest)
+		return
+	}
+
+	http.ServeFile(w, r, resolvedPath)
+}
+
+type FsEntry struct {
+	RelativePath string `json:"relative_path"`
+	Type         string `json:"type"` // "file" or "directory"
+}
+
+func fsListHandler(w http.ResponseWriter, r *http.Request) {
+	dirPath := r.URL.Query().Get("path")
+	if dirPath == "" {
+		dirPath = "."
+	}
+
+	recursiveParam := r.URL.Query().Get("recursive")
+	isRecursive, _ := strconv.ParseBool(recursiveParam)
+
+	resolvedPath, err := resolveWithinAppDir(dirPath)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var fsEntries []FsEntry
+
+	if isRecursive {
+		err := filepath.WalkDir(resolvedPath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path == resolvedPath {
+				return nil
+			}
+
+			relativePath, err := filepath.Rel(resolvedPath, path)
+			if err != nil {
+				return err
+			}
+
+			entryType := "file"
+			if d.IsDir() {
+				entryType = "directory"
+			}
+			fsEntries = append(fsEntries, FsEntry{RelativePath: relativePath, Type: entryType})
+			return nil
+		})
+
 		if err != nil {
-			httpError(w, fmt.Sprintf("Failed to stop dev server: %v", err), http.StatusInternalServerError)
+			httpError(w, fmt.Sprintf("Failed during recursive directory scan: %v", err), http.StatusInternalServerError)
 			return
 		}
-		sendJSONResponse(w, http.StatusOK, DevOpResponse{
-			Success:     true,
-			Message:     "Dev server stopped successfully",
-			ForceKilled: forceKilled,
-		})
 
-	case "start":
-		if isAlive {
-			httpError(w, "Already running", http.StatusConflict)
+	} else {
+		entries, err := os.ReadDir(resolvedPath)
+		if err != nil {
+			httpError(w, fmt.Sprintf("Could not read directory: %v", err), http.StatusInternalServerError)
 			return
 		}
-		newPid, err := startDevServer(defaultAppPort, req.Prewarm)
+
+		for _, entry := range entries {
+			entryType := "file"
+			if entry.IsDir() {
+				entryType = "directory"
+			}
+			fsEntries = append(fsEntries, FsEntry{RelativePath: entry.Name(), Type: entryType})
+		}
+	}
+
+	jsonResponse(w, http.StatusOK, fsEntries)
+}
+
+type InstallRequest struct {
+	ExtraArgs []string `json:"extra_args"`
+}
+
+func dependenciesInstallHandler(w http.ResponseWriter, r *http.Request) {
+	var req InstallRequest
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !installMu.TryLock() {
+		httpError(w, "An install is already running", http.StatusConflict)
+		return
+	}
+	defer installMu.Unlock()
+
+	pm := detectPackageManager(appDir)
+
+	// Output streams to /dev/logs as the install runs; the response carries
+	// the tail of it, which is where failures are reported.
+	out, cancelled, err := runDependencyInstall(appDir, pm, req.ExtraArgs)
+	if err != nil {
+		output := strings.TrimSpace(out.Stderr + "\n" + out.Stdout)
+		if output == "" {
+			// e.g. the package manager isn't installed.
+			output = err.Error()
+		}
+		log.Printf("%s install failed: %v", pm.Name, err)
+		resp := map[string]interface{}{
+			"success":       false,
+			"exit_code":     out.ExitCode,
+			"error_message": output,
+		}
+		if cancelled {
+			resp["cancelled"] = true
+			resp["error_message"] = "Install was cancelled; node_modules may be incomplete until the next install"
+			jsonResponse(w, http.StatusInternalServerError, resp)
+			return
+		}
+		if diag := diagnoseInstallFailure(output); diag != nil {
+			resp["diagnostic"] = diag
+		}
+		jsonResponse(w, http.StatusInternalServerError, resp)
+		return
+	}
+
+	log.Printf("%s install completed successfully", pm.Name)
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"success": true, "exit_code": 0})
+}
+
+type RunScriptRequest struct {
+	Script string   `json:"script"`
+	Args   []string `json:"args"`
+	// Cwd is a subdirectory of appDir to run the script in, e.g. a workspace
+	// package. Defaults to projectDir.
+	Cwd string `json:"cwd,omitempty"`
+}
+
+// runScriptHandler runs a package.json script, streaming its output to the
+// log broadcaster, and reports the exit code once it finishes.
+func runScriptHandler(w http.ResponseWriter, r *http.Request) {
+	var req RunScriptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if req.Script == "" {
+		httpError(w, "Field 'script' is required", http.StatusBadRequest)
+		return
+	}
+
+	dir := projectDir()
+	if req.Cwd != "" {
+		resolved, err := resolveWithinAppDir(req.Cwd)
+		if err != nil {
+			httpError(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if info, err := os.Stat(resolved); err != nil || !info.IsDir() {
+			httpError(w, fmt.Sprintf("cwd %q is not a directory", req.Cwd), http.StatusBadRequest)
+			return
+		}
+		dir = resolved
+	}
+
+	pkg, err := readPackageJSON(dir)
+	if err != nil {
+		httpError(w, fmt.Sprintf("Could not read package.json: %v", err), http.StatusBadRequest)
+		return
+	}
+	if _, ok := pkg.Scripts[req.Script]; !ok {
+		httpError(w, fmt.Sprintf("Script %q not found in package.json", req.Script), http.StatusBadRequest)
+		return
+	}
+
+	// Workspaces keep their lockfile at the repository root, so detect there.
+	pm := detectPackageManager(appDir)
+	args := []string{"run", req.Script}
+	if len(req.Args) > 0 {
+		// npm needs "--" to forward arguments to the script; the others pass them through.
+		if pm.Name == npmManager.Name {
+			args = append(args, "--")
+		}
+		args = append(args, req.Args...)
+	}
+
+	out, err := runCommandInDirAndStreamOutput(dir, pm.Name, args)
+	resp := map[string]interface{}{
+		"success":   err == nil,
+		"script":    req.Script,
+		"exit_code": out.ExitCode,
+	}
+	if err != nil {
+		// The tail of stderr usually holds the failure, e.g. a compiler error.
+		resp["stderr"] = out.Stderr
+	}
+	jsonResponse(w, http.StatusOK, resp)
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	packageManager := detectPackageManager(appDir).Name
+	status := map[string]interface{}{
+		"running":         false,
+		"pid":             nil,
+		"package_manager": packageManager,
+		"maintenance":     currentMaintenance(),
+		"auto_restart":    autoRestartStatus(),
+	}
+	if rec, err := readPIDFile(); err == nil && isProcessAlive(rec.PID) {
+		status["running"] = true
+		status["pid"] = rec.PID
+		if rec.Port != 0 {
+			status["port"] = rec.Port
+		}
+		if readyPattern != nil {
+			status["ready_logged"] = ownedDevProcessReady(rec.PID)
+		}
+		if !rec.StartedAt.IsZero() {
+			status["started_at"] = rec.StartedAt.Format(time.RFC3339)
+			status["uptime_seconds"] = int64(time.Since(rec.StartedAt).Seconds())
+		}
+	}
+	lastExitMu.Lock()
+	if lastExit != nil {
+		status["last_exit_code"] = lastExit.ExitCode
+		status["last_exit_reason"] = lastExit.Reason
+		status["last_exit_at"] = lastExit.At.Format(time.RFC3339)
+		status["last_stderr"] = lastExit.Stderr
+	}
+	lastExitMu.Unlock()
+	jsonResponse(w, http.StatusOK, status)
+}
+
+// resolveHandler reports the dev command that would be used for a directory
+// within appDir, without starting anything.
+func resolveHandler(w http.ResponseWriter, r *http.Request) {
+	dirPath := r.URL.Query().Get("path")
+	if dirPath == "" {
+		dirPath = "."
+		if appSubdir != "" {
+			dirPath = appSubdir
+		}
+	}
+
+	resolvedPath, err := resolveWithinAppDir(dirPath)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	info, err := os.Stat(resolvedPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			httpError(w, "Directory not found", http.StatusNotFound)
+		} else {
+			httpError(w, "Failed to access path", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !info.IsDir() {
+		httpError(w, "Path is a file, not a directory", http.StatusBadRequest)
+		return
+	}
+
+	// -dev-command only replaces detection where the dev server runs.
+	var override []string
+	if resolvedPath == projectDir() {
+		override = devCommandOverride
+	}
+	dc, overridden, err := selectDevCommand(resolvedPath, defaultAppPort, override)
+	if err != nil {
+		jsonResponse(w, http.StatusOK, map[string]interface{}{
+			"path":     dirPath,
+			"resolved": false,
+			"error":    err.Error(),
+		})
+		return
+	}
+	resp := map[string]interface{}{
+		"path":     dirPath,
+		"resolved": true,
+		"command":  dc.Command,
+		"args":     dc.Args,
+		"reason":   dc.Reason,
+	}
+	if overridden {
+		resp["override"] = true
+	}
+	jsonResponse(w, http.StatusOK, resp)
+}
+
+// DevCommandResponse is the /dev/command result.
+type DevCommandResponse struct {
+	Resolved bool     `json:"resolved"`
+	Command  string   `json:"command,omitempty"`
+	Args     []string `json:"args,omitempty"`
+	Reason   string   `json:"reason,omitempty"`
+	// Env is the framework's own variables; see devCommand.
+	Env map[string]string `json:"env,omitempty"`
+	// Override is set when -dev-command replaces detection.
+	Override bool   `json:"override,omitempty"`
+	Dir      string `json:"dir"`
+	Port     int    `json:"port"`
+	Error    string `json:"error,omitempty"`
+	// FoundScripts and FoundDependencies list what package.json has when
+	// nothing resolved.
+	FoundScripts      []string `json:"found_scripts,omitempty"`
+	FoundDependencies []string `json:"found_dependencies,omitempty"`
+}
+
+// devCommandHandler reports the command a start without dev_command would
+// run, and why, without starting anything.
+func devCommandHandler(w http.ResponseWriter, r *http.Request) {
+	dir := appSubdir
+	if dir == "" {
+		dir = "."
+	}
+	resp := DevCommandResponse{Dir: dir, Port: defaultAppPort}
+	dc, overridden, err := selectDevCommand(projectDir(), defaultAppPort, devCommandOverride)
+	resp.Override = overridden
+	if err != nil {
+		resp.Error = err.Error()
+		var noCmd *noDevCommandError
+		if errors.As(err, &noCmd) {
+			resp.FoundScripts, resp.FoundDependencies = noCmd.Scripts, noCmd.Dependencies
+		}
+		jsonResponse(w, http.StatusOK, resp)
+		return
+	}
+	resp.Resolved = true
+	resp.Command, resp.Args, resp.Reason, resp.Env = dc.Command, dc.Args, dc.Reason, dc.Env
+	jsonResponse(w, http.StatusOK, resp)
+}
+
+func startHandler(w http.ResponseWriter, r *http.Request) {
+	handleDevOperation(w, r, "start")
+}
+
+func stopHandler(w http.ResponseWriter, r *http.Request) {
+	handleDevOperation(w, r, "stop")
+}
+
+func restartHandler(w http.ResponseWriter, r *http.Request) {
+	handleDevOperation(w, r, "restart")
+}
+
+// healthHandler answers liveness probes. ?verbose=true adds the build
+// version, uptime, configuration and dev server state, which are all cheap
+// enough to keep it usable as a probe.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	verbose := false
+	if v := r.URL.Query().Get("verbose"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			httpError(w, "Query parameter 'verbose' must be a boolean", http.StatusBadRequest)
+			return
+		}
+		verbose = b
+	}
+
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	resp := map[string]interface{}{
+		"status":    "healthy",
+		"timestamp": timestamp,
+	}
+	code := http.StatusOK
+	checkDev := healthMode == healthModeDev && devServerExpected.Load()
+	var pid int
+	running := false
+	if checkDev || verbose {
+		var err error
+		pid, err = readPID()
+		running = err == nil && isProcessAlive(pid)
+	}
+	if checkDev && !running {
+		code = http.StatusServiceUnavailable
+		resp["status"] = "unhealthy"
+		resp["reason"] = "dev server is expected to be running but is not"
+	}
+	if verbose {
+		resp["version"] = version
+		resp["uptime_seconds"] = int64(time.Since(controlPlaneStartedAt).Seconds())
+		resp["app_dir"] = appDir
+		resp["default_app_port"] = defaultAppPort
+		devServer := map[string]interface{}{"running": running}
+		if running {
+			devServer["pid"] = pid
+		}
+		resp["dev_server"] = devServer
+	}
+	jsonResponse(w, code, resp)
+}
+
+// healthzHandler answers liveness probes: it succeeds whenever the control
+// plane can serve a request, whatever the dev server is doing.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, http.StatusOK, map[string]string{
+		"status":    "alive",
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// readyzHandler answers readiness probes: 200 when the dev server meets
+// -readiness-check, 503 otherwise, with the probe result either way.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	var probe appProbe
+	if readinessCheck == readinessProcess {
+		if pid, err := readPID(); err == nil && isProcessAlive(pid) {
+			probe = appProbe{State: probeRunning, Ready: true, PID: pid}
+		} else {
+			probe = appProbe{State: probeProcessDead}
+		}
+	} else {
+		probe = probeApp(currentAppPort(), readinessPath)
+	}
+	code := http.StatusOK
+	if !probe.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	jsonResponse(w, code, probe)
+}
+
+// App probe states reported by /dev/health-check and /readyz.
+const (
+	probeProcessDead  = "process_dead"
+	probeRunning      = "running" // Only with -readiness-check=process.
+	probeNotListening = "not_listening"
+	probeUnresponsive = "unresponsive"
+	probeResponding   = "responding"
+)
+
+// appHealthCheckTimeout bounds the single probe made by /dev/health-check.
+const appHealthCheckTimeout = 5 * time.Second
+
+// appProbe is the /dev/health-check response.
+type appProbe struct {
+	State      string `json:"state"`
+	Ready      bool   `json:"ready"`
+	PID        int    `json:"pid,omitempty"`
+	URL        string `json:"url,omitempty"`
+	StatusCode int    `json:"status_code,omitempty"`
+	LatencyMS  int64  `json:"latency_ms,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// appHealthCheckHandler makes one HTTP request to the dev server at ?path=
+// (default "/") and reports whether the process is dead, alive but not
+// listening, or listening and responding. It answers 503 unless the app is
+// ready, using the same criteria as startup readiness.
+func appHealthCheckHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		path = "/"
+	}
+	if !strings.HasPrefix(path, "/") {
+		httpError(w, "Query parameter 'path' must start with '/'", http.StatusBadRequest)
+		return
+	}
+
+	probe := probeApp(currentAppPort(), path)
+	code := http.StatusOK
+	if !probe.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	jsonResponse(w, code, probe)
+}
+
+// probeApp checks the dev server process and makes a single request to path
+// on port.
+func probeApp(port int, path string) appProbe {
+	pid, err := readPID()
+	if err != nil || !isProcessAlive(pid) {
+		return appProbe{State: probeProcessDead}
+	}
+	probe := appProbe{PID: pid, URL: fmt.Sprintf("http://localhost:%d%s", port, path)}
+	client := &http.Client{Timeout: appHealthCheckTimeout}
+	start := time.Now()
+	resp, err := client.Get(probe.URL)
+	probe.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		probe.State = probeUnresponsive
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			probe.State = probeNotListening
+		}
+		probe.Error = err.Error()
+		return probe
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	probe.State = probeResponding
+	probe.StatusCode = resp.StatusCode
+	probe.Ready = isReadyStatus(resp.StatusCode)
+	return probe
+}
+
+// isReadyStatus reports whether a response status means the dev server is
+// serving: 2xx, or 404 for apps without a route at the probed path.
+func isReadyStatus(status int) bool {
+	return (status >= 200 && status < 300) || status == http.StatusNotFound
+}
+
+type DevOpRequest struct {
+	Prewarm *PrewarmConfig `json:"prewarm,omitempty"`
+	// DevCommand overrides the resolved dev command for start/restart, e.g.
+	// "npm run dev:web --workspace=apps/web".
+	DevCommand *string `json:"dev_command,omitempty"`
+	// Port overrides -default-app-port for start/restart.
+	Port *int `json:"port,omitempty"`
+	// GracePeriodSeconds overrides -stop-grace-period for stop/restart. With
+	// -stop-sequence it replaces the wait after the last signal.
+	GracePeriodSeconds *float64 `json:"grace_period_seconds,omitempty"`
+	// Env adds variables to the dev server's environment for start/restart,
+	// e.g. {"NODE_ENV": "development"}. PORT and HOST are rejected unless
+	// OverridePortHost is set.
+	Env              map[string]string `json:"env,omitempty"`
+	OverridePortHost bool              `json:"override_port_host,omitempty"`
+	// StartupTimeoutSeconds overrides -startup-timeout for start/restart.
+	StartupTimeoutSeconds *float64 `json:"startup_timeout_seconds,omitempty"`
+	// ReclaimPort overrides -reclaim-port for start/restart.
+	ReclaimPort *bool `json:"reclaim_port,omitempty"`
+}
+
+// devStartOptions configures a dev server start.
+type devStartOptions struct {
+	Port    int
+	Prewarm *PrewarmConfig
+	// Command overrides the resolved dev command when non-empty.
+	Command []string
+	// Env is merged over the control plane's environment, PORT and HOST.
+	Env map[string]string
+	// StartupTimeout, when positive, is how long to wait for readiness.
+	StartupTimeout time.Duration
+	// ReclaimPort kills a leftover app process holding Port.
+	ReclaimPort bool
+}
+
+type PrewarmConfig struct {
+	Paths             []string `json:"paths"`
+	WaitForCompletion bool     `json:"wait_for_completion"`
+	// Concurrency caps how many paths are warmed at once; zero or less uses
+	// -prewarm-concurrency.
+	Concurrency int `json:"concurrency,omitempty"`
+	// Sequential warms one path at a time in the given order, for frameworks
+	// where compiling routes concurrently thrashes.
+	Sequential bool `json:"sequential,omitempty"`
+}
+
+type DevOpResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	// Included only for start/restart operations
+	PID         int  `json:"pid,omitempty"`
+	ForceKilled bool `json:"force_killed,omitempty"`
+	// PrewarmResults and PrewarmDurationMs are included when the start
+	// waited for prewarming to complete.
+	PrewarmResults    []PrewarmResult `json:"prewarm_results,omitempty"`
+	PrewarmDurationMs *int64          `json:"prewarm_duration_ms,omitempty"`
+	// StopDurationMs is how long stopping the running process took; nil if
+	// there was nothing to stop.
+	StopDurationMs *int64 `json:"stop_duration_ms,omitempty"`
+	// Ready is included when the start waited for readiness: false means the
+	// server was still starting when the startup timeout ran out.
+	Ready *bool `json:"ready,omitempty"`
+	// StartupExit describes a dev server that exited during startup.
+	StartupExit *devExitInfo `json:"startup_exit,omitempty"`
+	// PortInUse describes what held the port when a start was refused.
+	PortInUse *portInUseError `json:"port_in_use,omitempty"`
+}
+
+// setStart adds what a start waited for to the response.
+func (r *DevOpResponse) setStart(report *startReport) {
+	if report == nil {
+		return
+	}
+	if report.Prewarm != nil {
+		r.PrewarmResults = report.Prewarm.Results
+		r.PrewarmDurationMs = durationMs(report.Prewarm.Duration)
+	}
+	r.Ready = report.Ready
+}
+
+// sendStartError reports a failed start or restart, with the exit details if
+// the dev server died during startup.
+func sendStartError(w http.ResponseWriter, err error) {
+	var portErr *portInUseError
+	if errors.As(err, &portErr) {
+		log.Printf("Refusing to start dev server: %v", err)
+		sendJSONResponse(w, http.StatusConflict, DevOpResponse{
+			Success:   false,
+			Message:   fmt.Sprintf("Failed to start dev server: %v", err),
+			PortInUse: portErr,
+		})
+		return
+	}
+	var exitErr *startupExitError
+	if errors.As(err, &exitErr) {
+		sendJSONResponse(w, http.StatusInternalServerError, DevOpResponse{
+			Success:     false,
+			Message:     fmt.Sprintf("Failed to start dev server: %v", err),
+			StartupExit: &exitErr.Exit,
+		})
+		return
+	}
+	httpError(w, fmt.Sprintf("Failed to start dev server: %v", err), http.StatusInternalServerError)
+}
+
+// durationMs returns d in whole milliseconds, for optional response fields.
+func durationMs(d time.Duration) *int64 {
+	ms := d.Milliseconds()
+	return &ms
+}
+
+func sendJSONResponse(w http.ResponseWriter, statusCode int, payload DevOpResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
+}
+
+// PrewarmResult is the outcome of warming a single path.
+type PrewarmResult struct {
+	Path       string `json:"path"`
+	StatusCode int    `json:"status_code,omitempty"`
+	LatencyMs  int64  `json:"latency_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// prewarmReport is the outcome of a whole prewarm, results in the order the
+// paths were given.
+type prewarmReport struct {
+	Results  []PrewarmResult
+	Duration time.Duration
+}
+
+// OK reports whether the path was served without a client or server error.
+func (r PrewarmResult) OK() bool {
+	return r.Error == "" && r.StatusCode > 0 && r.StatusCode < 400
+}
+
+// performPrewarming sends GET requests to a list of paths to warm up the dev
+// server, at most config.Concurrency at a time. It starts once the server
+// answers HTTP or logReady is closed, whichever comes first.
+func performPrewarming(config PrewarmConfig, port int, logReady <-chan struct{}) prewarmReport {
+	started := time.Now()
+	log.Printf("Starting pre-warming for %d paths...", len(config.Paths))
+
+	// Wait for the dev server to accept connections before prewarming.
+	// Treat either 2xx or 404 responses as "ready" (mirrors Node helper).
+	if !waitForServerReady(port, 20*time.Second, logReady, nil) {
+		log.Printf("Dev server on port %d did not become ready within timeout; proceeding anyway", port)
+	}
+
+	client := &http.Client{
+		Timeout: 10 * time.Second, // Timeout for each pre-warm request.
+	}
+	var paths []string
+	seen := make(map[string]bool)
+	for _, path := range config.Paths {
+		if !strings.HasPrefix(path, "/") {
+			log.Printf("Skipping invalid pre-warm path: %s", path)
+			continue
+		}
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		paths = append(paths, path)
+	}
+
+	workers := config.Concurrency
+	if workers <= 0 {
+		workers = prewarmConcurrency
+	}
+	if config.Sequential {
+		workers = 1
+	}
+	if workers > len(paths) {
+		workers = len(paths)
+	}
+
+	// Workers take paths in order, so a single worker warms them sequentially.
+	results := make([]PrewarmResult, len(paths))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = prewarmPath(client, port, paths[i])
+			}
+		}()
+	}
+	for i := range paths {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	report := prewarmReport{Results: results, Duration: time.Since(started)}
+	ok := 0
+	for _, r := range results {
+		if r.OK() {
+			ok++
+		}
+	}
+	log.Printf("Pre-warming completed in %s: %d of %d paths OK.", report.Duration.Round(time.Millisecond), ok, len(results))
+	recordWarmPaths(results)
+	return report
+}
+
+// prewarmCall is an in-flight prewarm request shared by concurrent callers.
+type prewarmCall struct {
+	done   chan struct{}
+	result PrewarmResult
+}
+
+var (
+	// prewarmCallsMu guards prewarmCalls.
+	prewarmCallsMu sync.Mutex
+	// prewarmCalls holds in-flight prewarm requests keyed by URL.
+	prewarmCalls = make(map[string]*prewarmCall)
+)
+
+// prewarmPath requests p from the dev server on port. Concurrent warms of the
+// same URL, e.g. from a start and a restart overlapping, share one request so
+// the route isn't compiled twice.
+func prewarmPath(client *http.Client, port int, p string) PrewarmResult {
+	url := fmt.Sprintf("http://localhost:%d%s", port, p)
+	prewarmCallsMu.Lock()
+	if c, ok := prewarmCalls[url]; ok {
+		prewarmCallsMu.Unlock()
+		log.Printf("Pre-warm of %s already in flight; waiting for it", url)
+		<-c.done
+		return c.result
+	}
+	c := &prewarmCall{done: make(chan struct{})}
+	prewarmCalls[url] = c
+	prewarmCallsMu.Unlock()
+
+	defer func() {
+		prewarmCallsMu.Lock()
+		delete(prewarmCalls, url)
+		prewarmCallsMu.Unlock()
+		close(c.done)
+	}()
+
+	c.result = PrewarmResult{Path: p}
+	log.Printf("Pre-warming path: %s", url)
+	started := time.Now()
+	resp, err := client.Get(url)
+	if err != nil {
+		c.result.LatencyMs = time.Since(started).Milliseconds()
+		log.Printf("Pre-warm request to %s failed: %v", url, err)
+		c.result.Error = err.Error()
+		return c.result
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	c.result.LatencyMs = time.Since(started).Milliseconds()
+	c.result.StatusCode = resp.StatusCode
+	log.Printf("Pre-warmed %s - Status: %s (%dms)", url, resp.Status, c.result.LatencyMs)
+	return c.result
+}
+
+// waitForServerReady polls the base URL until it responds (2xx or 404), the
+// dev server logs that it is ready (logReady is closed; nil never fires), or
+// it times out. It gives up early, returning false, once exited is closed.
+func waitForServerReady(port int, timeout time.Duration, logReady, exited <-chan struct{}) bool {
+	baseURL := fmt.Sprintf("http://localhost:%d", port)
+	deadline := time.Now().Add(timeout)
+	client := &http.Client{Timeout: 2 * time.Second}
+	for time.Now().Before(deadline) {
+		select {
+		case <-logReady:
+			log.Printf("Dev server on port %d logged that it is ready", port)
+			return true
+		case <-exited:
+			return false
+		default:
+		}
+		resp, err := client.Get(baseURL)
+		if err == nil {
+			status := resp.StatusCode
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if isReadyStatus(status) {
+				return true
+			}
+		}
+		select {
+		case <-logReady:
+		case <-exited:
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+	return false
+}
+
+// waitForStartup waits up to timeout for dp to become ready, by HTTP on port
+// or its ready log line. If it exits first, its exit details are returned.
+func waitForStartup(dp *devProcess, port int, timeout time.Duration) (ready bool, exit *devExitInfo) {
+	logBroadcaster.Submit(fmt.Sprintf("--- Waiting up to %s for the server to become ready ---", timeout))
+	ready = waitForServerReady(port, timeout, dp.ready.ready, dp.done)
+	// Checking for an exit and handing the process back to its supervisor
+	// happen together, so an exit in between is reported exactly once: here
+	// or by auto-restart.
+	dp.handoffMu.Lock()
+	defer dp.handoffMu.Unlock()
+	select {
+	case <-dp.done:
+		// The supervisor records the exit before closing done.
+		lastExitMu.Lock()
+		info := *lastExit
+		lastExitMu.Unlock()
+		return false, &info
+	default:
+	}
+	dp.startupWatched.Store(false)
+	return ready, nil
+}
+
+func handleDevOperation(w http.ResponseWriter, r *http.Request, operation string) {
+	devOpMutex.Lock()
+	defer devOpMutex.Unlock()
+
+	pid, err := readPID()
+	isAlive := err == nil && isProcessAlive(pid)
+
+	// Optional request body for pre-warming config.
+	var req DevOpRequest
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			sendJSONResponse(w, http.StatusBadRequest, DevOpResponse{
+				Success: false,
+				Message: fmt.Sprintf("Invalid JSON body: %v", err),
+			})
+			return
+		}
+	}
+
+	opts := devStartOptions{Port: defaultAppPort, Prewarm: req.Prewarm, Command: devCommandOverride}
+	if req.DevCommand != nil {
+		argv, err := splitCommandLine(*req.DevCommand)
+		if err == nil && len(argv) == 0 {
+			err = fmt.Errorf("must not be empty")
+		}
+		if err != nil {
+			sendJSONResponse(w, http.StatusBadRequest, DevOpResponse{
+				Success: false,
+				Message: fmt.Sprintf("Invalid dev_command: %v", err),
+			})
+			return
+		}
+		opts.Command = argv
+	}
+	if req.Port != nil {
+		if err := validateAppPort(*req.Port); err != nil {
+			sendJSONResponse(w, http.StatusBadRequest, DevOpResponse{
+				Success: false,
+				Message: fmt.Sprintf("Invalid port: %v", err),
+			})
+			return
+		}
+		opts.Port = *req.Port
+	}
+	if err := validateDevEnv(req.Env, req.OverridePortHost); err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, DevOpResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid env: %v", err),
+		})
+		return
+	}
+	opts.Env = req.Env
+	steps := stopSteps()
+	if req.GracePeriodSeconds != nil {
+		g := time.Duration(*req.GracePeriodSeconds * float64(time.Second))
+		if *req.GracePeriodSeconds < 0 || g > maxStopGracePeriod {
+			sendJSONResponse(w, http.StatusBadRequest, DevOpResponse{
+				Success: false,
+				Message: fmt.Sprintf("Invalid grace_period_seconds: must be between 0 and %d", int(maxStopGracePeriod.Seconds())),
+			})
+			return
+		}
+		steps[len(steps)-1].Wait = g
+	}
+	opts.StartupTimeout = startupTimeout
+	if req.StartupTimeoutSeconds != nil {
+		t := time.Duration(*req.StartupTimeoutSeconds * float64(time.Second))
+		if *req.StartupTimeoutSeconds < 0 || t > maxStartupTimeout {
+			sendJSONResponse(w, http.StatusBadRequest, DevOpResponse{
+				Success: false,
+				Message: fmt.Sprintf("Invalid startup_timeout_seconds: must be between 0 and %d", int(maxStartupTimeout.Seconds())),
+			})
+			return
+		}
+		opts.StartupTimeout = t
+	}
+	opts.ReclaimPort = reclaimPort
+	if req.ReclaimPort != nil {
+		opts.ReclaimPort = *req.ReclaimPort
+	}
+
+	switch operation {
+	case "stop":
+		if !isAlive {
+			devServerExpected.Store(false)
+			sendJSONResponse(w, http.StatusOK, DevOpResponse{
+				Success: true,
+				Message: "Dev server not running",
+			})
+			return
+		}
+		devServerExpected.Store(false)
+		stopStart := time.Now()
+		forceKilled, err := stopDevServer(steps)
+		if err != nil {
+			httpError(w, fmt.Sprintf("Failed to stop dev server: %v", err), http.StatusInternalServerError)
+			return
+		}
+		sendJSONResponse(w, http.StatusOK, DevOpResponse{
+			Success:        true,
+			Message:        "Dev server stopped successfully",
+			ForceKilled:    forceKilled,
+			StopDurationMs: durationMs(time.Since(stopStart)),
+		})
+
+	case "start":
+		if isAlive {
+			httpError(w, "Already running", http.StatusConflict)
+			return
+		}
+		newPid, report, err := startDevServer(opts)
+		if err != nil {
+			sendStartError(w, err)
+			return
+		}
+		devServerExpected.Store(true)
+		resetAutoRestart(opts)
+		resp := DevOpResponse{
+			Success: true,
+			Message: "Dev server started successfully",
+			PID:     newPid,
+		}
+		resp.setStart(report)
+		sendJSONResponse(w, http.StatusAccepted, resp)
+
+	case "restart":
+		logBroadcaster.Submit("--- Server restarting... ---")
+		forceKilled := false
+		var stopDuration *int64
+		var err error
+		if isAlive {
+			stopStart := time.Now()
+			forceKilled, err = stopDevServer(steps)
+			stopDuration = durationMs(time.Since(stopStart))
+			if err != nil {
+				log.Printf("Failed to stop dev server during restart, proceeding anyway: %v", err)
+			}
+		}
+		newPid, report, err := startDevServer(opts)
+		if err != nil {
+			sendStartError(w, err)
+			return
+		}
+		devServerExpected.Store(true)
+		resetAutoRestart(opts)
+		devRestartsTotal.Add(1, "reason", "request")
+		resp := DevOpResponse{
+			Success:        true,
+			Message:        "Dev server restarted successfully",
+			PID:            newPid,
+			ForceKilled:    forceKilled,
+			StopDurationMs: stopDuration,
+		}
+		resp.setStart(report)
+		sendJSONResponse(w, http.StatusAccepted, resp)
+	}
+}
+
+// startDevServerAtBoot starts the dev server for -start-dev-server with the
+// defaults a POST /dev/start without a body uses. Failures are logged; the
+// control plane keeps running so a later start can be requested.
+func startDevServerAtBoot() {
+	devOpMutex.Lock()
+	defer devOpMutex.Unlock()
+	if pid, err := readPID(); err == nil && isProcessAlive(pid) {
+		log.Printf("Dev server (PID %d) is already running, not starting another at boot", pid)
+		return
+	}
+	opts := devStartOptions{
+		Port:           defaultAppPort,
+		Command:        devCommandOverride,
+		StartupTimeout: startupTimeout,
+		ReclaimPort:    reclaimPort,
+	}
+	pid, _, err := startDevServer(opts)
+	if err != nil {
+		log.Printf("Failed to start the dev server at boot: %v", err)
+		return
+	}
+	devServerExpected.Store(true)
+	resetAutoRestart(opts)
+	log.Printf("Dev server started at boot (PID %d)", pid)
+}
+
+// validateAppPort checks a dev server port from a request. It must be a valid
+// TCP port other than the one the control plane listens on.
+func validateAppPort(port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("%d is not between 1 and 65535", port)
+	}
+	for _, addr := range []string{listenAddr, adminListenAddr} {
+		if _, p, err := net.SplitHostPort(addr); err == nil && p == strconv.Itoa(port) {
+			return fmt.Errorf("%d is the control plane's own port", port)
+		}
+	}
+	return nil
+}
+
+// startReport describes what a start waited for; its fields are nil for
+// anything it didn't wait for.
+type startReport struct {
+	Prewarm *prewarmReport
+	// Ready reports whether the dev server became ready within
+	// opts.StartupTimeout.
+	Ready *bool
+}
+
+// startupExitError is returned when the dev server exits while a start is
+// waiting for it to become ready.
+type startupExitError struct {
+	Exit devExitInfo
+}
+
+func (e *startupExitError) Error() string {
+	return fmt.Sprintf("dev server exited during startup: %s", e.Exit.Reason)
+}
+
+// portInUseError is returned when the dev server's port is taken before it
+// starts, which would otherwise surface as an EADDRINUSE buried in its logs.
+type portInUseError struct {
+	Port int `json:"port"`
+	// PID and Name identify the listener; PID is 0 if it couldn't be found.
+	PID  int    `json:"pid,omitempty"`
+	Name string `json:"name,omitempty"`
+	// Orphan is set when the listener runs in the app dir, typically a dev
+	// server child left behind by a crash, which reclaim_port can kill.
+	Orphan bool `json:"orphan"`
+}
+
+func (e *portInUseError) Error() string {
+	switch {
+	case e.PID == 0:
+		return fmt.Sprintf("port %d is already in use by a process the control plane can't identify; free it or start on another port", e.Port)
+	case e.Orphan:
+		return fmt.Sprintf("port %d is in use by PID %d (%s), a leftover process from the app dir such as an orphaned dev server; retry with reclaim_port to kill it, or start on another port", e.Port, e.PID, e.Name)
+	}
+	return fmt.Sprintf("port %d is in use by PID %d (%s), which isn't part of the app; free it or start on another port", e.Port, e.PID, e.Name)
+}
+
+// portIsFree reports whether nothing listens on port, by trying to bind it.
+// Errors other than EADDRINUSE are left for the dev server to report.
+func portIsFree(port int) bool {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return !errors.Is(err, syscall.EADDRINUSE)
+	}
+	ln.Close()
+	return true
+}
+
+// checkDevPort returns a *portInUseError if port is taken. With reclaim, a
+// listener running in the app dir is killed along with its process group
+// first, the stop signal then SIGKILL after the grace period.
+func checkDevPort(port int, reclaim bool) error {
+	if portIsFree(port) {
+		return nil
+	}
+	portErr := &portInUseError{Port: port}
+	if pid, ok := portListenerPID(port); ok {
+		portErr.PID, portErr.Name = pid, processName(pid)
+		cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+		absAppDir, _ := filepath.Abs(appDir)
+		portErr.Orphan = err == nil && pid != os.Getpid() && isWithinDir(absAppDir, cwd)
+	}
+	if !portErr.Orphan || !reclaim {
+		return portErr
+	}
+
+	// Kill the whole group, unless it is ours, to take the orphan's siblings
+	// (e.g. a bundler worker) with it.
+	target := portErr.PID
+	if pgid, err := processGroup(portErr.PID); err == nil && pgid != syscall.Getpgrp() {
+		target = -pgid
+	}
+	log.Printf("Port %d is held by leftover PID %d (%s); killing it", port, portErr.PID, portErr.Name)
+	logBroadcaster.Submit(fmt.Sprintf("--- Killing leftover process %d (%s) holding port %d ---", portErr.PID, portErr.Name, port))
+	for _, step := range []stopStep{{stopSignal, stopGracePeriod}, {syscall.SIGKILL, 2 * time.Second}} {
+		syscall.Kill(target, step.Signal)
+		deadline := time.Now().Add(step.Wait)
+		for {
+			if portIsFree(port) {
+				return nil
+			}
+			if time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	return portErr
+}
+
+// maxStartupTimeout bounds the startup timeout, since starts hold devOpMutex.
+const maxStartupTimeout = 5 * time.Minute
+
+// startDevServer starts the dev server and prewarms it. With
+// opts.StartupTimeout, it first waits for the server to become ready and
+// returns a *startupExitError if it exits before then.
+func startDevServer(opts devStartOptions) (int, *startReport, error) {
+	port, prewarm := opts.Port, opts.Prewarm
+
+	dc, overridden, err := selectDevCommand(projectDir(), port, opts.Command)
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not resolve dev command: %w", err)
+	}
+	if overridden {
+		log.Printf("Using dev command override: %q", opts.Command)
+	}
+	cmd, args := dc.Command, dc.Args
+
+	if err := checkDevPort(port, opts.ReclaimPort); err != nil {
+		return 0, nil, err
+	}
+
+	log.Printf("Starting dev server: %q", append([]string{cmd}, args...))
+	proc := exec.Command(cmd, args...)
+	proc.Dir = projectDir()
+	proc.Env = devServerEnv(opts, dc.Env)
+	if len(opts.Env) > 0 {
+		log.Printf("Dev server environment: %s", redactedEnv(opts.Env))
+	}
+
+	// Crucial for robust process killing: create a new process group.
+	proc.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	// Capture stdout and stderr for log streaming. We create the pipes ourselves
+	// rather than using StdoutPipe so that reaping the process doesn't depend on
+	// the pipes being drained (grandchildren may keep them open).
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to create stdout pipe: %w", err)
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		stdoutR.Close()
+		stdoutW.Close()
+		return 0, nil, fmt.Errorf("failed to create stderr pipe: %w", err)
+	}
+	proc.Stdout = stdoutW
+	proc.Stderr = stderrW
+
+	// Each start gets a fresh run log, keeping the previous run's for crashes.
+	if runLogs != nil {
+		runLogs.Rotate()
+	}
+	startErr := proc.Start()
+	// The child holds its own copies of the write ends now.
+	stdoutW.Close()
+	stderrW.Close()
+	if startErr != nil {
+		stdoutR.Close()
+		stderrR.Close()
+		return 0, nil, fmt.Errorf("failed to start process: %w", startErr)
+	}
+
+	dp := &devProcess{
+		cmd:        proc,
+		pid:        proc.Process.Pid,
+		startedAt:  time.Now(),
+		stderrTail: &tailBuffer{max: commandTailBytes},
+		ready:      newReadyWatcher(),
+		done:       make(chan struct{}),
+	}
+	dp.startupWatched.Store(opts.StartupTimeout > 0)
+	dp.streams.Add(2)
+	go func() {
+		defer dp.streams.Done()
+		defer stdoutR.Close()
+		streamPipeToBroadcaster(io.TeeReader(stdoutR, dp.ready.stream()), "STDOUT", phaseApp)
+	}()
+	go func() {
+		defer dp.streams.Done()
+		defer stderrR.Close()
+		streamPipeToBroadcaster(io.TeeReader(stderrR, io.MultiWriter(dp.stderrTail, dp.ready.stream())), "STDERR", phaseApp)
+	}()
+
+	// A new process supersedes the previous one's exit details.
+	lastExitMu.Lock()
+	lastExit = nil
+	lastExitMu.Unlock()
+
+	// Write the pid file before supervising so an early exit can't leave a stale one.
+	pidErr := writePID(pidRecord{PID: proc.Process.Pid, StartedAt: dp.startedAt, Port: port})
+	devProcMu.Lock()
+	devProc = dp
+	devProcMu.Unlock()
+	go superviseDevServer(dp)
+
+	if pidErr != nil {
+		proc.Process.Kill() // Kill orphan process if we can't track it.
+		return 0, nil, fmt.Errorf("failed to write pid file: %w", pidErr)
+	}
+
+	log.Printf("Dev server started with PID: %d", proc.Process.Pid)
+	logBroadcaster.Submit(fmt.Sprintf("--- Server started with PID %d on port %d ---", proc.Process.Pid, port))
+
+	if prewarm == nil || len(prewarm.Paths) == 0 {
+		// Without explicit paths, warm the configured defaults and the paths
+		// that warmed successfully before.
+		if paths := defaultWarmPaths(); len(paths) > 0 {
+			log.Printf("Using %d default and persisted warm paths", len(paths))
+			cfg := PrewarmConfig{Paths: paths}
+			if prewarm != nil {
+				cfg.WaitForCompletion = prewarm.WaitForCompletion
+				cfg.Concurrency = prewarm.Concurrency
+				cfg.Sequential = prewarm.Sequential
+			}
+			prewarm = &cfg
+		}
+	}
+	report := &startReport{}
+	if opts.StartupTimeout > 0 {
+		ready, exit := waitForStartup(dp, port, opts.StartupTimeout)
+		if exit != nil {
+			return 0, nil, &startupExitError{Exit: *exit}
+		}
+		report.Ready = &ready
+		if !ready {
+			logBroadcaster.Submit(fmt.Sprintf("--- Server not ready after %s; it is still starting ---", opts.StartupTimeout))
+		}
+	}
+	if prewarm != nil && len(prewarm.Paths) > 0 {
+		logBroadcaster.Submit(fmt.Sprintf("--- Pre-warming %d paths ---", len(prewarm.Paths)))
+		if prewarm.WaitForCompletion {
+			r := performPrewarming(*prewarm, port, dp.ready.ready)
+			report.Prewarm = &r
+			logBroadcaster.Submit("--- Pre-warming completed ---")
+		} else {
+			go performPrewarming(*prewarm, port, dp.ready.ready)
+			logBroadcaster.Submit("--- Pre-warming running in the background ---")
+		}
+	}
+
+	return proc.Process.Pid, report, nil
+}
+
+// devProcess is a dev server child owned by this control plane instance.
+type devProcess struct {
+	cmd       *exec.Cmd
+	pid       int
+	startedAt time.Time
+	// stopRequested is set by stopDevServer so the exit isn't treated as a
+	// crash.
+	stopRequested atomic.Bool
+	// startupWatched is set while a start waits for readiness, which reports
+	// an exit itself instead of leaving it to auto-restart.
+	startupWatched atomic.Bool
+	// handoffMu makes closing done and reading startupWatched in the
+	// supervisor atomic with respect to waitForStartup's handoff.
+	handoffMu sync.Mutex
+	// stderrTail keeps the end of stderr for the exit details.
+	stderrTail *tailBuffer
+	// ready watches the output for readyPattern.
+	ready *readyWatcher
+	// streams tracks the goroutines copying the child's stdout/stderr.
+	streams sync.WaitGroup
+	// done is closed once the process has exited and been reaped.
+	done chan struct{}
+	// exitErr is the result of cmd.Wait, valid once done is closed.
+	exitErr error
+}
+
+// devExitInfo describes how a dev server process exited.
+type devExitInfo struct {
+	PID int `json:"pid"`
+	// ExitCode is -1 if the process was killed by a signal.
+	ExitCode int `json:"exit_code"`
+	// Reason is "stopped" for a stop through the control plane, otherwise
+	// the wait error ("exit status 1", "signal: killed") or "exited".
+	Reason string    `json:"reason"`
+	Error  string    `json:"error,omitempty"`
+	At     time.Time `json:"at"`
+	// Stderr holds the last exitStderrLines lines of stderr.
+	Stderr []string `json:"stderr,omitempty"`
+}
+
+// exitStderrLines is how many stderr lines are kept with the exit details.
+const exitStderrLines = 20
+
+// superviseDevServer waits for the dev server to exit, reaps it, waits briefly
+// for its output to drain, and clears the running state.
+func superviseDevServer(dp *devProcess) {
+	dp.exitErr = dp.cmd.Wait()
+
+	drained := make(chan struct{})
+	go func() {
+		dp.streams.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(2 * time.Second):
+		log.Printf("Output pipes for PID %d still open after exit (held by a child process?)", dp.pid)
+	}
+
+	devProcMu.Lock()
+	if devProc == dp {
+		devProc = nil
+	}
+	devProcMu.Unlock()
+
+	exit := &devExitInfo{
+		PID:      dp.pid,
+		ExitCode: dp.cmd.ProcessState.ExitCode(),
+		Reason:   "exited",
+		At:       time.Now().UTC(),
+		Stderr:   dp.stderrTail.lastLines(exitStderrLines),
+	}
+	if dp.exitErr != nil {
+		exit.Error = dp.exitErr.Error()
+		exit.Reason = exit.Error
+	}
+	if dp.stopRequested.Load() {
+		exit.Reason = "stopped"
+	}
+	lastExitMu.Lock()
+	lastExit = exit
+	lastExitMu.Unlock()
+
+	// Only remove the pid file if it still refers to this process.
+	if pid, err := readPID(); err == nil && pid == dp.pid {
+		os.Remove(pidFile)
+	}
+
+	if dp.exitErr != nil {
+		log.Printf("Dev server (PID %d) exited: %v", dp.pid, dp.exitErr)
+		logBroadcaster.Submit(fmt.Sprintf("--- Server (PID %d) exited: %v ---", dp.pid, dp.exitErr))
+	} else {
+		log.Printf("Dev server (PID %d) exited.", dp.pid)
+		logBroadcaster.Submit(fmt.Sprintf("--- Server (PID %d) exited ---", dp.pid))
+	}
+	dp.handoffMu.Lock()
+	close(dp.done)
+	watched := dp.startupWatched.Load()
+	dp.handoffMu.Unlock()
+
+	if !dp.stopRequested.Load() && !watched {
+		handleUnexpectedExit(dp)
+	}
+}
+
+// markStopRequested flags the owned dev server with pid as deliberately
+// stopped, so its supervisor doesn't auto-restart it.
+func markStopRequested(pid int) {
+	devProcMu.Lock()
+	defer devProcMu.Unlock()
+	if devProc != nil && devProc.pid == pid {
+		devProc.stopRequested.Store(true)
+	}
+}
+
+// ownedDevProcessReady reports whether pid is the dev server owned by this
+// instance and it has logged that it is ready.
+func ownedDevProcessReady(pid int) bool {
+	devProcMu.Lock()
+	defer devProcMu.Unlock()
+	return devProc != nil && devProc.pid == pid && devProc.ready.seen()
+}
+
+// ownedDevProcessEnv returns the environment pid was started with if it is the
+// dev server owned by this instance, or nil otherwise.
+func ownedDevProcessEnv(pid int) []string {
+	devProcMu.Lock()
+	defer devProcMu.Unlock()
+	if devProc != nil && devProc.pid == pid {
+		return devProc.cmd.Env
+	}
+	return nil
+}
+
+// ownedDevProcessDone returns the exit channel for pid if it is the dev
+// server owned by this instance, or nil otherwise.
+func ownedDevProcessDone(pid int) <-chan struct{} {
+	devProcMu.Lock()
+	defer devProcMu.Unlock()
+	if devProc != nil && devProc.pid == pid {
+		return devProc.done
+	}
+	return nil
+}
+
+// hasExited reports whether pid is gone. For processes we own, the supervisor's
+// done channel is authoritative since the PID may be reused once reaped.
+func hasExited(pid int, exited <-chan struct{}) bool {
+	if exited != nil {
+		select {
+		case <-exited:
+			return true
+		default:
+			return false
+		}
+	}
+	return !isProcessAlive(pid)
+}
+
+// maxStopGracePeriod bounds the stop grace period, since stops hold devOpMutex.
+const maxStopGracePeriod = 5 * time.Minute
+
+// killTimeout is how long to wait for the process group to go away after SIGKILL.
+const killTimeout = 5 * time.Second
+
+// stopStep is one signal of a stop, and how long to wait for it to work.
+type stopStep struct {
+	Signal syscall.Signal
+	Wait   time.Duration
+}
+
+func (s stopStep) String() string {
+	return fmt.Sprintf("%s:%s", signalName(s.Signal), s.Wait)
+}
+
+// stopSteps returns a fresh copy of the configured stop signals.
+func stopSteps() []stopStep {
+	if len(stopSequence) == 0 {
+		return []stopStep{{Signal: stopSignal, Wait: stopGracePeriod}}
+	}
+	return append([]stopStep(nil), stopSequence...)
+}
+
+// stopDevServer sends each step's signal to the dev server's process group in
+// turn, moving on when the server hasn't exited within the step's wait, and
+// finally sends SIGKILL. It returns true if the server was force-killed, false
+// if it exited gracefully.
+func stopDevServer(steps []stopStep) (bool, error) {
+	pid, err := readPID()
+	if err != nil {
+		return false, nil // Not running or no pid file.
+	}
+	if !isProcessAlive(pid) {
+		os.Remove(pidFile)
+		return false, nil
+	}
+
+	// If we own the process, the supervisor tells us exactly when it was reaped.
+	exited := ownedDevProcessDone(pid)
+	markStopRequested(pid)
+
+	for i, step := range steps {
+		name := signalName(step.Signal)
+		if i == 0 {
+			log.Printf("Stopping process group with PGID: %d (%s)", pid, name)
+		} else {
+			log.Printf("Process %d did not exit within %s, sending %s.", pid, steps[i-1].Wait, name)
+		}
+		// Kill the entire process group by sending a signal to -PID.
+		if err := syscall.Kill(-pid, step.Signal); err != nil {
+			log.Printf("Failed to kill process group %d with %s, trying single process: %v", pid, name, err)
+			syscall.Kill(pid, step.Signal) // Fallback for safety.
+		}
+		if waitForExit(pid, exited, step.Wait) {
+			log.Printf("Process %d stopped.", pid)
+			logBroadcaster.Submit(fmt.Sprintf("--- Server (PID %d) stopped ---", pid))
+			os.Remove(pidFile)
+			return false, nil
+		}
+	}
+
+	log.Printf("Process %d did not exit within %s, sending SIGKILL.", pid, steps[len(steps)-1].Wait)
+	syscall.Kill(-pid, syscall.SIGKILL) // Force kill the group.
+	if !waitForExit(pid, exited, killTimeout) {
+		log.Printf("Process %d still present %s after SIGKILL", pid, killTimeout)
+	}
+	logBroadcaster.Submit(fmt.Sprintf("--- Server (PID %d) force-killed ---", pid))
+	os.Remove(pidFile)
+	return true, nil
+}
+
+// waitForExit polls until pid has exited or timeout elapses, returning as soon
+// as the supervisor reports an owned process reaped. It reports whether the
+// process exited.
+func waitForExit(pid int, exited <-chan struct{}, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for !hasExited(pid, exited) {
+		select {
+		case <-exited:
+		case <-deadline.C:
+			return hasExited(pid, exited)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	return true
+}
+
+// --- Utility Functions ---
+
+// stopSignals are the signals accepted for stopping the dev server.
+var stopSignals = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGKILL": syscall.SIGKILL,
+}
+
+// parseSignal parses a signal name like "SIGINT" or "int".
+func parseSignal(name string) (syscall.Signal, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := stopSignals[name]
+	if !ok {
+		return 0, fmt.Errorf("unsupported signal %q", name)
+	}
+	return sig, nil
+}
+
+// parseStopSequence parses a comma-separated list of SIGNAL:wait steps such as
+// "SIGINT:3s,SIGTERM:5s". An empty spec returns nil, meaning the -stop-signal
+// and -stop-grace-period settings apply.
+func parseStopSequence(spec string) ([]stopStep, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	var (
+		steps []stopStep
+		total time.Duration
+	)
+	for _, part := range strings.Split(spec, ",") {
+		name, wait, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return nil, fmt.Errorf("step %q must be SIGNAL:wait, e.g. SIGINT:3s", part)
+		}
+		sig, err := parseSignal(name)
+		if err != nil {
+			return nil, err
+		}
+		if sig == syscall.SIGKILL {
+			return nil, fmt.Errorf("SIGKILL is always sent last and must not be listed")
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(wait))
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid wait %q for %s", wait, name)
+		}
+		total += d
+		steps = append(steps, stopStep{Signal: sig, Wait: d})
+	}
+	if total > maxStopGracePeriod {
+		return nil, fmt.Errorf("waits add up to %s, more than %s", total, maxStopGracePeriod)
+	}
+	return steps, nil
+}
+
+// signalName returns the conventional name of sig, e.g. "SIGTERM".
+func signalName(sig syscall.Signal) string {
+	for name, s := range stopSignals {
+		if s == sig {
+			return name
+		}
+	}
+	return sig.String()
+}
+
+func streamPipeToBroadcaster(pipe io.Reader, prefix, phase string) {
+	scanner := bufio.NewScanner(pipe)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxScannedLineBytes)
+	scanner.Split(scanLongLines)
+	for scanner.Scan() {
+		text, progress := strings.CutSuffix(scanner.Text(), "\r")
+		if progress && text == "" {
+			continue
+		}
+		// Stamp the line when it is read, not when a client receives it.
+		logBroadcaster.publishLine(BroadcastMessage{
+			Text:     text,
+			IsStderr: prefix == "STDERR",
+			Time:     time.Now(),
+			Progress: progress,
+			Phase:    phase,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Error reading from %s pipe: %v", prefix, err)
+	}
+}
+
+// maxScannedLineBytes is the longest line read from a process in one piece.
+// Longer lines are passed on in chunks of this size rather than ending the scan.
+const maxScannedLineBytes = 16 << 20
+
+// scanLongLines wraps scanLinesOrCR so that a line filling the scanner's
+// buffer is emitted as a chunk instead of failing with bufio.ErrTooLong,
+// which would stop all further output from the process.
+func scanLongLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	advance, token, err = scanLinesOrCR(data, atEOF)
+	if advance == 0 && token == nil && err == nil && len(data) >= maxScannedLineBytes {
+		return len(data), data, nil
+	}
+	return advance, token, err
+}
+
+// truncateLogLine caps a line sent to log stream clients at maxLogLineBytes,
+// cutting on a UTF-8 boundary and noting how much was dropped.
+func truncateLogLine(text string) string {
+	if maxLogLineBytes <= 0 || len(text) <= maxLogLineBytes {
+		return text
+	}
+	cut := maxLogLineBytes
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s...[truncated %d bytes]", text[:cut], len(text)-cut)
+}
+
+// scanLinesOrCR is like bufio.ScanLines but also ends a line at a bare '\r',
+// so progress output that rewrites its line streams as separate updates
+// rather than one huge line at the end. Such tokens keep their trailing '\r'
+// so the caller can tell them apart; "\r\n" is a single line ending.
+func scanLinesOrCR(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\n' {
+			return i + 1, data[:i], nil
+		}
+		if i+1 < len(data) {
+			if data[i+1] == '\n' {
+				return i + 2, data[:i], nil
+			}
+			return i + 1, data[:i+1], nil
+		}
+		if atEOF {
+			return i + 1, data[:i+1], nil
+		}
+		// Need the next byte to tell "\r" from "\r\n".
+		return 0, nil, nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+type PackageJSON struct {
+	Scripts         map[string]string `json:"scripts"`
+	Dependencies    map[string]string `json:"dependencies"`
+	DevDependencies map[string]string `json:"devDependencies"`
+	PackageManager  string            `json:"packageManager"`
+}
+
+// dependsOn reports whether dep is in dependencies or devDependencies.
+func (p *PackageJSON) dependsOn(dep string) bool {
+	_, ok := p.Dependencies[dep]
+	if !ok {
+		_, ok = p.DevDependencies[dep]
+	}
+	return ok
+}
+
+func readPackageJSON(dir string) (*PackageJSON, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		return nil, err
+	}
+	var pkg PackageJSON
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return nil, err
+	}
+	return &pkg, nil
+}
+
+// fileExists returns true if the given path exists and is a file.
+func fileExists(p string) bool {
+	info, err := os.Stat(p)
+	if err != nil {
+		return false
+	}
+	return !info.IsDir()
+}
+
+// devCommand is a resolved dev command and what it was resolved from.
+type devCommand struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	// Reason says what matched, e.g. "config file next.config.js".
+	Reason string `json:"reason"`
+	// Env holds variables the framework needs to run in a container, set
+	// below the .env file and the request's env.
+	Env map[string]string `json:"env,omitempty"`
+}
+
+// devCommandOverrideReason is the reason given for a command that replaced
+// detection.
+const devCommandOverrideReason = "-dev-command override"
+
+// selectDevCommand returns the command the dev server runs in dir on port:
+// override (-dev-command, or a request's dev_command) when set, otherwise the
+// one detected in dir. overridden reports which. It is the only place that
+// choice is made, so starts and the endpoints previewing them agree.
+func selectDevCommand(dir string, port int, override []string) (dc devCommand, overridden bool, err error) {
+	if len(override) > 0 {
+		return devCommand{Command: override[0], Args: override[1:], Reason: devCommandOverrideReason}, true, nil
+	}
+	dc, err = detectDevCommand(dir, port)
+	return dc, false, err
+}
+
+// detectDevCommand picks the dev command for the project in cwd.
+func detectDevCommand(cwd string, port int) (devCommand, error) {
+	// Prefer framework based on presence of config files in cwd.
+	nextConfigs := []string{
+		"next.config.js",
+		"next.config.mjs",
+		"next.config.cjs",
+		"next.config.ts",
+	}
+	for _, f := range nextConfigs {
+		if fileExists(filepath.Join(cwd, f)) {
+			return devCommand{"node", []string{"node_modules/next/dist/bin/next", "dev", "-p", strconv.Itoa(port)}, "config file " + f, nil}, nil
+		}
+	}
+
+	viteConfigs := []string{
+		"vite.config.ts",
+		"vite.config.js",
+		"vite.config.mjs",
+		"vite.config.cjs",
+		"vite.config.mts",
+		"vite.config.cts",
+	}
+	for _, f := range viteConfigs {
+		if fileExists(filepath.Join(cwd, f)) {
+			return devCommand{"node", []string{"node_modules/vite/bin/vite.js", "--port", strconv.Itoa(port)}, "config file " + f, nil}, nil
+		}
+	}
+
+	if fileExists(filepath.Join(cwd, "angular.json")) {
+		return devCommand{"npx", []string{"ng", "serve", "--port", strconv.Itoa(port)}, "config file angular.json", nil}, nil
+	}
+
+	// Fallback to package.json scripts, run with the project's package manager.
+	pkg, err := readPackageJSON(cwd)
+	if err == nil {
+		pm := detectPackageManager(cwd)
+		env := frameworkEnv(pkg)
+		if _, ok := pkg.Scripts["dev"]; ok {
+			return devCommand{pm.Name, []string{"run", "dev"}, `package.json script "dev"`, env}, nil
+		}
+		if _, ok := pkg.Scripts["start"]; ok {
+			return devCommand{pm.Name, []string{"start"}, `package.json script "start"`, env}, nil
+		}
+		// Frameworks with a conventional dev CLI, for projects without a
+		// dev or start script.
+		for _, fw := range frameworkDevCommands {
+			if pkg.dependsOn(fw.Dependency) {
+				return devCommand{"npx", fw.Args(strconv.Itoa(port)), fmt.Sprintf("dependency %s", fw.Dependency), env}, nil
+			}
+		}
+	}
+
+	noCmd := &noDevCommandError{PackageJSONErr: err}
+	if pkg != nil {
+		noCmd.Scripts = sortedStringKeys(pkg.Scripts)
+		for _, dep := range frameworkDependencies {
+			if pkg.dependsOn(dep) {
+				noCmd.Dependencies = append(noCmd.Dependencies, dep)
+			}
+		}
+	}
+	return devCommand{}, noCmd
+}
+
+// frameworkDevCommands are the dev CLIs run, through npx, for projects that
+// depend on these frameworks but have no config file or script that matches.
+// SvelteKit and Remix's Vite setup usually have a vite.config, so they are
+// rarely reached.
+var frameworkDevCommands = []struct {
+	Dependency string
+	Args       func(port string) []string
+}{
+	// Remix's classic compiler serves on $PORT.
+	{"@remix-run/dev", func(port string) []string { return []string{"remix", "dev"} }},
+	{"nuxt", func(port string) []string { return []string{"nuxi", "dev", "--port", port} }},
+	{"@sveltejs/kit", func(port string) []string { return []string{"vite", "dev", "--port", port} }},
+	// SolidStart 1.x runs on vinxi; the pre-1.0 package has its own CLI.
+	{"@solidjs/start", func(port string) []string { return []string{"vinxi", "dev", "--port", port} }},
+	{"solid-start", func(port string) []string { return []string{"solid-start", "dev", "--port", port} }},
+	// Create React App reads the port from $PORT; see frameworkEnv.
+	{"react-scripts", func(port string) []string { return []string{"react-scripts", "start"} }},
+}
+
+// frameworkEnv returns the variables pkg's framework needs to run in the
+// container, whichever script starts it.
+func frameworkEnv(pkg *PackageJSON) map[string]string {
+	if pkg.dependsOn("react-scripts") {
+		// Create React App's start opens a browser unless BROWSER=none, which
+		// fails or hangs without a display. It already serves on $PORT and
+		// $HOST, which startDevServer sets.
+		return map[string]string{"BROWSER": "none"}
+	}
+	return nil
+}
+
+// frameworkDependencies are the packages named in a failed detection's error,
+// as hints to what kind of project it is.
+var frameworkDependencies = []string{
+	"next", "vite", "@angular/core", "@angular/cli", "react-scripts", "@remix-run/dev", "nuxt", "@sveltejs/kit",
+	"@solidjs/start", "solid-start", "astro", "gatsby", "parcel", "webpack-dev-server", "express",
+}
+
+// noDevCommandError is returned when no dev command can be detected. It
+// lists what the project does have, so the user can see why nothing matched.
+type noDevCommandError struct {
+	// PackageJSONErr is why package.json couldn't be read, if it couldn't.
+	PackageJSONErr error
+	// Scripts are the names of package.json's scripts.
+	Scripts []string
+	// Dependencies are the frameworkDependencies it depends on.
+	Dependencies []string
+}
+
+func (e *noDevCommandError) Error() string {
+	msg := "no suitable dev command found. Looked for config files (next.config.{js,mjs,cjs,ts}, vite.config.{ts,js,mjs,cjs,mts,cts}, angular.json), 'dev'/'start' scripts in package.json, or a Remix, Nuxt, SvelteKit, SolidStart or Create React App dependency"
+	switch {
+	case errors.Is(e.PackageJSONErr, fs.ErrNotExist):
+		return msg + "; there is no package.json"
+	case e.PackageJSONErr != nil:
+		return fmt.Sprintf("%s; package.json could not be read: %v", msg, e.PackageJSONErr)
+	}
+	scripts := "none"
+	if len(e.Scripts) > 0 {
+		scripts = strings.Join(e.Scripts, ", ")
+	}
+	msg += "; found scripts: " + scripts
+	if len(e.Dependencies) > 0 {
+		msg += "; framework dependencies: " + strings.Join(e.Dependencies, ", ")
+	}
+	return msg
+}
+
+// splitCommandLine splits a command string into argv, honoring single and
+// double quotes and backslash escapes. It does not perform shell expansion.
+func splitCommandLine(s string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range s {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// routeMethods records the methods each registered route accepts, so that
+// CORS preflights can advertise them accurately.
+var routeMethods = make(map[string][]string)
+
+// handle registers handler for pattern, accepting only the given methods (GET
+// implies HEAD). Other methods get a 405 with an Allow header.
+func handle(mux *http.ServeMux, pattern string, handler http.HandlerFunc, methods ...string) {
+	for _, m := range methods {
+		if m == http.MethodGet {
+			methods = append(methods, http.MethodHead)
+			break
+		}
+	}
+	allow := strings.Join(append(append([]string{}, methods...), http.MethodOptions), ", ")
+	routeMethods[pattern] = methods
+
+	mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range methods {
+			if r.Method == m {
+				handler(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", allow)
+		httpError(w, fmt.Sprintf("Method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+	})
+}
+
+// allowedMethods returns the Access-Control-Allow-Methods value for a path.
+func allowedMethods(path string) string {
+	methods, ok := routeMethods[path]
+	if !ok {
+		return "GET, POST, OPTIONS"
+	}
+	return strings.Join(append(append([]string{}, methods...), http.MethodOptions), ", ")
+}
+
+// corsMiddleware sets CORS headers. With no allowed origins configured any
+// origin is accepted; otherwise only allowlisted origins are echoed back.
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := true
+		allowedOrigins := currentSettings().AllowedOrigins
+		if len(allowedOrigins) == 0 {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Add("Vary", "Origin")
+			allowed = origin != "" && allowedOrigins[origin]
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+		}
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Methods", allowedMethods(r.URL.Path))
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		}
+		if r.Method == "OPTIONS" {
+			if !allowed {
+				log.Printf("Rejected CORS preflight from origin %q", origin)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseOrigins parses a comma-separated origin allowlist.
+func parseOrigins(list string) map[string]bool {
+	origins := make(map[string]bool)
+	for _, o := range strings.Split(list, ",") {
+		o = strings.TrimRight(strings.TrimSpace(o), "/")
+		if o != "" {
+			origins[o] = true
+		}
+	}
+	return origins
+}
+
+func httpError(w http.ResponseWriter, message string, code int) {
+	log.Printf("HTTP Error %d: %s", code, message)
+	jsonResponse(w, code, map[string]string{"error": message})
+}
+
+func jsonResponse(w http.ResponseWriter, code int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if payload != nil {
+		json.NewEncoder(w).Encode(payload)
+	}
+}
+
+// --- File System & Process Helpers ---
+
+// projectDir is the directory holding the app's package.json: appDir, or
+// appSubdir within it.
+func projectDir() string {
+	return filepath.Join(appDir, appSubdir)
+}
+
+// dependencyManifests returns the package.json files, relative to appDir,
+// whose dependency changes trigger a reconcile: appDir's and, with
+// appSubdir, the app's.
+func dependencyManifests() []string {
+	manifests := []string{"package.json"}
+	if appSubdir != "" {
+		manifests = append(manifests, filepath.Join(appSubdir, "package.json"))
+	}
+	return manifests
+}
+
+// installDir returns the directory whose install picks up a change to
+// manifest, one of dependencyManifests. That's appDir for the root
+// package.json and for an app that is one of the root's workspaces, as
+// workspaces install together; any other app installs in its own directory.
+func installDir(manifest string) string {
+	dir := filepath.Dir(filepath.Clean(manifest))
+	if dir == "." || isWorkspace(appDir, dir) {
+		return appDir
+	}
+	return filepath.Join(appDir, dir)
+}
+
+func resolveWithinAppDir(p string) (string, error) {
+	cleanPath := filepath.Join(appDir, p)
+	absAppDir, _ := filepath.Abs(appDir)
+	absCleanPath, _ := filepath.Abs(cleanPath)
+	if !isWithinDir(absAppDir, absCleanPath) {
+		return "", fmt.Errorf("path traversal attempt detected: %s", p)
+	}
+	return absCleanPath, nil
+}
+
+// isWithinDir reports whether p is dir or inside it. Both must be absolute. A
+// prefix check would accept siblings like /app/applet-evil, so this compares
+// path elements instead.
+func isWithinDir(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && !filepath.IsAbs(rel) && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// errProtectedPath is returned for a sync that would write or delete appDir
+// itself or a path isProtected leaves alone.
+var errProtectedPath = errors.New("path is managed by the control plane")
+
+// checkNotProtected rejects a path returned by resolveWithinAppDir if it is
+// appDir itself or protected, so a sync can't remove the app dir or touch
+// node_modules or the control plane's own files.
+func checkNotProtected(p, dest string) error {
+	absAppDir, _ := filepath.Abs(appDir)
+	rel, err := filepath.Rel(absAppDir, dest)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return fmt.Errorf("%w: %q is the app dir", errProtectedPath, p)
+	}
+	if isProtected(filepath.ToSlash(rel)) {
+		return fmt.Errorf("%w: %s", errProtectedPath, p)
+	}
+	return nil
+}
+
+// checkSymlinks rejects a path returned by resolveWithinAppDir if following
+// symlinks along it would leave appDir; resolveWithinAppDir only checks the
+// lexical path. With followFinal the last element is checked too, as writes
+// follow it; deletes remove a symlink itself. Unless allowSymlinks is set,
+// any symlink along the path is refused.
+func checkSymlinks(dest string, followFinal bool) error {
+	absAppDir, _ := filepath.Abs(appDir)
+	root, err := filepath.EvalSymlinks(absAppDir)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(absAppDir, dest)
+	if err != nil || rel == "." {
+		return err
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	if !followFinal {
+		parts = parts[:len(parts)-1]
+	}
+	cur := absAppDir
+	for _, part := range parts {
+		cur = filepath.Join(cur, part)
+		info, err := os.Lstat(cur)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // The rest of the path doesn't exist yet.
+		}
 		if err != nil {
-			httpError(w, fmt.Sprintf("Failed to start dev server: %v", err), http.StatusInternalServerError)
-			return
+			return err
 		}
-		sendJSONResponse(w, http.StatusAccepted, DevOpResponse{
-			Success: true,
-			Message: "Dev server started successfully",
-			PID:     newPid,
-		})
-
-	case "restart":
-		logBroadcaster.Submit("--- Server restarting... ---")
-		forceKilled := false
-		var err error
-		if isAlive {
-			forceKilled, err = stopDevServer()
-			if err != nil {
-				log.Printf("Failed to stop dev server during restart, proceeding anyway: %v", err)
-			}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			continue
+		}
+		name, _ := filepath.Rel(absAppDir, cur)
+		if !allowSymlinks {
+			return fmt.Errorf("refusing to follow symlink %s", name)
 		}
-		newPid, err := startDevServer(defaultAppPort, req.Prewarm)
+		target, err := filepath.EvalSymlinks(cur)
 		if err != nil {
-			httpError(w, fmt.Sprintf("Failed to start dev server: %v", err), http.StatusInternalServerError)
-			return
+			return fmt.Errorf("cannot resolve symlink %s: %w", name, err)
+		}
+		if !isWithinDir(root, target) {
+			return fmt.Errorf("symlink %s points outside the app dir", name)
 		}
-		sendJSONResponse(w, http.StatusAccepted, DevOpResponse{
-			Success:     true,
-			Message:     "Dev server restarted successfully",
-			PID:         newPid,
-			ForceKilled: forceKilled,
-		})
 	}
+	return nil
 }
 
-func startDevServer(port int, prewarm *PrewarmConfig) (int, error) {
-	cmd, args, err := resolveDevCommand(appDir, port)
+// openDirBeneath opens dir, a directory under appDir, one path element at a
+// time from appDir's real path without following symlinks. Writes and deletes
+// go through the returned descriptor (see fdPath), so a directory swapped for
+// a symlink after checkSymlinks passed can't redirect them out of appDir.
+// Unless allowSymlinks is off, symlinks along dir are resolved first and the
+// result must still be inside appDir. With create, missing directories are
+// made along the way.
+func openDirBeneath(dir string, create bool) (*os.File, error) {
+	absAppDir, _ := filepath.Abs(appDir)
+	root, err := filepath.EvalSymlinks(absAppDir)
 	if err != nil {
-		return 0, fmt.Errorf("could not resolve dev command: %w", err)
+		return nil, err
+	}
+	rel, err := filepath.Rel(absAppDir, dir)
+	if err != nil || !isWithinDir(absAppDir, dir) {
+		return nil, fmt.Errorf("%s is outside the app dir", dir)
+	}
+	if allowSymlinks {
+		real, err := resolveExisting(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !isWithinDir(root, real) {
+			return nil, fmt.Errorf("%s resolves outside the app dir", rel)
+		}
+		rel, _ = filepath.Rel(root, real)
 	}
 
-	log.Printf("Starting dev server: %s %s", cmd, strings.Join(args, " "))
-	proc := exec.Command(cmd, args...)
-	proc.Dir = appDir
-	proc.Env = append(os.Environ(), fmt.Sprintf("PORT=%d", port), "HOST=0.0.0.0")
+	fd, err := syscall.Open(root, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	if rel != "." {
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			const flags = syscall.O_RDONLY | syscall.O_DIRECTORY | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+			next, err := syscall.Openat(fd, part, flags, 0)
+			if err == syscall.ENOENT && create {
+				if err = syscall.Mkdirat(fd, part, 0755); err == nil || err == syscall.EEXIST {
+					next, err = syscall.Openat(fd, part, flags, 0)
+				}
+			}
+			syscall.Close(fd)
+			if err == syscall.ELOOP {
+				return nil, fmt.Errorf("refusing to follow symlink along %s", rel)
+			}
+			if err != nil {
+				return nil, &os.PathError{Op: "open", Path: dir, Err: err}
+			}
+			fd = next
+		}
+	}
+	return os.NewFile(uintptr(fd), dir), nil
+}
 
-	// Crucial for robust process killing: create a new process group.
-	proc.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+// resolveExisting is filepath.EvalSymlinks for a path whose trailing elements
+// may not exist yet: the longest existing prefix is resolved and the rest
+// appended.
+func resolveExisting(p string) (string, error) {
+	rest := ""
+	for cur := p; ; {
+		real, err := filepath.EvalSymlinks(cur)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		}
+		parent := filepath.Dir(cur)
+		if !errors.Is(err, fs.ErrNotExist) || parent == cur {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(cur), rest)
+		cur = parent
+	}
+}
+
+// fdPath names name inside dir, an open directory, through the descriptor
+// rather than the directory's path.
+func fdPath(dir *os.File, name string) string {
+	return fmt.Sprintf("/proc/self/fd/%d/%s", dir.Fd(), name)
+}
 
-	// Capture stdout and stderr for log streaming.
-	stdout, _ := proc.StdoutPipe()
-	stderr, _ := proc.StderrPipe()
-	go streamPipeToBroadcaster(stdout, "STDOUT")
-	go streamPipeToBroadcaster(stderr, "STDERR")
+// fileMode is a synced file's permissions, given in JSON as an octal string
+// ("0755") or a number (493).
+type fileMode uint32
 
-	if err := proc.Start(); err != nil {
-		return 0, fmt.Errorf("failed to start process: %w", err)
+func (m *fileMode) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		v, err := strconv.ParseUint(s, 8, 32)
+		if err != nil {
+			return fmt.Errorf("mode %q is not an octal number", s)
+		}
+		*m = fileMode(v)
+		return nil
 	}
-
-	if err := writePID(proc.Process.Pid); err != nil {
-		proc.Process.Kill() // Kill orphan process if we can't track it.
-		return 0, fmt.Errorf("failed to write pid file: %w", err)
+	var n uint32
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("mode must be an octal string or a number")
 	}
+	*m = fileMode(n)
+	return nil
+}
 
-	log.Printf("Dev server started with PID: %d", proc.Process.Pid)
-	logBroadcaster.Submit(fmt.Sprintf("--- Server started with PID %d on port %d ---", proc.Process.Pid, port))
+// validate allows only permission bits, never setuid, setgid or sticky, and
+// requires the owner to keep read and write access.
+func (m fileMode) validate() error {
+	if m&^0777 != 0 {
+		return fmt.Errorf("%#o has bits outside 0777", uint32(m))
+	}
+	if m&0600 != 0600 {
+		return fmt.Errorf("%#o must grant the owner read and write", uint32(m))
+	}
+	return nil
+}
 
-	if prewarm != nil && len(prewarm.Paths) > 0 {
-		logBroadcaster.Submit(fmt.Sprintf("--- Pre-warming %d paths ---", len(prewarm.Paths)))
-		if prewarm.WaitForCompletion {
-			performPrewarming(*prewarm, port)
-			logBroadcaster.Submit("--- Pre-warming completed ---")
-		} else {
-			go performPrewarming(*prewarm, port)
-			logBroadcaster.Submit("--- Pre-warming running in the background ---")
-		}
+// formatFileMode formats permissions as a 4-digit octal string.
+func formatFileMode(m fs.FileMode) string {
+	if m == 0 {
+		return ""
 	}
+	return fmt.Sprintf("%04o", uint32(m.Perm()))
+}
 
-	return proc.Process.Pid, nil
+// fileWrite is the outcome of writeFileBase64 or applyPatch.
+type fileWrite struct {
+	// Change is "created", "modified", "mode", or empty if nothing changed.
+	Change string
+	// Data is the new content, or nil if the content is unchanged. Files
+	// written by writeFileBase64 are streamed to disk, so it only sets Data
+	// for package.json, which shouldReconcile needs.
+	Data []byte
+	// Mode is the file's resulting permissions.
+	Mode fs.FileMode
 }
 
-// stopDevServer returns true if the server was force-killed, false if it exited gracefully.
-func stopDevServer() (bool, error) {
-	pid, err := readPID()
+// writeFileBase64 decodes the file's content and writes it to p within
+// appDir. The write is skipped when the file on disk already has the same
+// content: either matching the optional hex sha256 sum up front, or matching
+// the decoded data; only a requested mode change is then applied. With
+// dryRun, everything but the write happens.
+func writeFileBase64(p string, file SyncFile, dryRun bool) (fileWrite, error) {
+	dest, err := resolveWithinAppDir(p)
 	if err != nil {
-		return false, nil // Not running or no pid file.
+		return fileWrite{}, err
 	}
-	if !isProcessAlive(pid) {
-		os.Remove(pidFile)
-		return false, nil
+	if err := checkNotProtected(p, dest); err != nil {
+		return fileWrite{}, err
 	}
-
-	log.Printf("Stopping process group with PGID: %d", pid)
-	// Kill the entire process group by sending a signal to -PID.
-	if err := syscall.Kill(-pid, syscall.SIGTERM); err != nil {
-		log.Printf("Failed to kill process group %d with SIGTERM, trying single process: %v", pid, err)
-		syscall.Kill(pid, syscall.SIGTERM) // Fallback for safety.
+	if err := checkSymlinks(dest, true); err != nil {
+		return fileWrite{}, err
 	}
-
-	// Wait for the process to exit, with a timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	for isProcessAlive(pid) {
-		select {
-		case <-ctx.Done():
-			log.Printf("Process %d did not exit gracefully, sending SIGKILL.", pid)
-			syscall.Kill(-pid, syscall.SIGKILL) // Force kill the group.
-			time.Sleep(1 * time.Second)         // Give SIGKILL time to work.
-			logBroadcaster.Submit(fmt.Sprintf("--- Server (PID %d) force-killed ---", pid))
-			os.Remove(pidFile)
-			return true, nil
-		default:
-			time.Sleep(150 * time.Millisecond)
+	perm := fs.FileMode(0644)
+	var current fs.FileMode
+	if info, err := os.Stat(dest); err == nil {
+		current = info.Mode().Perm()
+		perm = current
+	}
+	if file.Mode != nil {
+		if err := file.Mode.validate(); err != nil {
+			return fileWrite{}, fmt.Errorf("invalid mode for %s: %w", p, err)
 		}
+		perm = fs.FileMode(*file.Mode)
+	}
+	if file.Encoding != "" && file.Encoding != "gzip" {
+		return fileWrite{}, fmt.Errorf("unsupported encoding %q for %s", file.Encoding, p)
 	}
 
-	log.Printf("Process %d stopped.", pid)
-	logBroadcaster.Submit(fmt.Sprintf("--- Server (PID %d) stopped ---", pid))
-	os.Remove(pidFile)
-	return false, nil
+	existing, _ := fileSHA256(dest)
+	unchanged := file.SHA256 != "" && existing != "" && strings.EqualFold(file.SHA256, existing)
+	if !unchanged {
+		var src io.Reader = strings.NewReader(file.Content)
+		if file.stream != nil {
+			src = file.stream
+		} else if size := base64DecodedLen(file.Content); file.Encoding == "" && maxSyncFileBytes > 0 && size > maxSyncFileBytes {
+			return fileWrite{}, fmt.Errorf("%s is %d bytes, more than the %d byte limit: %w", p, size, maxSyncFileBytes, errSyncFileTooLarge)
+		}
+		// Decode straight into the temp file rather than holding a decoded
+		// copy of every file in memory; only package.json's content is kept,
+		// for shouldReconcile.
+		h := sha256.New()
+		w := io.Writer(h)
+		var tmp *atomicFile
+		if !dryRun {
+			tmp, err = newAtomicFile(dest)
+			if err != nil {
+				return fileWrite{}, err
+			}
+			defer tmp.abort()
+			w = io.MultiWriter(tmp, h)
+		}
+		var kept *bytes.Buffer
+		if slices.Contains(dependencyManifests(), filepath.Clean(p)) {
+			kept = &bytes.Buffer{}
+			w = io.MultiWriter(w, kept)
+		}
+		dec := io.Reader(base64.NewDecoder(base64.StdEncoding, src))
+		if file.Encoding == "gzip" {
+			gz, err := gzip.NewReader(dec)
+			if err != nil {
+				return fileWrite{}, fmt.Errorf("invalid gzip content for %s: %w", p, err)
+			}
+			defer gz.Close()
+			dec = gz
+		}
+		if maxSyncFileBytes > 0 {
+			// A streamed file's size is only known once it has been read.
+			dec = io.LimitReader(dec, maxSyncFileBytes+1)
+		}
+		n, err := io.Copy(w, dec)
+		if err != nil {
+			var corrupt base64.CorruptInputError
+			if errors.As(err, &corrupt) {
+				return fileWrite{}, fmt.Errorf("invalid base64 content for %s: %w", p, err)
+			}
+			var flateErr flate.CorruptInputError
+			if errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &flateErr) {
+				return fileWrite{}, fmt.Errorf("invalid gzip content for %s: %w", p, err)
+			}
+			return fileWrite{}, err
+		}
+		if maxSyncFileBytes > 0 && n > maxSyncFileBytes {
+			return fileWrite{}, fmt.Errorf("%s is more than the %d byte limit: %w", p, maxSyncFileBytes, errSyncFileTooLarge)
+		}
+		unchanged = existing != "" && hex.EncodeToString(h.Sum(nil)) == existing
+		if !unchanged {
+			fw := fileWrite{Change: "created", Mode: perm}
+			if kept != nil {
+				fw.Data = append([]byte{}, kept.Bytes()...)
+			}
+			if existing != "" {
+				fw.Change = "modified"
+			}
+			if dryRun {
+				return fw, nil
+			}
+			return fw, tmp.commit(perm)
+		}
+	}
+	if perm == current {
+		return fileWrite{Mode: perm}, nil
+	}
+	if !dryRun {
+		if err := os.Chmod(dest, perm); err != nil {
+			return fileWrite{}, err
+		}
+	}
+	return fileWrite{Change: "mode", Mode: perm}, nil
 }
 
-// --- Utility Functions ---
+// base64DecodedLen returns how many bytes s decodes to, without decoding it.
+// Line breaks, which the decoder skips, aren't counted.
+func base64DecodedLen(s string) int64 {
+	n := len(s) - strings.Count(s, "\n") - strings.Count(s, "\r")
+	trimmed := strings.TrimRight(s, "\r\n")
+	pad := len(trimmed) - len(strings.TrimRight(trimmed, "="))
+	return int64(base64.StdEncoding.DecodedLen(n) - pad)
+}
 
-func streamPipeToBroadcaster(pipe io.Reader, prefix string) {
-	scanner := bufio.NewScanner(pipe)
-	for scanner.Scan() {
-		if prefix == "STDERR" {
-			logBroadcaster.SubmitStderr(scanner.Text())
-		} else {
-			logBroadcaster.Submit(scanner.Text())
-		}
+// writeFileAtomic writes data to a temp file next to dest and renames it into
+// place, so watchers such as the dev server's never see a partly written
+// file. If dest is a symlink, its target is replaced instead.
+func writeFileAtomic(dest string, data []byte, perm fs.FileMode) error {
+	tmp, err := newAtomicFile(dest)
+	if err != nil {
+		return err
 	}
-	if err := scanner.Err(); err != nil {
-		log.Printf("Error reading from %s pipe: %v", prefix, err)
+	defer tmp.abort()
+	if _, err := tmp.Write(data); err != nil {
+		return err
 	}
+	return tmp.commit(perm)
 }
 
-type PackageJSON struct {
-	Scripts      map[string]string `json:"scripts"`
-	Dependencies map[string]string `json:"dependencies"`
+// atomicFile is a temp file next to dest that commit renames into place. Both
+// are reached through dir, opened by openDirBeneath, so neither can be
+// redirected out of appDir once it's open.
+type atomicFile struct {
+	*os.File
+	dir  *os.File
+	base string
+	done bool
 }
 
-func readPackageJSON(dir string) (*PackageJSON, error) {
-	data, err := os.ReadFile(filepath.Join(dir, "package.json"))
+// newAtomicFile creates the temp file for dest, making its directory if
+// needed. With allowSymlinks a symlink at dest is written through; otherwise
+// (checkSymlinks having refused it) commit would replace the link itself.
+func newAtomicFile(dest string) (*atomicFile, error) {
+	if allowSymlinks {
+		if target, err := filepath.EvalSymlinks(dest); err == nil {
+			dest = target
+		}
+	}
+	dir, err := openDirBeneath(filepath.Dir(dest), true)
 	if err != nil {
 		return nil, err
 	}
-	var pkg PackageJSON
-	if err := json.Unmarshal(data, &pkg); err != nil {
+	base := filepath.Base(dest)
+	tmp, err := os.CreateTemp(fdPath(dir, ""), "."+base+".tmp-*")
+	if err != nil {
+		dir.Close()
 		return nil, err
 	}
-	return &pkg, nil
+	return &atomicFile{File: tmp, dir: dir, base: base}, nil
 }
 
-// fileExists returns true if the given path exists and is a file.
-func fileExists(p string) bool {
-	info, err := os.Stat(p)
-	if err != nil {
-		return false
+// commit gives the file perm and renames it over dest.
+func (a *atomicFile) commit(perm fs.FileMode) error {
+	// CreateTemp uses 0600.
+	if err := a.Chmod(perm); err != nil {
+		return err
 	}
-	return !info.IsDir()
+	if err := a.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(a.Name(), fdPath(a.dir, a.base)); err != nil {
+		return err
+	}
+	a.done = true
+	return nil
 }
 
-func resolveDevCommand(cwd string, port int) (string, []string, error) {
-	// Prefer framework based on presence of config files in cwd.
-	nextConfigs := []string{
-		"next.config.js",
-		"next.config.mjs",
-		"next.config.cjs",
-		"next.config.ts",
-	}
-	for _, f := range nextConfigs {
-		if fileExists(filepath.Join(cwd, f)) {
-			return "node", []string{"node_modules/next/dist/bin/next", "dev", "-p", strconv.Itoa(port)}, nil
-		}
+// abort removes the temp file unless it was committed, and closes dir. It
+// must be called either way.
+func (a *atomicFile) abort() {
+	if !a.done {
+		a.Close()
+		os.Remove(a.Name())
 	}
+	a.dir.Close()
+}
 
-	viteConfigs := []string{
-		"vite.config.ts",
-		"vite.config.js",
-		"vite.config.mjs",
-		"vite.config.cjs",
-		"vite.config.mts",
-		"vite.config.cts",
+// fileSHA256 returns the hex sha256 of the regular file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
 	}
-	for _, f := range viteConfigs {
-		if fileExists(filepath.Join(cwd, f)) {
-			return "node", []string{"node_modules/vite/bin/vite.js", "--port", strconv.Itoa(port)}, nil
-		}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", path)
 	}
-
-	if fileExists(filepath.Join(cwd, "angular.json")) {
-		return "npx", []string{"ng", "serve", "--port", strconv.Itoa(port)}, nil
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
-	// Fallback to package.json scripts.
-	if pkg, err := readPackageJSON(cwd); err == nil {
-		if _, ok := pkg.Scripts["dev"]; ok {
-			return "npm", []string{"run", "dev"}, nil
-		}
-		if _, ok := pkg.Scripts["start"]; ok {
-			return "npm", []string{"start"}, nil
-		}
+// planDelete reports what deletePath would do for p without removing anything.
+func planDelete(p string) (SyncFileResult, error) {
+	dest, err := resolveWithinAppDir(p)
+	if err != nil {
+		return SyncFileResult{}, err
+	}
+	if err := checkNotProtected(p, dest); err != nil {
+		return SyncFileResult{}, err
+	}
+	if err := checkSymlinks(dest, false); err != nil {
+		return SyncFileResult{}, err
 	}
+	if _, err := os.Lstat(dest); errors.Is(err, fs.ErrNotExist) {
+		return SyncFileResult{Status: "unchanged"}, nil
+	}
+	return SyncFileResult{Status: "deleted"}, nil
+}
 
-	return "", nil, fmt.Errorf("no suitable dev command found. Looked for config files (next.config.{js,mjs,cjs,ts}, vite.config.{ts,js,mjs,cjs,mts,cts}, angular.json) or 'dev'/'start' scripts in package.json")
+func deletePath(p string) error {
+	dest, err := resolveWithinAppDir(p)
+	if err != nil {
+		return err
+	}
+	if err := checkNotProtected(p, dest); err != nil {
+		return err
+	}
+	if err := checkSymlinks(dest, false); err != nil {
+		return err
+	}
+	dir, err := openDirBeneath(filepath.Dir(dest), false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return os.RemoveAll(fdPath(dir, filepath.Base(dest)))
 }
 
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// TODO: samuelpetit - only allow AI Studio origins when in prod.
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusNoContent)
-			return
+// mirrorExtraneous returns the files and symlinks under appDir, relative to
+// it, that a mirror sync deletes: those whose absolute path isn't in keep and
+// that aren't ignored. Ignored directories aren't entered.
+func mirrorExtraneous(keep map[string]bool) ([]string, error) {
+	absAppDir, err := filepath.Abs(appDir)
+	if err != nil {
+		return nil, err
+	}
+	ignore := loadIgnore(nil)
+	var extraneous []string
+	err = filepath.WalkDir(absAppDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p != absAppDir && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
 		}
-		next.ServeHTTP(w, r)
+		if p == absAppDir {
+			return nil
+		}
+		rel, err := filepath.Rel(absAppDir, p)
+		if err != nil {
+			return err
+		}
+		if ignore.Ignored(filepath.ToSlash(rel), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !keep[p] {
+			extraneous = append(extraneous, filepath.ToSlash(rel))
+		}
+		return nil
 	})
+	return extraneous, err
 }
 
-func httpError(w http.ResponseWriter, message string, code int) {
-	log.Printf("HTTP Error %d: %s", code, message)
-	jsonResponse(w, code, map[string]string{"error": message})
+// removeEmptyParents removes the directories left empty by deleting paths,
+// stopping at the first one that isn't empty and never removing appDir.
+func removeEmptyParents(paths []string) {
+	absAppDir, _ := filepath.Abs(appDir)
+	for _, p := range paths {
+		for dir := filepath.Dir(filepath.Join(absAppDir, p)); dir != absAppDir && isWithinDir(absAppDir, dir); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
 }
 
-func jsonResponse(w http.ResponseWriter, code int, payload interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	if payload != nil {
-		json.NewEncoder(w).Encode(payload)
-	}
+func readPID() (int, error) {
+	rec, err := readPIDFile()
+	return rec.PID, err
 }
 
-// --- File System & Process Helpers ---
+// pidRecord is the content of the pid file: one value per line, so pid files
+// from before the later lines existed still parse.
+type pidRecord struct {
+	PID int
+	// StartedAt is when the dev server was started; zero if not recorded.
+	StartedAt time.Time
+	// StartTicks is the process's start time from /proc, in clock ticks
+	// since boot; zero if not recorded. It identifies the process exactly.
+	StartTicks int64
+	// Port is the port the dev server was started on; zero if not recorded.
+	Port int
+}
 
-func resolveWithinAppDir(p string) (string, error) {
-	cleanPath := filepath.Join(appDir, p)
-	absAppDir, _ := filepath.Abs(appDir)
-	absCleanPath, _ := filepath.Abs(cleanPath)
-	if !strings.HasPrefix(absCleanPath, absAppDir) {
-		return "", fmt.Errorf("path traversal attempt detected: %s", p)
+// matchesProcess reports whether the process now running as r.PID is the one
+// recorded, rather than an unrelated process that reused the pid. It trusts
+// the pid when there is nothing to compare.
+func (r pidRecord) matchesProcess() bool {
+	if r.StartTicks != 0 {
+		ticks, err := processStartTicks(r.PID)
+		return err != nil || ticks == r.StartTicks
 	}
-	return absCleanPath, nil
+	if !r.StartedAt.IsZero() {
+		actual, err := processStartTime(r.PID)
+		return err != nil || sameStartTime(actual, r.StartedAt)
+	}
+	return true
 }
 
-func writeFileBase64(p, b64 string) error {
-	dest, err := resolveWithinAppDir(p)
+func readPIDFile() (pidRecord, error) {
+	data, err := os.ReadFile(pidFile)
 	if err != nil {
-		return err
+		return pidRecord{}, err
 	}
-	data, err := base64.StdEncoding.DecodeString(b64)
-	if err != nil {
-		return fmt.Errorf("invalid base64 content for %s: %w", p, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var rec pidRecord
+	if rec.PID, err = strconv.Atoi(strings.TrimSpace(lines[0])); err != nil {
+		return pidRecord{}, err
 	}
-	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
-		return err
+	if len(lines) > 1 {
+		if t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(lines[1])); err == nil {
+			rec.StartedAt = t
+		}
+	}
+	if len(lines) > 2 {
+		if ticks, err := strconv.ParseInt(strings.TrimSpace(lines[2]), 10, 64); err == nil {
+			rec.StartTicks = ticks
+		}
+	}
+	if len(lines) > 3 {
+		if port, err := strconv.Atoi(strings.TrimSpace(lines[3])); err == nil {
+			rec.Port = port
+		}
 	}
-	return os.WriteFile(dest, data, 0644)
+	return rec, nil
 }
 
-func deletePath(p string) error {
-	dest, err := resolveWithinAppDir(p)
-	if err != nil {
-		return err
+// writePID records the dev server's pid, start time, /proc identity and port,
+// so they survive a control plane restart and a reused pid isn't mistaken for
+// the dev server. StartTicks is filled in here; a line is left empty when its
+// value is unknown.
+func writePID(rec pidRecord) error {
+	var ticks, port string
+	if t, err := processStartTicks(rec.PID); err == nil {
+		ticks = strconv.FormatInt(t, 10)
+	}
+	if rec.Port != 0 {
+		port = strconv.Itoa(rec.Port)
 	}
-	return os.RemoveAll(dest)
+	data := strings.Join([]string{strconv.Itoa(rec.PID), rec.StartedAt.UTC().Format(time.RFC3339Nano), ticks, port}, "\n") + "\n"
+	return os.WriteFile(pidFile, []byte(data), 0644)
 }
 
-func readPID() (int, error) {
-	data, err := os.ReadFile(pidFile)
-	if err != nil {
-		return 0, err
+// currentAppPort returns the port of the running dev server, or
+// defaultAppPort when none is running or its port wasn't recorded.
+func currentAppPort() int {
+	if rec, err := readPIDFile(); err == nil && rec.Port != 0 && isProcessAlive(rec.PID) {
+		return rec.Port
 	}
-	return strconv.Atoi(strings.TrimSpace(string(data)))
+	return defaultAppPort
 }
 
-func writePID(pid int) error {
-	return os.WriteFile(pidFile, []byte(strconv.Itoa(pid)), 0644)
+// isProcessAlive reports whether pid is running. For the pid in the pid file,
+// the process must also match the recorded identity, since after a crash the
+// pid may belong to an unrelated process.
+func isProcessAlive(pid int) bool {
+	if !processExists(pid) {
+		return false
+	}
+	if rec, err := readPIDFile(); err == nil && rec.PID == pid {
+		return rec.matchesProcess()
+	}
+	return true
 }
 
-func isProcessAlive(pid int) bool {
+// processExists reports whether any live process has pid. Zombies, which
+// have exited but not been reaped, don't count.
+func processExists(pid int) bool {
 	proc, err := os.FindProcess(pid)
 	if err != nil {
 		return false
 	}
 	// On Unix, sending signal 0 to a process checks if it exists without killing it.
-	return proc.Signal(syscall.Signal(0)) == nil
+	if proc.Signal(syscall.Signal(0)) != nil {
+		return false
+	}
+	return !isZombie(pid)
 }
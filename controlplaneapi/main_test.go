@@ -0,0 +1,1645 @@
+// main_test.go
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// useAppDir points appDir and the control plane's files at a new temp dir for
+// the rest of the test.
+func useAppDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	vars := []*string{&appDir, &pidFile, &warmPathsFile, &runLogFile, &logFilePath}
+	saved := make([]string, len(vars))
+	for i, v := range vars {
+		saved[i] = *v
+	}
+	t.Cleanup(func() {
+		for i, v := range vars {
+			*v = saved[i]
+		}
+	})
+	appDir = dir
+	pidFile = filepath.Join(dir, ".dev.pid")
+	warmPathsFile = filepath.Join(dir, ".dev.warm-paths.json")
+	runLogFile = filepath.Join(dir, ".dev.run.log")
+	logFilePath = filepath.Join(dir, ".dev.log")
+	return dir
+}
+
+// writeTestFile creates rel under dir with content, making its directories.
+func writeTestFile(t *testing.T, dir, rel, content string) {
+	t.Helper()
+	p := filepath.Join(dir, rel)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncRejectsProtectedPaths(t *testing.T) {
+	dir := useAppDir(t)
+	for _, rel := range []string{".dev.pid", ".dev.log.2", "node_modules/react/index.js", "src/app.js"} {
+		writeTestFile(t, dir, rel, "x")
+	}
+	tests := []struct {
+		path      string
+		protected bool
+	}{
+		{path: "", protected: true},
+		{path: ".", protected: true},
+		{path: "src/..", protected: true},
+		{path: ".dev.pid", protected: true},
+		{path: ".dev.run.log", protected: true},
+		{path: ".dev.log.2", protected: true},
+		{path: "node_modules", protected: true},
+		{path: "node_modules/react/index.js", protected: true},
+		{path: "packages/web/node_modules/x", protected: true},
+		{path: "src/app.js"},
+		{path: ".dev.pid.bak"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			_, writeErr := writeFileBase64(tt.path, SyncFile{Content: "eQ=="}, true)
+			_, planErr := planDelete(tt.path)
+			for name, err := range map[string]error{"write": writeErr, "planned delete": planErr} {
+				if got := errors.Is(err, errProtectedPath); got != tt.protected {
+					t.Errorf("%s: got error %v, want protected=%v", name, err, tt.protected)
+				}
+			}
+		})
+	}
+
+	for _, p := range []string{"", ".", ".dev.pid", "node_modules"} {
+		if err := deletePath(p); !errors.Is(err, errProtectedPath) {
+			t.Errorf("deleting %q: got error %v, want it refused", p, err)
+		}
+	}
+	for _, rel := range []string{".dev.pid", "node_modules/react/index.js", "src/app.js"} {
+		if _, err := os.Stat(filepath.Join(dir, rel)); err != nil {
+			t.Errorf("%s is gone after refused deletes: %v", rel, err)
+		}
+	}
+}
+
+func TestSubmitWithStalledStdout(t *testing.T) {
+	b := newBroadcaster()
+	// Nobody reads the pipe, so the first write to stdout or stderr blocks
+	// forever.
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go b.writeOSStreams(pw, pw)
+	go b.loop()
+	defer b.Shutdown()
+
+	// A block-with-timeout client that never reads mustn't hold things up
+	// either.
+	b.SubscribeAfter(0, overflowBlock)
+	client, _, _ := b.SubscribeAfter(0, overflowDrop)
+	var seen atomic.Int64
+	go func() {
+		for msg := range client {
+			seen.Store(msg.ID)
+		}
+	}()
+
+	const n = 3000
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		b.Submit(fmt.Sprintf("line %d", i))
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("submitting %d lines took %s", n, d)
+	}
+	waitFor(t, "the run loop to broadcast every line", func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.lastID == n
+	})
+	waitFor(t, "the client to catch up", func() bool { return len(client) == 0 })
+	b.Submit("after")
+	waitFor(t, "the client to get the line after the burst", func() bool { return seen.Load() == n+1 })
+	if b.osDropped.Load() == 0 {
+		t.Error("no lines were dropped for the stalled stdout")
+	}
+}
+
+func TestBlockClientGetsLinesInOrder(t *testing.T) {
+	b := newBroadcaster()
+	client := make(chan BroadcastMessage, 10)
+	state := &logClient{policy: overflowBlock, queue: make(chan BroadcastMessage, logClientQueueSize), stop: make(chan struct{})}
+	defer close(state.stop)
+	send := func(id int64) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.deliver(client, state, BroadcastMessage{ID: id})
+	}
+	// The pump starts late, so the client is full with a backlog waiting
+	// when it reads a line and makes room just as another one arrives.
+	const n = 21
+	for id := int64(1); id < n; id++ {
+		send(id)
+	}
+	var last int64
+	select {
+	case msg := <-client:
+		last = msg.ID
+	default:
+	}
+	send(n)
+	go b.pump(client, state.queue, state.stop)
+
+	for last != n {
+		select {
+		case msg := <-client:
+			// Nothing is dropped, so the ids are consecutive.
+			if msg.ID != last+1 {
+				t.Fatalf("got id %d after %d", msg.ID, last)
+			}
+			last = msg.ID
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after id %d", last)
+		}
+	}
+}
+
+func TestSlowClientNoteRateLimit(t *testing.T) {
+	b := newBroadcaster()
+	for i := 0; i < 3; i++ {
+		b.slowClientNote("Dropping message.")
+	}
+	if got := len(b.osLines); got != 1 {
+		t.Fatalf("got %d notes queued, want 1", got)
+	}
+	<-b.osLines
+
+	b.noteMu.Lock()
+	b.lastNote = time.Now().Add(-2 * slowClientNoteInterval)
+	b.noteMu.Unlock()
+	b.slowClientNote("Dropping message.")
+	line := <-b.osLines
+	if !line.note || !strings.Contains(line.text, "(2 similar notes suppressed)") {
+		t.Errorf("got %+v, want a note counting 2 suppressed", line)
+	}
+}
+
+func TestClearReportsGapOnResume(t *testing.T) {
+	b := newBroadcaster()
+	for i := 0; i < 3; i++ {
+		b.mu.Lock()
+		b.lastID++
+		b.appendHistory(BroadcastMessage{ID: b.lastID, Text: fmt.Sprintf("line %d", i)})
+		b.mu.Unlock()
+	}
+	if _, _, gap := b.SubscribeAfter(1, overflowDrop); gap {
+		t.Fatal("got a gap before clearing")
+	}
+	b.Clear()
+	if _, history, gap := b.SubscribeAfter(1, overflowDrop); !gap || len(history) != 0 {
+		t.Errorf("after clearing got gap=%v and %d history lines, want a gap and none", gap, len(history))
+	}
+	if _, _, gap := b.SubscribeAfter(3, overflowDrop); gap {
+		t.Error("got a gap resuming from the last line before the clear")
+	}
+}
+
+// useTestBroadcaster replaces logBroadcaster with a running one that doesn't
+// echo to stdout, for the duration of the test.
+func useTestBroadcaster(t *testing.T) *Broadcaster {
+	t.Helper()
+	saved := logBroadcaster
+	t.Cleanup(func() { logBroadcaster = saved })
+	logBroadcaster = newBroadcaster()
+	go logBroadcaster.writeOSStreams(io.Discard, io.Discard)
+	go logBroadcaster.loop()
+	return logBroadcaster
+}
+
+// broadcastHistory waits for n messages to reach b's history and returns it.
+func broadcastHistory(t *testing.T, b *Broadcaster, n int) []BroadcastMessage {
+	t.Helper()
+	var history []BroadcastMessage
+	waitFor(t, fmt.Sprintf("%d broadcast lines", n), func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		history = b.historySnapshot()
+		return len(history) >= n
+	})
+	return history
+}
+
+func TestShutdownReleasesLogClients(t *testing.T) {
+	useTestBroadcaster(t)
+	srv := httptest.NewServer(http.HandlerFunc(logsHandler))
+	defer srv.Close()
+
+	const clients = 2
+	bodies := make(chan string, clients)
+	for i := 0; i < clients; i++ {
+		resp, err := http.Get(srv.URL + "/dev/logs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			defer resp.Body.Close()
+			data, _ := io.ReadAll(resp.Body)
+			bodies <- string(data)
+		}()
+	}
+	waitFor(t, "the clients to subscribe", func() bool { return logBroadcaster.ClientCount() == clients })
+
+	if n := logBroadcaster.Shutdown(); n != clients {
+		t.Errorf("Shutdown reported %d clients, want %d", n, clients)
+	}
+	for i := 0; i < clients; i++ {
+		select {
+		case body := <-bodies:
+			if !strings.Contains(body, `"system_message":"SHUTTING_DOWN"`) {
+				t.Errorf("stream ended without a SHUTTING_DOWN event:\n%s", body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("a log stream was still open after Shutdown")
+		}
+	}
+	if logBroadcaster.ClientCount() != 0 {
+		t.Errorf("%d clients left after Shutdown", logBroadcaster.ClientCount())
+	}
+}
+
+func TestLogClientUnregisteredOnDisconnect(t *testing.T) {
+	useTestBroadcaster(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "/dev/logs", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		logsHandler(rec, req)
+	}()
+	waitFor(t, "the client to subscribe", func() bool { return logBroadcaster.ClientCount() == 1 })
+
+	cancel()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("the handler was still streaming a second after the client went away")
+	}
+	// The broadcaster's loop handles the unregistration.
+	deadline := time.Now().Add(time.Second)
+	for logBroadcaster.ClientCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients still registered a second after the disconnect", logBroadcaster.ClientCount())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSlowHeadersCutOffButStreamsStayUp(t *testing.T) {
+	b := useTestBroadcaster(t)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(logsHandler))
+	srv.Config.ReadHeaderTimeout = 100 * time.Millisecond
+	srv.Config.ReadTimeout = 200 * time.Millisecond
+	srv.Config.WriteTimeout = 200 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	// A client that never finishes its headers is dropped.
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /dev/logs HTTP/1.1\r\nHost: x\r\n")
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("the connection with unfinished headers stayed open: %v", err)
+	}
+
+	// A log stream outlives the read and write timeouts.
+	resp, err := http.Get(srv.URL + "/dev/logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	time.Sleep(500 * time.Millisecond)
+	b.Submit("still streaming")
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatal("the log stream was cut off")
+			}
+			if strings.Contains(line, "still streaming") {
+				return
+			}
+		case <-timeout:
+			t.Fatal("the message sent after the timeouts never arrived")
+		}
+	}
+}
+
+func TestWritesDontFollowPlantedSymlinks(t *testing.T) {
+	for _, allow := range []bool{true, false} {
+		t.Run(fmt.Sprintf("allowSymlinks=%v", allow), func(t *testing.T) {
+			dir := useAppDir(t)
+			saved := allowSymlinks
+			t.Cleanup(func() { allowSymlinks = saved })
+			allowSymlinks = allow
+			outside := t.TempDir()
+			writeTestFile(t, outside, "victim.txt", "outside")
+			assertOutsideUntouched := func() {
+				t.Helper()
+				if got := readTestFile(t, outside, "victim.txt"); got != "outside" {
+					t.Errorf("victim.txt outside the app dir was overwritten: %q", got)
+				}
+				if entries, _ := os.ReadDir(outside); len(entries) != 1 {
+					t.Errorf("got %d entries outside the app dir, want only victim.txt", len(entries))
+				}
+			}
+
+			// The directory is swapped for a symlink between opening the
+			// temp file and renaming it into place.
+			writeTestFile(t, dir, "sub/victim.txt", "inside")
+			tmp, err := newAtomicFile(filepath.Join(dir, "sub", "victim.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(filepath.Join(dir, "sub"), filepath.Join(dir, "moved")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(outside, filepath.Join(dir, "sub")); err != nil {
+				t.Fatal(err)
+			}
+			tmp.WriteString("new")
+			if err := tmp.commit(0644); err != nil {
+				t.Fatal(err)
+			}
+			tmp.abort()
+			if got := readTestFile(t, dir, "moved/victim.txt"); got != "new" {
+				t.Errorf("got %q in the directory that was open, want the write there", got)
+			}
+			assertOutsideUntouched()
+
+			// The symlink is already in place once the directory is opened,
+			// as when it's planted after checkSymlinks ran.
+			if _, err := newAtomicFile(filepath.Join(dir, "sub", "victim.txt")); err == nil {
+				t.Error("opened a temp file through a symlink out of the app dir")
+			}
+			if _, err := openDirBeneath(filepath.Join(dir, "sub", "new"), true); err == nil {
+				t.Error("made a directory through a symlink out of the app dir")
+			}
+			if _, err := writeFileBase64("sub/victim.txt", SyncFile{Content: "eQ=="}, false); err == nil {
+				t.Error("synced a file through a symlink out of the app dir")
+			}
+			if err := deletePath("sub/victim.txt"); err == nil {
+				t.Error("deleted a file through a symlink out of the app dir")
+			}
+			assertOutsideUntouched()
+
+			// With symlinks refused, even one inside the app dir isn't
+			// followed.
+			if err := os.Symlink("moved", filepath.Join(dir, "inner")); err != nil {
+				t.Fatal(err)
+			}
+			_, err = openDirBeneath(filepath.Join(dir, "inner"), false)
+			if allow && err != nil {
+				t.Errorf("refused a symlink inside the app dir: %v", err)
+			}
+			if !allow && err == nil {
+				t.Error("followed a symlink with -allow-symlinks=false")
+			}
+
+			// Deleting a symlink removes the link, not what it points to.
+			if err := deletePath("inner"); err != nil {
+				t.Fatal(err)
+			}
+			if got := readTestFile(t, dir, "moved/victim.txt"); got != "new" {
+				t.Errorf("deleting a symlink touched its target: %q", got)
+			}
+		})
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir := useAppDir(t)
+	writeTestFile(t, dir, "src/app.js", "hello")
+	writeTestFile(t, dir, "empty.txt", "")
+	writeTestFile(t, dir, "dist/out.js", "x")
+	writeTestFile(t, dir, "node_modules/react/index.js", "react")
+	writeTestFile(t, dir, ".syncignore", "dist/\n")
+	if err := os.Symlink("src/app.js", filepath.Join(dir, "link.js")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		query string
+		want  string // path:size
+	}{
+		{query: "", want: ".syncignore:6 empty.txt:0 src/app.js:5"},
+		{query: "ignore=*.js", want: ".syncignore:6 empty.txt:0"},
+		{query: "hashes=true", want: ".syncignore:6 empty.txt:0 src/app.js:5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			filesHandler(rec, httptest.NewRequest(http.MethodGet, "/files?"+tt.query, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got %d: %s", rec.Code, rec.Body)
+			}
+			var resp FilesResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			var total int64
+			for _, e := range resp.Files {
+				if e.Mode != "0644" || e.ModTime.IsZero() {
+					t.Errorf("%s: got mode %q and mtime %v", e.Path, e.Mode, e.ModTime)
+				}
+				if hashed := e.SHA256 != ""; hashed != strings.Contains(tt.query, "hashes") {
+					t.Errorf("%s: got sha256 %q", e.Path, e.SHA256)
+				}
+				got = append(got, fmt.Sprintf("%s:%d", e.Path, e.Size))
+				total += e.Size
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("got %s, want %s", strings.Join(got, " "), tt.want)
+			}
+			if resp.Count != len(resp.Files) || resp.Bytes != total {
+				t.Errorf("got count %d and %d bytes for %d files of %d bytes", resp.Count, resp.Bytes, len(resp.Files), total)
+			}
+		})
+	}
+	for _, query := range []string{"hashes=maybe", "ignore=a["} {
+		rec := httptest.NewRecorder()
+		filesHandler(rec, httptest.NewRequest(http.MethodGet, "/files?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestFileRead(t *testing.T) {
+	dir := useAppDir(t)
+	saved := maxFileReadBytes
+	t.Cleanup(func() { maxFileReadBytes = saved })
+	maxFileReadBytes = 100
+	writeTestFile(t, dir, "src/app.js", "hello")
+	writeTestFile(t, dir, "big.bin", strings.Repeat("x", 200))
+	outside := t.TempDir()
+	writeTestFile(t, outside, "secret.txt", "secret")
+	if err := os.Symlink(outside, filepath.Join(dir, "out")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		query    string
+		wantCode int
+	}{
+		{query: "path=src/app.js", wantCode: http.StatusOK},
+		{query: "", wantCode: http.StatusBadRequest},
+		{query: "path=src/app.js&encoding=hex", wantCode: http.StatusBadRequest},
+		{query: "path=src", wantCode: http.StatusBadRequest},
+		{query: "path=missing.js", wantCode: http.StatusNotFound},
+		{query: "path=../etc/passwd", wantCode: http.StatusForbidden},
+		{query: "path=out/secret.txt", wantCode: http.StatusForbidden},
+		{query: "path=big.bin", wantCode: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			fileReadHandler(rec, httptest.NewRequest(http.MethodGet, "/files/read?"+tt.query, nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got %d (%s), want %d", rec.Code, strings.TrimSpace(rec.Body.String()), tt.wantCode)
+			}
+			if tt.wantCode == http.StatusOK && rec.Body.String() != "hello" {
+				t.Errorf("got body %q", rec.Body)
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	fileReadHandler(rec, httptest.NewRequest(http.MethodGet, "/files/read?path=./src/../src/app.js&encoding=base64", nil))
+	var resp FileContentResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+	content, _ := base64.StdEncoding.DecodeString(resp.Content)
+	// sha256 of "hello".
+	const sum = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if resp.Path != "src/app.js" || string(content) != "hello" || resp.SHA256 != sum || resp.Size != 5 {
+		t.Errorf("got %+v", resp)
+	}
+}
+
+// TestFsEndpointsUnchanged pins the /fs/list and /fs/read responses existing
+// clients rely on.
+func TestFsEndpointsUnchanged(t *testing.T) {
+	dir := useAppDir(t)
+	writeTestFile(t, dir, "src/app.js", "hello")
+	if err := os.Mkdir(filepath.Join(dir, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		handler  http.HandlerFunc
+		target   string
+		wantCode int
+		wantBody string
+	}{
+		{handler: fsListHandler, target: "/fs/list?path=src", wantCode: http.StatusOK, wantBody: `[{"relative_path":"app.js","type":"file"}]` + "\n"},
+		{handler: fsListHandler, target: "/fs/list?path=empty", wantCode: http.StatusOK, wantBody: "null\n"},
+		{handler: fsReadHandler, target: "/fs/read?path=src/app.js", wantCode: http.StatusOK, wantBody: "hello"},
+		{handler: fsReadHandler, target: "/fs/read", wantCode: http.StatusBadRequest, wantBody: "Query parameter 'path' is required\n"},
+		{handler: fsReadHandler, target: "/fs/read?path=missing.js", wantCode: http.StatusNotFound, wantBody: "File not found\n"},
+		{handler: fsReadHandler, target: "/fs/read?path=src", wantCode: http.StatusBadRequest, wantBody: "Path is a directory, not a file\n"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		tt.handler(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if rec.Code != tt.wantCode || rec.Body.String() != tt.wantBody {
+			t.Errorf("%s: got %d %q, want %d %q", tt.target, rec.Code, rec.Body, tt.wantCode, tt.wantBody)
+		}
+	}
+}
+
+func TestSyncReportsPartialWrites(t *testing.T) {
+	dir := useAppDir(t)
+	saved := maxSyncBytes
+	t.Cleanup(func() { maxSyncBytes = saved })
+	maxSyncBytes = 200
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{name: "syntax error", body: `{"files": {"a.txt": "YQ==", "b.txt": 12}}`, wantCode: http.StatusBadRequest},
+		{name: "truncated", body: `{"files": {"a.txt": "YQ==", "b.txt": "Y`, wantCode: http.StatusBadRequest},
+		{name: "too large", body: `{"files": {"a.txt": "YQ==", "b.txt": "` + strings.Repeat("A", 400) + `"}}`, wantCode: http.StatusRequestEntityTooLarge},
+		{name: "bad mode", body: `{"files": {"a.txt": "YQ=="}, "mode": "merge"}`, wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(filepath.Join(dir, "a.txt"))
+			rec := httptest.NewRecorder()
+			syncHandler(rec, httptest.NewRequest(http.MethodPost, "/sync", strings.NewReader(tt.body)))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got %d: %s", rec.Code, rec.Body)
+			}
+			var resp SyncResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if !resp.Partial || resp.SyncID == 0 || resp.Files["a.txt"].Status != "written" {
+				t.Errorf("got %+v, want a partial result listing a.txt as written", resp)
+			}
+			if got := readTestFile(t, dir, "a.txt"); got != "a" {
+				t.Errorf("a.txt: got %q", got)
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	syncHandler(rec, httptest.NewRequest(http.MethodPost, "/sync", strings.NewReader(`{"files": {"a.txt": 12}}`)))
+	var resp SyncResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusBadRequest || resp.Partial || resp.SyncID != 0 {
+		t.Errorf("got %d %+v for a request that wrote nothing, want a plain 400", rec.Code, resp)
+	}
+}
+
+func TestDevCommandEndpointsAgree(t *testing.T) {
+	dir := useAppDir(t)
+	saved := devCommandOverride
+	t.Cleanup(func() { devCommandOverride = saved })
+	if currentSettings() == nil {
+		s, err := newLiveSettings("", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		settings.Store(s)
+	}
+	writeTestFile(t, dir, "package.json", `{"scripts": {"dev": "vite"}}`)
+	writeTestFile(t, dir, "other/package.json", `{"scripts": {"start": "node server.js"}}`)
+
+	get := func(h http.HandlerFunc, target string) map[string]interface{} {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		var resp map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		return resp
+	}
+	for _, override := range [][]string{nil, {"node", "server.js", "--dev"}} {
+		devCommandOverride = override
+		want := fmt.Sprint("npm", []interface{}{"run", "dev"})
+		if override != nil {
+			want = fmt.Sprint("node", []interface{}{"server.js", "--dev"})
+		}
+		command := get(devCommandHandler, "/dev/command")
+		resolved := get(resolveHandler, "/dev/resolve")
+		snapshot := get(snapshotHandler, "/debug/snapshot")["dev_command"].(map[string]interface{})
+		for name, resp := range map[string]map[string]interface{}{"/dev/command": command, "/dev/resolve": resolved, "/debug/snapshot": snapshot} {
+			if got := fmt.Sprint(resp["command"], resp["args"]); got != want {
+				t.Errorf("%s with override %q: got %s, want %s", name, override, got, want)
+			}
+			if got, _ := resp["override"].(bool); got != (override != nil) {
+				t.Errorf("%s with override %q: got override=%v", name, override, resp["override"])
+			}
+		}
+		// The override only applies where the dev server runs.
+		if other := get(resolveHandler, "/dev/resolve?path=other"); other["command"] != "npm" || other["override"] != nil {
+			t.Errorf("/dev/resolve?path=other with override %q: got %v", override, other)
+		}
+	}
+}
+
+// startDevProcess runs script in its own process group and records it in the
+// pid file, as a dev server this instance didn't start. It returns once the
+// script has created its "started" file.
+func startDevProcess(t *testing.T, dir, script string) int {
+	t.Helper()
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Dir = dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go cmd.Wait()
+	t.Cleanup(func() { syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) })
+	if err := writePID(pidRecord{PID: cmd.Process.Pid, StartedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the process to start", func() bool {
+		_, err := os.Stat(filepath.Join(dir, "started"))
+		return err == nil
+	})
+	return cmd.Process.Pid
+}
+
+func TestHealthModes(t *testing.T) {
+	savedMode, savedExpected := healthMode, devServerExpected.Load()
+	t.Cleanup(func() {
+		healthMode = savedMode
+		devServerExpected.Store(savedExpected)
+	})
+	tests := []struct {
+		mode     string
+		running  bool
+		expected bool
+		wantCode int
+	}{
+		{mode: healthModePlain, running: true, expected: true, wantCode: http.StatusOK},
+		{mode: healthModePlain, running: false, expected: true, wantCode: http.StatusOK},
+		{mode: healthModeDev, running: true, expected: true, wantCode: http.StatusOK},
+		{mode: healthModeDev, running: false, expected: true, wantCode: http.StatusServiceUnavailable},
+		// A server that was never started, or was stopped, isn't missed.
+		{mode: healthModeDev, running: false, expected: false, wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s running=%v expected=%v", tt.mode, tt.running, tt.expected), func(t *testing.T) {
+			dir := useAppDir(t)
+			if tt.running {
+				startDevProcess(t, dir, `touch started; while :; do sleep 0.05; done`)
+			}
+			healthMode = tt.mode
+			devServerExpected.Store(tt.expected)
+
+			rec := httptest.NewRecorder()
+			healthHandler(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got %d: %s", rec.Code, rec.Body)
+			}
+			var resp struct {
+				Status string `json:"status"`
+				Reason string `json:"reason"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			wantStatus := "healthy"
+			if tt.wantCode != http.StatusOK {
+				wantStatus = "unhealthy"
+			}
+			if resp.Status != wantStatus || (resp.Reason != "") != (tt.wantCode != http.StatusOK) {
+				t.Errorf("got %s", rec.Body)
+			}
+		})
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    syscall.Signal
+		wantErr bool
+	}{
+		{name: "SIGTERM", want: syscall.SIGTERM},
+		{name: "sigint", want: syscall.SIGINT},
+		{name: "INT", want: syscall.SIGINT},
+		{name: " hup ", want: syscall.SIGHUP},
+		{name: "KILL", want: syscall.SIGKILL},
+		{name: "SIGSTOP", wantErr: true},
+		{name: "15", wantErr: true},
+		{name: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSignal(tt.name)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("got %v, %v; want %v, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStopDevServerSignal(t *testing.T) {
+	tests := []struct {
+		name       string
+		script     string
+		signal     syscall.Signal
+		wantForced bool
+	}{
+		{name: "exits on the configured signal", script: `trap 'exit 0' INT`, signal: syscall.SIGINT},
+		{name: "exits on the default signal", script: `trap 'exit 0' TERM`},
+		{name: "ignores the signal", script: `trap '' TERM`, signal: syscall.SIGTERM, wantForced: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := useAppDir(t)
+			pid := startDevProcess(t, dir, tt.script+`; touch started; while :; do sleep 0.05; done`)
+			wait := 5 * time.Second
+			if tt.wantForced {
+				wait = 200 * time.Millisecond
+			}
+			steps := []stopStep{{Signal: tt.signal, Wait: wait}}
+			if tt.signal == 0 {
+				steps = stopSteps()
+			}
+			forced, err := stopDevServer(steps)
+			if err != nil || forced != tt.wantForced {
+				t.Errorf("got forced=%v, %v; want forced=%v", forced, err, tt.wantForced)
+			}
+			waitFor(t, "the process to exit", func() bool { return !processExists(pid) })
+			if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+				t.Error("the pid file is left after stopping")
+			}
+		})
+	}
+}
+
+func TestParseStopSequence(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{spec: "", want: "[]"},
+		{spec: "SIGINT:3s,SIGTERM:5s", want: "[SIGINT:3s SIGTERM:5s]"},
+		{spec: " int:500ms , term:0s ", want: "[SIGINT:500ms SIGTERM:0s]"},
+		{spec: "SIGINT", wantErr: true},
+		{spec: "SIGINT:soon", wantErr: true},
+		{spec: "SIGINT:-1s", wantErr: true},
+		{spec: "SIGKILL:1s", wantErr: true},
+		{spec: "SIGBOGUS:1s", wantErr: true},
+		{spec: "SIGINT:3m,SIGTERM:3m", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			steps, err := parseStopSequence(tt.spec)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %v, want an error", steps)
+				}
+				return
+			}
+			if got := fmt.Sprint(steps); err != nil || got != tt.want {
+				t.Errorf("got %s, %v; want %s", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStopDevServerEscalates(t *testing.T) {
+	dir := useAppDir(t)
+	// SIGINT is ignored, as by a server that only stops on SIGTERM.
+	pid := startDevProcess(t, dir, `trap '' INT; trap 'echo TERM > got; exit 0' TERM; touch started; while :; do sleep 0.05; done`)
+	start := time.Now()
+	forced, err := stopDevServer([]stopStep{{Signal: syscall.SIGINT, Wait: 300 * time.Millisecond}, {Signal: syscall.SIGTERM, Wait: 5 * time.Second}})
+	if err != nil || forced {
+		t.Fatalf("got forced=%v, %v; want it stopped by SIGTERM", forced, err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("SIGTERM came %s after SIGINT, before its wait was up", d)
+	}
+	if got := readTestFile(t, dir, "got"); got != "TERM\n" {
+		t.Errorf("got %q", got)
+	}
+	waitFor(t, "the process to exit", func() bool { return !processExists(pid) })
+}
+
+// freePort returns a local port nothing is listening on.
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestDevServerExitIsReaped(t *testing.T) {
+	dir := useAppDir(t)
+	useTestBroadcaster(t)
+	t.Cleanup(func() {
+		lastExitMu.Lock()
+		lastExit = nil
+		lastExitMu.Unlock()
+	})
+	writeTestFile(t, dir, "hold", "")
+	script := `while [ -e hold ]; do sleep 0.05; done; echo bye >&2; exit 3`
+	pid, _, err := startDevServer(devStartOptions{Port: freePort(t), Command: []string{"sh", "-c", script}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Kill(-pid, syscall.SIGKILL) })
+	done := ownedDevProcessDone(pid)
+	if done == nil {
+		t.Fatal("the started process isn't the owned dev server")
+	}
+	if got, err := readPID(); err != nil || got != pid {
+		t.Fatalf("got pid file %d, %v; want %d", got, err, pid)
+	}
+
+	os.Remove(filepath.Join(dir, "hold"))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the exit wasn't noticed")
+	}
+	// A zombie still takes signals; a reaped process is gone.
+	if err := syscall.Kill(pid, 0); err != syscall.ESRCH {
+		t.Errorf("got %v signalling the exited process, want it reaped", err)
+	}
+	if ownedDevProcessDone(pid) != nil {
+		t.Error("the exited process is still the owned dev server")
+	}
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("pid file left behind: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	statusHandler(rec, httptest.NewRequest(http.MethodGet, "/dev/status", nil))
+	var status struct {
+		Running    bool     `json:"running"`
+		ExitCode   int      `json:"last_exit_code"`
+		ExitReason string   `json:"last_exit_reason"`
+		Stderr     []string `json:"last_stderr"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Running || status.ExitCode != 3 || status.ExitReason != "exit status 3" {
+		t.Errorf("got status %s", rec.Body)
+	}
+	if strings.Join(status.Stderr, "\n") != "bye" {
+		t.Errorf("got last stderr %q", status.Stderr)
+	}
+}
+
+func TestIsProcessAliveDetectsPIDReuse(t *testing.T) {
+	useAppDir(t)
+	pid := os.Getpid()
+	ticks, err := processStartTicks(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, err := processStartTime(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		pidFile string
+		want    bool
+	}{
+		{name: "no pid file", want: true},
+		{name: "pid only, as old pid files were", pidFile: fmt.Sprintf("%d\n", pid), want: true},
+		{name: "matching start ticks", pidFile: fmt.Sprintf("%d\n%s\n%d\n", pid, started.Format(time.RFC3339Nano), ticks), want: true},
+		{name: "other start ticks", pidFile: fmt.Sprintf("%d\n%s\n%d\n", pid, started.Format(time.RFC3339Nano), ticks+1000)},
+		{name: "matching start time", pidFile: fmt.Sprintf("%d\n%s\n", pid, started.Format(time.RFC3339Nano)), want: true},
+		{name: "other start time", pidFile: fmt.Sprintf("%d\n%s\n", pid, started.Add(-time.Hour).Format(time.RFC3339Nano))},
+		{name: "a different pid", pidFile: fmt.Sprintf("%d\n%s\n%d\n", pid+1, started.Format(time.RFC3339Nano), ticks+1000), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(pidFile)
+			if tt.pidFile != "" {
+				if err := os.WriteFile(pidFile, []byte(tt.pidFile), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := isProcessAlive(pid); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// writePID records the start ticks, so its record matches.
+	if err := writePID(pidRecord{PID: pid, StartedAt: started}); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := readPIDFile(); err != nil || rec.StartTicks != ticks || !isProcessAlive(pid) {
+		t.Errorf("got %+v, %v from writePID's record", rec, err)
+	}
+}
+
+func TestSyncManyFilesWithFewDescriptors(t *testing.T) {
+	dir := useAppDir(t)
+	// Leave room for only a few dozen more open files, so writing every file
+	// at once would fail with EMFILE.
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("/proc/self/fd is unavailable")
+	}
+	highest := 0
+	for _, e := range entries {
+		var fd int
+		if _, err := fmt.Sscan(e.Name(), &fd); err == nil && fd > highest {
+			highest = fd
+		}
+	}
+	var saved syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &saved); err != nil {
+		t.Fatal(err)
+	}
+	limited := saved
+	limited.Cur = uint64(highest + 1 + 4*syncConcurrency)
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limited); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Setrlimit(syscall.RLIMIT_NOFILE, &saved) })
+
+	const n = 1000
+	var body strings.Builder
+	body.WriteString(`{"files": {`)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		fmt.Fprintf(&body, `"src/f%d.txt": %q`, i, base64.StdEncoding.EncodeToString([]byte(fmt.Sprint(i))))
+	}
+	body.WriteString(`}}`)
+	rec := httptest.NewRecorder()
+	syncHandler(rec, httptest.NewRequest(http.MethodPost, "/sync", strings.NewReader(body.String())))
+	syscall.Setrlimit(syscall.RLIMIT_NOFILE, &saved)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %.500s", rec.Code, rec.Body)
+	}
+	for _, i := range []int{0, n / 2, n - 1} {
+		if got := readTestFile(t, dir, fmt.Sprintf("src/f%d.txt", i)); got != fmt.Sprint(i) {
+			t.Errorf("f%d.txt: got %q", i, got)
+		}
+	}
+}
+
+func TestSyncMirror(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dry_run=%v", dryRun), func(t *testing.T) {
+			dir := useAppDir(t)
+			writeTestFile(t, dir, ".syncignore", "*.log\n")
+			writeTestFile(t, dir, "keep.js", "old")
+			writeTestFile(t, dir, "stale.js", "stale")
+			writeTestFile(t, dir, "old/deep/gone.js", "gone")
+			writeTestFile(t, dir, "debug.log", "log")
+			writeTestFile(t, dir, "node_modules/react/index.js", "react")
+
+			rec := httptest.NewRecorder()
+			body := `{"files": {".syncignore": "Ki5sb2cK", "keep.js": "bmV3", "new.js": "bmV3"}, "mode": "mirror"}`
+			syncHandler(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/sync?dry_run=%v", dryRun), strings.NewReader(body)))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got %d: %s", rec.Code, rec.Body)
+			}
+			var resp SyncResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			want := "old/deep/gone.js,stale.js"
+			sort.Strings(resp.MirrorDeleted)
+			if got := strings.Join(resp.MirrorDeleted, ","); got != want {
+				t.Errorf("got mirror_deleted %q, want %q", got, want)
+			}
+			for _, rel := range []string{"debug.log", "node_modules/react/index.js"} {
+				if _, err := os.Stat(filepath.Join(dir, rel)); err != nil {
+					t.Errorf("ignored %s was touched: %v", rel, err)
+				}
+			}
+			_, staleErr := os.Stat(filepath.Join(dir, "stale.js"))
+			_, oldErr := os.Stat(filepath.Join(dir, "old"))
+			if dryRun {
+				if staleErr != nil || oldErr != nil || readTestFile(t, dir, "keep.js") != "old" {
+					t.Error("a dry run changed the app dir")
+				}
+				return
+			}
+			if !os.IsNotExist(staleErr) {
+				t.Error("stale.js wasn't deleted")
+			}
+			if !os.IsNotExist(oldErr) {
+				t.Error("old/ was left behind empty")
+			}
+			if got := readTestFile(t, dir, "new.js"); got != "new" {
+				t.Errorf("new.js: got %q", got)
+			}
+		})
+	}
+}
+
+func TestAllowedMethods(t *testing.T) {
+	saved := currentSettings()
+	t.Cleanup(func() { settings.Store(saved) })
+	s, err := newLiveSettings("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.Store(s)
+	mux, _ := newMuxes()
+	h := corsMiddleware(mux)
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/dev/status", want: "GET, HEAD, OPTIONS"},
+		{path: "/files/read", want: "GET, HEAD, OPTIONS"},
+		{path: "/sync", want: "POST, OPTIONS"},
+		{path: "/admin/maintenance", want: "GET, POST, HEAD, OPTIONS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodOptions, tt.path, nil))
+			if rec.Code != http.StatusNoContent {
+				t.Fatalf("got %d for the preflight", rec.Code)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Methods"); got != tt.want {
+				t.Errorf("got Access-Control-Allow-Methods %q, want %q", got, tt.want)
+			}
+			if strings.Contains(tt.want, http.MethodPost) {
+				return
+			}
+			// The 405 for a method the route doesn't take agrees.
+			rec = httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tt.path, nil))
+			if rec.Code != http.StatusMethodNotAllowed {
+				t.Fatalf("got %d for POST", rec.Code)
+			}
+			if got := rec.Header().Get("Allow"); got != tt.want {
+				t.Errorf("got Allow %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdminRoutesSplit(t *testing.T) {
+	saved := adminListenAddr
+	t.Cleanup(func() { adminListenAddr = saved })
+	routed := func(mux *http.ServeMux, path string) bool {
+		_, pattern := mux.Handler(httptest.NewRequest(http.MethodGet, path, nil))
+		return pattern != ""
+	}
+	tests := []struct {
+		path                string
+		wantMain, wantAdmin bool
+	}{
+		{path: "/health", wantMain: true, wantAdmin: true},
+		{path: "/readyz", wantMain: true, wantAdmin: true},
+		{path: "/metrics", wantMain: false, wantAdmin: true},
+		{path: "/metrics/stream", wantMain: false, wantAdmin: true},
+		{path: "/sync", wantMain: true, wantAdmin: false},
+		{path: "/debug/snapshot", wantMain: true, wantAdmin: false},
+	}
+
+	adminListenAddr = ""
+	mux, adminMux := newMuxes()
+	if mux != adminMux {
+		t.Fatal("without -admin-listen-addr there should be a single mux")
+	}
+	for _, tt := range tests {
+		if !routed(mux, tt.path) {
+			t.Errorf("%s isn't served without -admin-listen-addr", tt.path)
+		}
+	}
+
+	adminListenAddr = "127.0.0.1:9090"
+	mux, adminMux = newMuxes()
+	for _, tt := range tests {
+		if got := routed(mux, tt.path); got != tt.wantMain {
+			t.Errorf("%s on -listen-addr: got routed=%v, want %v", tt.path, got, tt.wantMain)
+		}
+		if got := routed(adminMux, tt.path); got != tt.wantAdmin {
+			t.Errorf("%s on -admin-listen-addr: got routed=%v, want %v", tt.path, got, tt.wantAdmin)
+		}
+	}
+}
+
+func TestDetectDevCommand(t *testing.T) {
+	tests := []struct {
+		name       string
+		files      map[string]string
+		wantCmd    string
+		wantReason string
+		wantEnv    map[string]string
+		wantErr    string
+	}{
+		{
+			name:       "next config wins over scripts",
+			files:      map[string]string{"next.config.mjs": "", "package.json": `{"scripts": {"dev": "next dev"}}`},
+			wantCmd:    "node node_modules/next/dist/bin/next dev -p 3000",
+			wantReason: "config file next.config.mjs",
+		},
+		{
+			name:       "vite config",
+			files:      map[string]string{"vite.config.mts": ""},
+			wantCmd:    "node node_modules/vite/bin/vite.js --port 3000",
+			wantReason: "config file vite.config.mts",
+		},
+		{
+			name:       "angular",
+			files:      map[string]string{"angular.json": "{}"},
+			wantCmd:    "npx ng serve --port 3000",
+			wantReason: "config file angular.json",
+		},
+		{
+			name:       "dev script with the project's package manager",
+			files:      map[string]string{"package.json": `{"scripts": {"dev": "x", "start": "y"}}`, "pnpm-lock.yaml": ""},
+			wantCmd:    "pnpm run dev",
+			wantReason: `package.json script "dev"`,
+		},
+		{
+			name:       "create react app start script",
+			files:      map[string]string{"package.json": `{"scripts": {"start": "react-scripts start"}, "dependencies": {"react-scripts": "5.0.1"}}`},
+			wantCmd:    "npm start",
+			wantReason: `package.json script "start"`,
+			wantEnv:    map[string]string{"BROWSER": "none"},
+		},
+		{
+			name:       "create react app without scripts",
+			files:      map[string]string{"package.json": `{"devDependencies": {"react-scripts": "5.0.1"}}`},
+			wantCmd:    "npx react-scripts start",
+			wantReason: "dependency react-scripts",
+			wantEnv:    map[string]string{"BROWSER": "none"},
+		},
+		{
+			name:       "nuxt",
+			files:      map[string]string{"package.json": `{"dependencies": {"nuxt": "^3"}}`},
+			wantCmd:    "npx nuxi dev --port 3000",
+			wantReason: "dependency nuxt",
+		},
+		{
+			name:       "remix classic compiler",
+			files:      map[string]string{"package.json": `{"devDependencies": {"@remix-run/dev": "^2"}}`},
+			wantCmd:    "npx remix dev",
+			wantReason: "dependency @remix-run/dev",
+		},
+		{
+			name:       "sveltekit",
+			files:      map[string]string{"package.json": `{"devDependencies": {"@sveltejs/kit": "^2"}}`},
+			wantCmd:    "npx vite dev --port 3000",
+			wantReason: "dependency @sveltejs/kit",
+		},
+		{
+			name:       "solidstart",
+			files:      map[string]string{"package.json": `{"dependencies": {"@solidjs/start": "^1"}}`},
+			wantCmd:    "npx vinxi dev --port 3000",
+			wantReason: "dependency @solidjs/start",
+		},
+		{
+			name:    "no package.json",
+			wantErr: "there is no package.json",
+		},
+		{
+			name:    "unreadable package.json",
+			files:   map[string]string{"package.json": "{"},
+			wantErr: "package.json could not be read",
+		},
+		{
+			name:    "nothing matches",
+			files:   map[string]string{"package.json": `{"scripts": {"build": "tsc"}, "dependencies": {"express": "^4"}}`},
+			wantErr: "found scripts: build; framework dependencies: express",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for rel, content := range tt.files {
+				writeTestFile(t, dir, rel, content)
+			}
+			dc, err := detectDevCommand(dir, 3000)
+			if tt.wantErr != "" {
+				var noCmd *noDevCommandError
+				if !errors.As(err, &noCmd) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %+v, %v, want an error containing %q", dc, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(append([]string{dc.Command}, dc.Args...), " "); got != tt.wantCmd {
+				t.Errorf("got command %q, want %q", got, tt.wantCmd)
+			}
+			if dc.Reason != tt.wantReason {
+				t.Errorf("got reason %q, want %q", dc.Reason, tt.wantReason)
+			}
+			if fmt.Sprint(dc.Env) != fmt.Sprint(tt.wantEnv) {
+				t.Errorf("got env %v, want %v", dc.Env, tt.wantEnv)
+			}
+		})
+	}
+}
+
+func TestResolveHandler(t *testing.T) {
+	dir := useAppDir(t)
+	writeTestFile(t, dir, "web/vite.config.ts", "")
+	writeTestFile(t, dir, "web/index.html", "")
+	writeTestFile(t, dir, "empty/.keep", "")
+	writeTestFile(t, dir, "package.json", `{"scripts": {"start": "node server.js"}}`)
+	savedSubdir := appSubdir
+	t.Cleanup(func() { appSubdir = savedSubdir })
+
+	tests := []struct {
+		name         string
+		subdir       string
+		query        string
+		wantCode     int
+		wantResolved bool
+		wantReason   string
+	}{
+		{name: "default is the app dir", wantCode: http.StatusOK, wantResolved: true, wantReason: `package.json script "start"`},
+		{name: "default is -app-subdir", subdir: "web", wantCode: http.StatusOK, wantResolved: true, wantReason: "config file vite.config.ts"},
+		{name: "subdirectory", query: "?path=web", wantCode: http.StatusOK, wantResolved: true, wantReason: "config file vite.config.ts"},
+		{name: "nothing to run", query: "?path=empty", wantCode: http.StatusOK},
+		{name: "escapes the app dir", query: "?path=../..", wantCode: http.StatusForbidden},
+		{name: "missing", query: "?path=nope", wantCode: http.StatusNotFound},
+		{name: "a file", query: "?path=web/index.html", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appSubdir = tt.subdir
+			rec := httptest.NewRecorder()
+			resolveHandler(rec, httptest.NewRequest(http.MethodGet, "/dev/resolve"+tt.query, nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got %d: %s", rec.Code, rec.Body)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			var resp struct {
+				Resolved bool   `json:"resolved"`
+				Reason   string `json:"reason"`
+				Error    string `json:"error"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Resolved != tt.wantResolved || resp.Reason != tt.wantReason {
+				t.Errorf("got %+v, want resolved=%v with reason %q", resp, tt.wantResolved, tt.wantReason)
+			}
+			if !resp.Resolved && resp.Error == "" {
+				t.Error("an unresolved command came back without an error")
+			}
+		})
+	}
+}
+
+func TestStreamCommandOutputKeepsStreamsApart(t *testing.T) {
+	b := useTestBroadcaster(t)
+	cmd := exec.Command("sh", "-c", "echo out1; echo err1 >&2; echo out2; echo err2 >&2; exit 3")
+	cmd.Dir = t.TempDir()
+	out, err := streamCommandOutput(cmd, nil)
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("got %v, want an exit error", err)
+	}
+	if out.ExitCode != 3 || out.Stdout != "out1\nout2\n" || out.Stderr != "err1\nerr2\n" {
+		t.Errorf("got %+v", out)
+	}
+
+	// "--- Running", four lines and "--- Command failed".
+	lines := 0
+	for _, msg := range broadcastHistory(t, b, 6) {
+		if strings.HasPrefix(msg.Text, "--- ") {
+			continue
+		}
+		lines++
+		if wantStderr := strings.HasPrefix(msg.Text, "err"); msg.IsStderr != wantStderr {
+			t.Errorf("%q was broadcast with IsStderr=%v", msg.Text, msg.IsStderr)
+		}
+	}
+	if lines != 4 {
+		t.Errorf("got %d output lines broadcast, want 4", lines)
+	}
+}
+
+func TestIsWithinDir(t *testing.T) {
+	tests := []struct {
+		dir, p string
+		want   bool
+	}{
+		{"/app", "/app", true},
+		{"/app", "/app/src/index.js", true},
+		{"/app", "/app/..foo", true},
+		{"/app", "/app/src/../index.js", true},
+		{"/app", "/applet-evil", false},
+		{"/app", "/app-evil/index.js", false},
+		{"/app", "/", false},
+		{"/app", "/etc/passwd", false},
+		{"/app", "/app/../etc", false},
+		{"/app/", "/app/src", true},
+		{"/", "/anything", true},
+	}
+	for _, tt := range tests {
+		if got := isWithinDir(tt.dir, tt.p); got != tt.want {
+			t.Errorf("isWithinDir(%q, %q) = %v, want %v", tt.dir, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateLogLine(t *testing.T) {
+	saved := maxLogLineBytes
+	t.Cleanup(func() { maxLogLineBytes = saved })
+	tests := []struct {
+		max        int
+		text, want string
+	}{
+		{max: 8, text: "short", want: "short"},
+		{max: 8, text: "exactly8", want: "exactly8"},
+		{max: 8, text: "0123456789", want: "01234567...[truncated 2 bytes]"},
+		// "é" is two bytes; cutting between them would send invalid UTF-8.
+		{max: 8, text: "abcdefgé rest", want: "abcdefg...[truncated 7 bytes]"},
+		{max: 0, text: strings.Repeat("x", 100), want: strings.Repeat("x", 100)},
+	}
+	for _, tt := range tests {
+		maxLogLineBytes = tt.max
+		if got := truncateLogLine(tt.text); got != tt.want {
+			t.Errorf("truncateLogLine(%q) with max %d = %q, want %q", tt.text, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestHugeLogLineDoesntStopOutput(t *testing.T) {
+	dir := useAppDir(t)
+	savedRunLogs := runLogs
+	t.Cleanup(func() { runLogs = savedRunLogs })
+	runLogs = startRotatingLog(runLogFile, 0, 0, 1)
+	defer runLogs.Close()
+	b := useTestBroadcaster(t)
+	huge := strings.Repeat("x", maxScannedLineBytes+10)
+	streamPipeToBroadcaster(strings.NewReader(huge+"\nafter\n"), "STDOUT", phaseApp)
+
+	// The line past the scanner's limit comes through in two chunks, each
+	// truncated for clients, and output continues after it.
+	history := broadcastHistory(t, b, 3)
+	if got := history[len(history)-1].Text; got != "after" {
+		t.Fatalf("got last line %q, want the line after the huge one", got)
+	}
+	for _, msg := range history[:2] {
+		if len(msg.Text) > maxLogLineBytes+64 {
+			t.Errorf("a %d byte line reached clients", len(msg.Text))
+		}
+	}
+	if !strings.HasSuffix(history[0].Text, fmt.Sprintf("...[truncated %d bytes]", maxScannedLineBytes-maxLogLineBytes)) {
+		t.Errorf("first chunk doesn't note what was cut: ...%s", history[0].Text[len(history[0].Text)-40:])
+	}
+	if history[1].Text != strings.Repeat("x", 10) {
+		t.Errorf("got second chunk %q, want the 10 bytes past the limit", history[1].Text)
+	}
+
+	// The run log keeps the chunk whole.
+	runLogs.Flush()
+	if log := readTestFile(t, dir, ".dev.run.log"); !strings.Contains(log, " STDOUT "+huge[:maxScannedLineBytes]+"\n") {
+		t.Errorf("the run log doesn't have the %d byte chunk whole (got %d bytes)", maxScannedLineBytes, len(log))
+	}
+}
+
+func TestProgressOutputStreamsIncrementally(t *testing.T) {
+	b := useTestBroadcaster(t)
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		streamPipeToBroadcaster(pr, "STDOUT", phaseApp)
+	}()
+
+	// Each update goes out once the next one starts, while the process is
+	// still writing.
+	io.WriteString(pw, "\r10%")
+	io.WriteString(pw, "\r50%")
+	history := broadcastHistory(t, b, 1)
+	if got := history[0]; got.Text != "10%" || !got.Progress {
+		t.Fatalf("got %q (progress=%v), want the first update", got.Text, got.Progress)
+	}
+	io.WriteString(pw, "\rdone\n")
+	pw.Close()
+	<-done
+
+	history = broadcastHistory(t, b, 3)
+	want := []struct {
+		text     string
+		progress bool
+	}{{"10%", true}, {"50%", true}, {"done", false}}
+	for i, w := range want {
+		if history[i].Text != w.text || history[i].Progress != w.progress {
+			t.Errorf("line %d: got %q (progress=%v), want %q (progress=%v)", i, history[i].Text, history[i].Progress, w.text, w.progress)
+		}
+	}
+}
+
+func TestLongLinesAreQueuedTruncated(t *testing.T) {
+	// Nothing runs the broadcaster, so the line stays in its queue.
+	b := newBroadcaster()
+	b.publishLine(BroadcastMessage{Text: strings.Repeat("x", 1<<20)})
+	msg := <-b.messages
+	if len(msg.Text) > maxLogLineBytes+64 || !msg.writtenOut {
+		t.Errorf("queued a %d byte line (writtenOut=%v), want it capped at %d", len(msg.Text), msg.writtenOut, maxLogLineBytes)
+	}
+	if line := <-b.osLines; len(line.text) != 1<<20 {
+		t.Errorf("stdout got %d bytes, want the whole line", len(line.text))
+	}
+}
+
+// postRunScript calls runScriptHandler with body, returning the status and
+// the decoded response.
+func postRunScript(t *testing.T, body string) (int, map[string]interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	runScriptHandler(rec, httptest.NewRequest(http.MethodPost, "/dev/run", strings.NewReader(body)))
+	var resp map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+	return rec.Code, resp
+}
+
+func TestRunScript(t *testing.T) {
+	dir := useAppDir(t)
+	useTestBroadcaster(t)
+	writeTestFile(t, dir, "package.json", `{"scripts": {"build": "x", "fail": "x"}}`)
+	useFakeNpm(t, `echo "$*" >> "`+dir+`/runs"
+if [ "$2" = fail ]; then echo boom >&2; exit 7; fi`)
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+		wantExit float64
+		wantRun  string
+	}{
+		{name: "success", body: `{"script": "build", "args": ["--prod"]}`, wantCode: http.StatusOK, wantRun: "run build -- --prod"},
+		{name: "failure", body: `{"script": "fail"}`, wantCode: http.StatusOK, wantExit: 7, wantRun: "run fail"},
+		{name: "unknown script", body: `{"script": "deploy"}`, wantCode: http.StatusBadRequest},
+		{name: "no script", body: `{}`, wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(filepath.Join(dir, "runs"))
+			code, resp := postRunScript(t, tt.body)
+			if code != tt.wantCode {
+				t.Fatalf("got %d: %v", code, resp)
+			}
+			runs, _ := os.ReadFile(filepath.Join(dir, "runs"))
+			if got := strings.TrimSpace(string(runs)); got != tt.wantRun {
+				t.Errorf("npm ran with %q, want %q", got, tt.wantRun)
+			}
+			if code != http.StatusOK {
+				return
+			}
+			if resp["exit_code"] != tt.wantExit || resp["success"] != (tt.wantExit == 0) {
+				t.Errorf("got %v, want exit code %v", resp, tt.wantExit)
+			}
+			if tt.wantExit != 0 && !strings.Contains(fmt.Sprint(resp["stderr"]), "boom") {
+				t.Errorf("got stderr %q, want the script's", resp["stderr"])
+			}
+		})
+	}
+}
+
+func TestRunScriptInSubdirectory(t *testing.T) {
+	dir := useAppDir(t)
+	useTestBroadcaster(t)
+	writeTestFile(t, dir, "package.json", `{"scripts": {"where": "x"}}`)
+	writeTestFile(t, dir, "packages/web/package.json", `{"scripts": {"where": "x"}}`)
+	writeTestFile(t, dir, "notes.txt", "")
+	useFakeNpm(t, `pwd > "`+dir+`/cwd"`)
+
+	tests := []struct {
+		name     string
+		cwd      string
+		wantCode int
+		wantDir  string
+	}{
+		{name: "default", wantCode: http.StatusOK, wantDir: dir},
+		{name: "subdirectory", cwd: "packages/web", wantCode: http.StatusOK, wantDir: filepath.Join(dir, "packages/web")},
+		{name: "outside the app dir", cwd: "../", wantCode: http.StatusForbidden},
+		{name: "a file", cwd: "notes.txt", wantCode: http.StatusBadRequest},
+		{name: "missing", cwd: "packages/api", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(filepath.Join(dir, "cwd"))
+			body, _ := json.Marshal(RunScriptRequest{Script: "where", Cwd: tt.cwd})
+			code, resp := postRunScript(t, string(body))
+			if code != tt.wantCode {
+				t.Fatalf("got %d: %v", code, resp)
+			}
+			if tt.wantDir == "" {
+				if _, err := os.Stat(filepath.Join(dir, "cwd")); err == nil {
+					t.Error("the script ran")
+				}
+				return
+			}
+			got := strings.TrimSpace(readTestFile(t, dir, "cwd"))
+			want, _ := filepath.EvalSymlinks(tt.wantDir)
+			if got != want {
+				t.Errorf("ran in %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestConcurrentPrewarmsShareOneRequest(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+	}))
+	defer srv.Close()
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	const warms = 5
+	results := make(chan PrewarmResult, warms)
+	warm := func() { results <- prewarmPath(client, port, "/page") }
+	go warm()
+	waitFor(t, "the first request", func() bool { return requests.Load() == 1 })
+	for i := 1; i < warms; i++ {
+		go warm()
+	}
+	// Give the others time to find the request in flight.
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < warms; i++ {
+		if r := <-results; !r.OK() {
+			t.Errorf("got %+v", r)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("the dev server got %d requests, want 1", n)
+	}
+}
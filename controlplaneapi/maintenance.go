@@ -0,0 +1,86 @@
+// maintenance.go
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// --- Maintenance Mode (for /admin/maintenance) ---
+
+// maintenanceState is reported by /admin/maintenance and /dev/status.
+type maintenanceState struct {
+	Enabled bool       `json:"enabled"`
+	Reason  string     `json:"reason,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+var (
+	// maintenanceMu guards maintenance.
+	maintenanceMu sync.Mutex
+	// maintenance, while enabled, makes mutating endpoints return 503.
+	maintenance maintenanceState
+)
+
+// currentMaintenance returns a copy of the maintenance state.
+func currentMaintenance() maintenanceState {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	return maintenance
+}
+
+// pausable rejects requests with a 503 while maintenance mode is enabled.
+// It wraps the endpoints that write files or manage processes; status, logs
+// and health keep working.
+func pausable(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if state := currentMaintenance(); state.Enabled {
+			msg := "Control plane is in maintenance mode"
+			if state.Reason != "" {
+				msg += ": " + state.Reason
+			}
+			httpError(w, msg, http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
+	}
+}
+
+type MaintenanceRequest struct {
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// maintenanceHandler reports the maintenance state on GET and sets it on POST.
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var req MaintenanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpError(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		maintenanceMu.Lock()
+		if req.Enabled {
+			since := time.Now()
+			if maintenance.Enabled {
+				since = *maintenance.Since
+			}
+			maintenance = maintenanceState{Enabled: true, Reason: req.Reason, Since: &since}
+		} else {
+			maintenance = maintenanceState{}
+		}
+		maintenanceMu.Unlock()
+
+		if req.Enabled {
+			log.Printf("Maintenance mode enabled (reason: %q)", req.Reason)
+			logBroadcaster.Submit("--- Maintenance mode enabled ---")
+		} else {
+			log.Println("Maintenance mode disabled")
+			logBroadcaster.Submit("--- Maintenance mode disabled ---")
+		}
+	}
+	jsonResponse(w, http.StatusOK, currentMaintenance())
+}
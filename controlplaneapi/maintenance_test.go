@@ -0,0 +1,71 @@
+// maintenance_test.go
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaintenanceModePausesMutatingRoutes(t *testing.T) {
+	useAppDir(t)
+	useTestBroadcaster(t)
+	saved := currentSettings()
+	t.Cleanup(func() {
+		settings.Store(saved)
+		maintenanceMu.Lock()
+		maintenance = maintenanceState{}
+		maintenanceMu.Unlock()
+	})
+	s, err := newLiveSettings("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.Store(s)
+	mux, _ := newMuxes()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/admin/maintenance", "application/json", strings.NewReader(`{"enabled": true, "reason": "migrating"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("enabling maintenance: got %d", resp.StatusCode)
+	}
+
+	for _, path := range []string{"/sync", "/sync/pull", "/sync/archive", "/dev/install", "/dev/run", "/dev/start", "/dev/stop", "/dev/restart", "/dev/logs/clear"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{}`)))
+		if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "migrating") {
+			t.Errorf("POST %s: got %d: %s", path, rec.Code, rec.Body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dev/status", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"enabled":true`) {
+		t.Errorf("/dev/status: got %d: %s", rec.Code, rec.Body)
+	}
+	logs, err := http.Get(srv.URL + "/dev/logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs.Body.Close()
+	if logs.StatusCode != http.StatusOK || logs.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("/dev/logs: got %d, %s", logs.StatusCode, logs.Header.Get("Content-Type"))
+	}
+
+	resp, err = http.Post(srv.URL+"/admin/maintenance", "application/json", strings.NewReader(`{"enabled": false}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/dev/logs/clear", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("/dev/logs/clear after maintenance: got %d: %s", rec.Code, rec.Body)
+	}
+}
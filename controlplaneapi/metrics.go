@@ -0,0 +1,275 @@
+// metrics.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Metrics ---
+
+// defaultMetricsStreamInterval is how often /metrics/stream emits a snapshot.
+var defaultMetricsStreamInterval = 5 * time.Second
+
+// metricsSnapshot is a point-in-time view of the key gauges.
+type metricsSnapshot struct {
+	Timestamp        string `json:"timestamp"`
+	UptimeSeconds    int64  `json:"uptime_seconds"`
+	DevServerRunning bool   `json:"dev_server_running"`
+	DevServerPID     int    `json:"dev_server_pid,omitempty"`
+	ErrorLines       int64  `json:"error_lines"`
+	LogClients       int    `json:"log_clients"`
+	HeapAllocBytes   uint64 `json:"heap_alloc_bytes"`
+	SysBytes         uint64 `json:"sys_bytes"`
+	Goroutines       int    `json:"goroutines"`
+}
+
+func collectMetrics() metricsSnapshot {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	snap := metricsSnapshot{
+		Timestamp:      time.Now().UTC().Format(time.RFC3339),
+		UptimeSeconds:  int64(time.Since(controlPlaneStartedAt).Seconds()),
+		ErrorLines:     logBroadcaster.errorLines.Load(),
+		LogClients:     logBroadcaster.ClientCount(),
+		HeapAllocBytes: mem.HeapAlloc,
+		SysBytes:       mem.Sys,
+		Goroutines:     runtime.NumGoroutine(),
+	}
+	if pid, err := readPID(); err == nil && isProcessAlive(pid) {
+		snap.DevServerRunning = true
+		snap.DevServerPID = pid
+	}
+	return snap
+}
+
+// metricsStreamHandler emits a metrics snapshot as an SSE event every
+// interval (?interval=<seconds>) until the client disconnects.
+func metricsStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+		return
+	}
+
+	interval := defaultMetricsStreamInterval
+	if param := r.URL.Query().Get("interval"); param != "" {
+		seconds, err := strconv.ParseFloat(param, 64)
+		if err != nil || seconds < 1 || seconds > 3600 {
+			httpError(w, "Query parameter 'interval' must be a number of seconds between 1 and 3600", http.StatusBadRequest)
+			return
+		}
+		interval = time.Duration(seconds * float64(time.Second))
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	rc := http.NewResponseController(w)
+	clearStreamDeadlines(rc)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	ctx := r.Context()
+	for {
+		data, err := json.Marshal(collectMetrics())
+		if err == nil {
+			if err := writeSSEEvent(w, rc, data); err != nil {
+				log.Printf("Metrics stream client write failed, disconnecting: %v", err)
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-shutdownStarted:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// --- Prometheus Exposition (for /metrics) ---
+
+var (
+	syncRequestsTotal = newCounterVec()
+	syncBytesTotal    = newCounterVec()
+	// installsTotal counts dependency installs by result: success, failure
+	// or cancelled.
+	installsTotal          = newCounterVec()
+	installDurationSeconds = newHistogram(1, 5, 10, 30, 60, 120, 300, 600)
+	// reconcilesTotal counts dependency reconciliations triggered by syncs,
+	// by result.
+	reconcilesTotal = newCounterVec()
+	// devRestartsTotal counts dev server restarts, by reason: request or
+	// auto.
+	devRestartsTotal = newCounterVec()
+)
+
+// counterVec is a counter with one series per set of label values.
+type counterVec struct {
+	mu     sync.Mutex
+	series map[string]float64
+}
+
+func newCounterVec() *counterVec {
+	return &counterVec{series: make(map[string]float64)}
+}
+
+// Add increments the series for labels, given as name, value pairs.
+func (c *counterVec) Add(v float64, labels ...string) {
+	key := formatLabels(labels)
+	c.mu.Lock()
+	c.series[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.series))
+	for k := range c.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", name, k, formatFloat(c.series[k]))
+	}
+}
+
+// histogram counts observations into cumulative buckets.
+type histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, buckets: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.bounds {
+		if v <= b {
+			h.buckets[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(b), h.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", name, formatFloat(h.sum), name, h.count)
+}
+
+func writeGauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+// formatLabels renders name, value pairs as {name="value",...}.
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("{")
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		fmt.Fprintf(&b, "%s=\"%s\"", labels[i], v)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// observeInstall records a finished dependency install.
+func observeInstall(d time.Duration, cancelled bool, err error) {
+	result := "success"
+	if cancelled {
+		result = "cancelled"
+	} else if err != nil {
+		result = "failure"
+	}
+	installsTotal.Add(1, "result", result)
+	installDurationSeconds.Observe(d.Seconds())
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countSync wraps a sync endpoint to count its requests, by status code, and
+// the request bytes it reads.
+func countSync(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := &countingBody{ReadCloser: r.Body}
+		r.Body = body
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		syncRequestsTotal.Add(1, "endpoint", endpoint, "code", strconv.Itoa(rec.status))
+		syncBytesTotal.Add(float64(body.n), "endpoint", endpoint)
+	}
+}
+
+// prometheusHandler serves the counters above and the current gauges in the
+// Prometheus text format.
+func prometheusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	snap := collectMetrics()
+	up := 0.0
+	if snap.DevServerRunning {
+		up = 1
+	}
+
+	syncRequestsTotal.write(w, "sync_requests_total", "Sync requests handled, by endpoint and status code.")
+	syncBytesTotal.write(w, "sync_bytes_total", "Request body bytes read by sync endpoints.")
+	installsTotal.write(w, "installs_total", "Dependency installs, by result.")
+	installDurationSeconds.write(w, "install_duration_seconds", "Duration of dependency installs.")
+	reconcilesTotal.write(w, "reconciles_total", "Dependency reconciliations triggered by syncs, by result.")
+	devRestartsTotal.write(w, "dev_restarts_total", "Dev server restarts, by reason.")
+	fmt.Fprintf(w, "# HELP dropped_log_lines_total Log lines dropped for slow /dev/logs clients.\n# TYPE dropped_log_lines_total counter\ndropped_log_lines_total %d\n", logBroadcaster.droppedLines.Load())
+	fmt.Fprintf(w, "# HELP dropped_published_lines_total Log lines dropped before broadcasting because the queue was full.\n# TYPE dropped_published_lines_total counter\ndropped_published_lines_total %d\n", logBroadcaster.publishDropped.Load())
+	fmt.Fprintf(w, "# HELP dropped_stdout_lines_total Log lines not written to the control plane's stdout or stderr because they weren't keeping up.\n# TYPE dropped_stdout_lines_total counter\ndropped_stdout_lines_total %d\n", logBroadcaster.osDropped.Load())
+	fmt.Fprintf(w, "# HELP log_error_lines_total Broadcast log lines classified as errors.\n# TYPE log_error_lines_total counter\nlog_error_lines_total %d\n", snap.ErrorLines)
+	writeGauge(w, "log_clients", "Connected /dev/logs clients.", float64(snap.LogClients))
+	writeGauge(w, "dev_server_up", "Whether the dev server is running.", up)
+	writeGauge(w, "uptime_seconds", "Seconds since the control plane started.", float64(snap.UptimeSeconds))
+}
@@ -0,0 +1,179 @@
+// metrics_test.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatLabels(t *testing.T) {
+	tests := []struct {
+		labels []string
+		want   string
+	}{
+		{labels: nil, want: ""},
+		{labels: []string{"code", "200"}, want: `{code="200"}`},
+		{labels: []string{"endpoint", "sync", "code", "413"}, want: `{endpoint="sync",code="413"}`},
+		{labels: []string{"reason", "a \"quoted\" \\ line\nbreak"}, want: `{reason="a \"quoted\" \\ line\nbreak"}`},
+	}
+	for _, tt := range tests {
+		if got := formatLabels(tt.labels); got != tt.want {
+			t.Errorf("formatLabels(%q) = %s, want %s", tt.labels, got, tt.want)
+		}
+	}
+}
+
+func TestHistogramBucketsAreCumulative(t *testing.T) {
+	h := newHistogram(1, 5, 10)
+	for _, v := range []float64{0.5, 3, 3, 7, 60} {
+		h.Observe(v)
+	}
+	var buf bytes.Buffer
+	h.write(&buf, "d", "Durations.")
+	want := `# HELP d Durations.
+# TYPE d histogram
+d_bucket{le="1"} 1
+d_bucket{le="5"} 3
+d_bucket{le="10"} 4
+d_bucket{le="+Inf"} 5
+d_sum 73.5
+d_count 5
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+// counterValue returns the current value of one of c's series.
+func counterValue(c *counterVec, labels ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.series[formatLabels(labels)]
+}
+
+func TestCountSync(t *testing.T) {
+	before := counterValue(syncRequestsTotal, "endpoint", "test", "code", "418")
+	beforeBytes := counterValue(syncBytesTotal, "endpoint", "test")
+
+	h := countSync("test", func(w http.ResponseWriter, r *http.Request) {
+		io.CopyN(io.Discard, r.Body, 4)
+		w.WriteHeader(http.StatusTeapot)
+	})
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/sync", strings.NewReader("0123456789")))
+
+	if got := counterValue(syncRequestsTotal, "endpoint", "test", "code", "418") - before; got != 1 {
+		t.Errorf("got %v more requests, want 1", got)
+	}
+	// Only what the handler read counts, not the whole body.
+	if got := counterValue(syncBytesTotal, "endpoint", "test") - beforeBytes; got != 4 {
+		t.Errorf("got %v more bytes, want 4", got)
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	useAppDir(t)
+	devRestartsTotal.Add(1, "reason", "request")
+	rec := httptest.NewRecorder()
+	prometheusHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE sync_requests_total counter\n",
+		"# TYPE install_duration_seconds histogram\n",
+		"install_duration_seconds_bucket{le=\"+Inf\"} ",
+		"dev_restarts_total{reason=\"request\"} ",
+		"# TYPE dropped_log_lines_total counter\n",
+		"dev_server_up 0\n",
+		"# TYPE uptime_seconds gauge\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("output is missing %q:\n%s", want, body)
+		}
+	}
+	// Every sample line is "name[{labels}] value", which is what scrapers parse.
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		if strings.HasPrefix(line, "# ") {
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) != 2 {
+			t.Errorf("malformed sample line %q", line)
+		}
+	}
+}
+
+func TestMetricsStreamEmitsSnapshots(t *testing.T) {
+	useAppDir(t)
+	b := useTestBroadcaster(t)
+	saved := defaultMetricsStreamInterval
+	t.Cleanup(func() { defaultMetricsStreamInterval = saved })
+	defaultMetricsStreamInterval = 20 * time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(metricsStreamHandler))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/metrics/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	events := make(chan metricsSnapshot)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var snap metricsSnapshot
+			if err := json.Unmarshal([]byte(data), &snap); err != nil {
+				t.Errorf("bad snapshot %s: %v", data, err)
+				return
+			}
+			events <- snap
+		}
+	}()
+	next := func() metricsSnapshot {
+		t.Helper()
+		select {
+		case snap, ok := <-events:
+			if !ok {
+				t.Fatal("the stream ended")
+			}
+			return snap
+		case <-time.After(5 * time.Second):
+			t.Fatal("no snapshot within 5s")
+		}
+		return metricsSnapshot{}
+	}
+
+	first := next()
+	b.errorLines.Add(1)
+	// Each tick is a fresh snapshot, not a replay of the first.
+	for i := 0; i < 3; i++ {
+		if snap := next(); i == 2 && snap.ErrorLines != first.ErrorLines+1 {
+			t.Errorf("got %d error lines, want %d", snap.ErrorLines, first.ErrorLines+1)
+		}
+	}
+}
+
+func TestMetricsStreamInterval(t *testing.T) {
+	for _, interval := range []string{"0.5", "0", "3601", "soon"} {
+		rec := httptest.NewRecorder()
+		metricsStreamHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics/stream?interval="+interval, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("?interval=%s: got %d, want 400", interval, rec.Code)
+		}
+	}
+}
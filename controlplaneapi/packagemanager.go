@@ -0,0 +1,254 @@
+// packagemanager.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Package Manager Detection ---
+
+// packageManager describes how to drive a Node package manager.
+type packageManager struct {
+	Name string
+	// Lockfiles are the lockfile names that identify this manager.
+	Lockfiles []string
+	// InstallArgs are the arguments used for dependency installs.
+	InstallArgs []string
+	// PruneArgs are the arguments used to remove extraneous packages, or nil
+	// when the manager's install already prunes.
+	PruneArgs []string
+}
+
+var (
+	npmManager = packageManager{
+		Name:        "npm",
+		Lockfiles:   []string{"package-lock.json"},
+		InstallArgs: []string{"install", "--no-fund", "--prefer-offline", "--no-optional", "--no-audit"},
+		PruneArgs:   []string{"prune"},
+	}
+	yarnManager = packageManager{
+		Name:        "yarn",
+		Lockfiles:   []string{"yarn.lock"},
+		InstallArgs: []string{"install", "--prefer-offline", "--non-interactive"},
+	}
+	pnpmManager = packageManager{
+		Name:        "pnpm",
+		Lockfiles:   []string{"pnpm-lock.yaml"},
+		InstallArgs: []string{"install", "--prefer-offline"},
+		PruneArgs:   []string{"prune"},
+	}
+	// bun doesn't understand npm's flags, and its install already prunes.
+	bunManager = packageManager{
+		Name:        "bun",
+		Lockfiles:   []string{"bun.lockb", "bun.lock"},
+		InstallArgs: []string{"install"},
+	}
+)
+
+var (
+	// installRegistry, when set, is the registry installs fetch packages
+	// from, passed as npm_config_registry, which npm, pnpm, yarn 1 and bun
+	// all honor.
+	installRegistry string
+	// useNpmCI lets npm installs run as `npm ci` when npmCIApplies.
+	useNpmCI = true
+)
+
+// npmLockfileDriftRegex matches npm ci refusing a lockfile that is out of
+// sync with package.json, or missing.
+var npmLockfileDriftRegex = regexp.MustCompile(`can only install (packages when your package\.json and package-lock\.json|with an existing package-lock\.json)`)
+
+// npmCIApplies reports whether an npm install in dir should be a clean
+// `npm ci`: there is a package-lock.json and node_modules is missing or older
+// than it, judged by the lockfile npm keeps in node_modules/.package-lock.json.
+func npmCIApplies(dir string) bool {
+	lock, err := os.Stat(filepath.Join(dir, "package-lock.json"))
+	if err != nil || lock.IsDir() {
+		return false
+	}
+	hidden, err := os.Stat(filepath.Join(dir, "node_modules", ".package-lock.json"))
+	if err != nil {
+		return true
+	}
+	return hidden.ModTime().Before(lock.ModTime())
+}
+
+// installFlagManagers are the managers -install-flags applies to. Its flags
+// are npm-style, which bun rejects, so bun keeps its defaults.
+var installFlagManagers = []string{npmManager.Name, pnpmManager.Name, yarnManager.Name}
+
+// installArgs returns the arguments for a dependency install: the manager's
+// defaults unless -install-flags overrides them. /dev/install and sync
+// reconciliation both use it, so they can't drift apart.
+func (pm packageManager) installArgs() []string {
+	installFlags := currentSettings().InstallFlags
+	if installFlags == nil || !slices.Contains(installFlagManagers, pm.Name) {
+		return append([]string{}, pm.InstallArgs...)
+	}
+	return append([]string{pm.InstallArgs[0]}, installFlags...)
+}
+
+// installEnv returns the environment for install and prune commands.
+func installEnv() []string {
+	env := os.Environ()
+	if installRegistry != "" {
+		env = append(env, "npm_config_registry="+installRegistry)
+	}
+	return env
+}
+
+// packageManagers lists the supported managers. npm is the default when no
+// lockfile is present.
+var packageManagers = []packageManager{npmManager, yarnManager, pnpmManager, bunManager}
+
+// lockfileWarnings holds the last multiple-lockfiles warning logged for each
+// dir, so detectPackageManager, which status and debug requests call too,
+// logs it again only once the lockfiles or the choice change.
+var (
+	lockfileWarningsMu sync.Mutex
+	lockfileWarnings   = map[string]string{}
+)
+
+// detectPackageManager picks the package manager for dir based on its
+// lockfile. If several lockfiles exist, the most recently modified one wins.
+// Without a lockfile, package.json's "packageManager" field is honored.
+func detectPackageManager(dir string) packageManager {
+	var (
+		found        []string
+		selected     = npmManager
+		selectedLock string
+		newest       time.Time
+	)
+	for _, pm := range packageManagers {
+		for _, lockfile := range pm.Lockfiles {
+			info, err := os.Stat(filepath.Join(dir, lockfile))
+			if err != nil || info.IsDir() {
+				continue
+			}
+			found = append(found, lockfile)
+			if len(found) == 1 || info.ModTime().After(newest) {
+				selected = pm
+				selectedLock = lockfile
+				newest = info.ModTime()
+			}
+		}
+	}
+	warning := ""
+	if len(found) > 1 {
+		warning = fmt.Sprintf("Multiple lockfiles found in %s (%s); selected %s from the most recently modified %s",
+			dir, strings.Join(found, ", "), selected.Name, selectedLock)
+	}
+	lockfileWarningsMu.Lock()
+	if warning != lockfileWarnings[dir] {
+		if warning == "" {
+			delete(lockfileWarnings, dir)
+		} else {
+			log.Print(warning)
+			lockfileWarnings[dir] = warning
+		}
+	}
+	lockfileWarningsMu.Unlock()
+	if len(found) == 0 {
+		if pkg, err := readPackageJSON(dir); err == nil && pkg.PackageManager != "" {
+			// The field looks like "pnpm@9.1.0".
+			name, _, _ := strings.Cut(pkg.PackageManager, "@")
+			for _, pm := range packageManagers {
+				if pm.Name == name {
+					return pm
+				}
+			}
+		}
+	}
+	return selected
+}
+
+// --- Workspaces ---
+
+// workspacePatterns returns the workspace globs declared by root: package.json's
+// "workspaces" (an array, or yarn's {"packages": [...]}) and the packages
+// listed in pnpm-workspace.yaml.
+func workspacePatterns(root string) []string {
+	var patterns []string
+	if data, err := os.ReadFile(filepath.Join(root, "package.json")); err == nil {
+		var pkg struct {
+			Workspaces json.RawMessage `json:"workspaces"`
+		}
+		if json.Unmarshal(data, &pkg) == nil && len(pkg.Workspaces) > 0 {
+			var list []string
+			var obj struct {
+				Packages []string `json:"packages"`
+			}
+			if json.Unmarshal(pkg.Workspaces, &list) == nil {
+				patterns = append(patterns, list...)
+			} else if json.Unmarshal(pkg.Workspaces, &obj) == nil {
+				patterns = append(patterns, obj.Packages...)
+			}
+		}
+	}
+	// pnpm-workspace.yaml is read line by line rather than as YAML: only the
+	// "packages:" list's items matter.
+	if data, err := os.ReadFile(filepath.Join(root, "pnpm-workspace.yaml")); err == nil {
+		inPackages := false
+		for _, line := range strings.Split(string(data), "\n") {
+			trimmed := strings.TrimSpace(line)
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") && !strings.HasPrefix(line, "-") {
+				inPackages = strings.HasPrefix(trimmed, "packages:")
+				continue
+			}
+			if item, ok := strings.CutPrefix(trimmed, "-"); ok && inPackages {
+				item, _, _ = strings.Cut(item, " #")
+				patterns = append(patterns, strings.Trim(strings.TrimSpace(item), `"'`))
+			}
+		}
+	}
+	return patterns
+}
+
+// isWorkspace reports whether dir, relative to root, is one of root's
+// workspaces. A "!" pattern excludes what earlier ones matched, and "**"
+// matches any number of directories.
+func isWorkspace(root, dir string) bool {
+	dir = filepath.ToSlash(dir)
+	matched := false
+	for _, pattern := range workspacePatterns(root) {
+		negate := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(pattern, "!"), "./"), "/")
+		if matchWorkspaceGlob(strings.Split(pattern, "/"), strings.Split(dir, "/")) {
+			matched = !negate
+		}
+	}
+	return matched
+}
+
+// matchWorkspaceGlob matches path elements against a glob's elements.
+func matchWorkspaceGlob(pattern, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(parts); i++ {
+			if matchWorkspaceGlob(pattern[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], parts[0])
+	return ok && matchWorkspaceGlob(pattern[1:], parts[1:])
+}
@@ -0,0 +1,126 @@
+// packagemanager_test.go
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetectPackageManager(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{name: "no lockfile", want: "npm"},
+		{name: "yarn lockfile", files: map[string]string{"yarn.lock": ""}, want: "yarn"},
+		{name: "pnpm lockfile", files: map[string]string{"pnpm-lock.yaml": ""}, want: "pnpm"},
+		{name: "packageManager field", files: map[string]string{"package.json": `{"packageManager": "pnpm@9.1.0"}`}, want: "pnpm"},
+		{name: "lockfile over packageManager field", files: map[string]string{"package.json": `{"packageManager": "pnpm@9.1.0"}`, "yarn.lock": ""}, want: "yarn"},
+		{name: "unknown packageManager field", files: map[string]string{"package.json": `{"packageManager": "deno@2"}`}, want: "npm"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for rel, content := range tt.files {
+				writeTestFile(t, dir, rel, content)
+			}
+			if got := detectPackageManager(dir).Name; got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectPackageManagerWarnsOnce(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	dir := t.TempDir()
+	writeTestFile(t, dir, "package-lock.json", "{}")
+	writeTestFile(t, dir, "yarn.lock", "")
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, "package-lock.json"), old, old)
+
+	for i := 0; i < 3; i++ {
+		if got := detectPackageManager(dir).Name; got != "yarn" {
+			t.Fatalf("got %s, want yarn from the newer lockfile", got)
+		}
+	}
+	if n := strings.Count(buf.String(), "Multiple lockfiles"); n != 1 {
+		t.Errorf("got %d warnings for 3 detections, want 1:\n%s", n, buf.String())
+	}
+
+	// Touching the other lockfile changes the choice, which is worth
+	// another warning.
+	os.Chtimes(filepath.Join(dir, "package-lock.json"), time.Now().Add(time.Hour), time.Now().Add(time.Hour))
+	detectPackageManager(dir)
+	detectPackageManager(dir)
+	if n := strings.Count(buf.String(), "Multiple lockfiles"); n != 2 {
+		t.Errorf("got %d warnings after the choice changed, want 2:\n%s", n, buf.String())
+	}
+}
+
+func TestInstallDir(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string // relative to the app dir
+	}{
+		{name: "no workspaces", files: map[string]string{"package.json": `{}`}, want: "packages/web"},
+		{name: "no root package.json", want: "packages/web"},
+		{name: "npm workspaces", files: map[string]string{"package.json": `{"workspaces": ["packages/*"]}`}, want: "."},
+		{name: "yarn workspaces object", files: map[string]string{"package.json": `{"workspaces": {"packages": ["./packages/web/"]}}`}, want: "."},
+		{name: "globstar", files: map[string]string{"package.json": `{"workspaces": ["**"]}`}, want: "."},
+		{name: "other workspaces", files: map[string]string{"package.json": `{"workspaces": ["apps/*", "packages/web/*"]}`}, want: "packages/web"},
+		{name: "excluded", files: map[string]string{"package.json": `{"workspaces": ["packages/*", "!packages/web"]}`}, want: "packages/web"},
+		{
+			name:  "pnpm workspace",
+			files: map[string]string{"pnpm-workspace.yaml": "# monorepo\npackages:\n  - 'apps/*'\n  - \"packages/**\" # all\ncatalog:\n  react: ^18\n"},
+			want:  ".",
+		},
+		{name: "pnpm other workspaces", files: map[string]string{"pnpm-workspace.yaml": "packages:\n  - apps/*\n"}, want: "packages/web"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := useAppDir(t)
+			for rel, content := range tt.files {
+				writeTestFile(t, dir, rel, content)
+			}
+			if got := installDir("package.json"); got != dir {
+				t.Errorf("root package.json installs in %s", got)
+			}
+			got, _ := filepath.Rel(dir, installDir("packages/web/package.json"))
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstallArgs(t *testing.T) {
+	saved := currentSettings()
+	t.Cleanup(func() { settings.Store(saved) })
+	for _, spec := range []string{"", "--no-audit --legacy-peer-deps"} {
+		s, err := newLiveSettings("", "", spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		settings.Store(s)
+		for _, pm := range packageManagers {
+			got := strings.Join(pm.installArgs(), " ")
+			want := strings.Join(pm.InstallArgs, " ")
+			if spec != "" && pm.Name != "bun" {
+				want = "install " + spec
+			}
+			if got != want {
+				t.Errorf("%s with -install-flags %q: got %q, want %q", pm.Name, spec, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// patch.go
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// --- Patch-Based Sync (SyncRequest.Patches) ---
+
+// errPatchConflict is returned when a patch's base checksum doesn't match the
+// file on disk; the client should resend the whole file.
+var errPatchConflict = errors.New("base checksum mismatch")
+
+// SyncPatch edits an existing file in place of resending all of it.
+type SyncPatch struct {
+	// BaseSHA256 is the hex sha256 the client expects the file on disk to
+	// have. When set and it doesn't match, the patch is rejected as a conflict.
+	BaseSHA256 string    `json:"base_sha256"`
+	Ops        []PatchOp `json:"ops"`
+}
+
+// PatchOp replaces Length bytes at Offset with Replacement. Offsets refer to
+// the base content, not to the content after earlier ops, and ops must not
+// overlap.
+type PatchOp struct {
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+	// Replacement is base64 encoded.
+	Replacement string `json:"replacement"`
+}
+
+// applyPatch applies patch to the file at p within appDir, keeping its mode.
+// The change is "modified", or empty if the result equals the base. Either
+// every op applies or the file is left untouched. With dryRun, everything but
+// the write happens.
+func applyPatch(p string, patch SyncPatch, dryRun bool) (fileWrite, error) {
+	dest, err := resolveWithinAppDir(p)
+	if err != nil {
+		return fileWrite{}, err
+	}
+	if err := checkNotProtected(p, dest); err != nil {
+		return fileWrite{}, err
+	}
+	if err := checkSymlinks(dest, true); err != nil {
+		return fileWrite{}, err
+	}
+	info, err := os.Stat(dest)
+	if err != nil {
+		return fileWrite{}, fmt.Errorf("cannot patch %s: %w", p, err)
+	}
+	base, err := os.ReadFile(dest)
+	if err != nil {
+		return fileWrite{}, fmt.Errorf("cannot patch %s: %w", p, err)
+	}
+	baseSum := sha256.Sum256(base)
+	if patch.BaseSHA256 != "" && !strings.EqualFold(patch.BaseSHA256, hex.EncodeToString(baseSum[:])) {
+		return fileWrite{}, fmt.Errorf("cannot patch %s: %w", p, errPatchConflict)
+	}
+
+	ops := append([]PatchOp(nil), patch.Ops...)
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].Offset < ops[j].Offset })
+	var (
+		out  = make([]byte, 0, len(base))
+		next int // first base byte not yet copied
+	)
+	for _, op := range ops {
+		if op.Offset < next || op.Length < 0 || op.Offset+op.Length > len(base) {
+			return fileWrite{}, fmt.Errorf("invalid patch for %s: op at offset %d length %d is out of range or overlaps", p, op.Offset, op.Length)
+		}
+		replacement, err := base64.StdEncoding.DecodeString(op.Replacement)
+		if err != nil {
+			return fileWrite{}, fmt.Errorf("invalid base64 replacement for %s: %w", p, err)
+		}
+		out = append(out, base[next:op.Offset]...)
+		out = append(out, replacement...)
+		next = op.Offset + op.Length
+	}
+	out = append(out, base[next:]...)
+	if maxSyncFileBytes > 0 && int64(len(out)) > maxSyncFileBytes {
+		return fileWrite{}, fmt.Errorf("patched %s would be %d bytes, more than the %d byte limit: %w", p, len(out), maxSyncFileBytes, errSyncFileTooLarge)
+	}
+
+	perm := info.Mode().Perm()
+	if sha256.Sum256(out) == baseSum {
+		return fileWrite{Mode: perm}, nil
+	}
+	fw := fileWrite{Change: "modified", Data: out, Mode: perm}
+	if dryRun {
+		return fw, nil
+	}
+	return fw, writeFileAtomic(dest, out, perm)
+}
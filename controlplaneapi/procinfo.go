@@ -0,0 +1,223 @@
+// procinfo.go
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// --- Process Info (Linux /proc) ---
+
+// clockTicksPerSecond is USER_HZ, the unit of start times in /proc/<pid>/stat.
+// It is 100 on every Linux platform we run on.
+const clockTicksPerSecond = 100
+
+// startTimeTolerance absorbs the rounding of /proc start times (boot time is
+// whole seconds) and the gap between starting a process and recording it.
+const startTimeTolerance = 2 * time.Second
+
+// processStartTime returns when pid started, from /proc. It fails where /proc
+// is unavailable, in which case callers should trust the pid.
+func processStartTime(pid int) (time.Time, error) {
+	ticks, err := processStartTicks(pid)
+	if err != nil {
+		return time.Time{}, err
+	}
+	boot, err := bootTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return boot.Add(time.Duration(ticks) * time.Second / clockTicksPerSecond), nil
+}
+
+// processStartTicks returns when pid started, in clock ticks since boot. It
+// doesn't depend on the wall clock, so it is the exact identity of a process.
+func processStartTicks(pid int) (int64, error) {
+	fields, err := procStatFields(pid)
+	if err != nil {
+		return 0, err
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected /proc/%d/stat start time: %w", pid, err)
+	}
+	return ticks, nil
+}
+
+// procStatFields returns the fields of /proc/<pid>/stat after the command
+// name, so fields[0] is field 3 (state) and fields[19] is field 22 (starttime).
+func procStatFields(pid int) ([]string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	// The command name is in parentheses and may itself contain spaces or
+	// parentheses, so the fields that follow are counted from the last ')'.
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return nil, fmt.Errorf("unexpected /proc/%d/stat format", pid)
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 20 {
+		return nil, fmt.Errorf("unexpected /proc/%d/stat format", pid)
+	}
+	return fields, nil
+}
+
+// isZombie reports whether pid has exited but not been reaped. A dev server
+// left behind by a killed control plane can linger like this when nothing
+// reaps orphans.
+func isZombie(pid int) bool {
+	fields, err := procStatFields(pid)
+	return err == nil && fields[0] == "Z"
+}
+
+// processEnviron returns pid's initial environment from /proc, as KEY=value
+// entries.
+func processEnviron(pid int) ([]string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimRight(string(data), "\x00"), "\x00"), nil
+}
+
+// portListenerPID returns the process listening on TCP port, found by
+// matching the socket inodes in /proc/net/tcp{,6} against each process's
+// descriptors. It returns false if there is none or /proc can't tell, e.g.
+// for a listener in another network namespace.
+func portListenerPID(port int) (int, bool) {
+	inodes := make(map[string]bool)
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		data, err := os.ReadFile(table)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			// sl local_address rem_address st tx:rx tr:when retrnsmt uid timeout inode
+			fields := strings.Fields(line)
+			if len(fields) < 10 || fields[3] != "0A" { // 0A is TCP_LISTEN.
+				continue
+			}
+			i := strings.LastIndexByte(fields[1], ':')
+			if p, err := strconv.ParseUint(fields[1][i+1:], 16, 16); err == nil && int(p) == port {
+				inodes["socket:["+fields[9]+"]"] = true
+			}
+		}
+	}
+	if len(inodes) == 0 {
+		return 0, false
+	}
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, false
+	}
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil {
+			continue
+		}
+		dir := fmt.Sprintf("/proc/%d/fd", pid)
+		fds, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if link, err := os.Readlink(dir + "/" + fd.Name()); err == nil && inodes[link] {
+				return pid, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// processName returns pid's command name from /proc, or "" if unknown.
+func processName(pid int) string {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// processGroup returns pid's process group id from /proc.
+func processGroup(pid int) (int, error) {
+	fields, err := procStatFields(pid)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(fields[2])
+}
+
+// bootTime returns when the system booted, from /proc/stat.
+func bootTime() (time.Time, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if v, ok := strings.CutPrefix(scanner.Text(), "btime "); ok {
+			secs, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("unexpected btime in /proc/stat: %w", err)
+			}
+			return time.Unix(secs, 0), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+	return time.Time{}, fmt.Errorf("no btime in /proc/stat")
+}
+
+// sameStartTime reports whether a /proc start time matches a recorded one.
+func sameStartTime(actual, recorded time.Time) bool {
+	d := actual.Sub(recorded)
+	return d > -startTimeTolerance && d < startTimeTolerance
+}
+
+// --- Dev Server Recovery On Startup ---
+
+// recoverDevServer checks a pid file left behind by a previous control plane
+// instance. A dev server that is still running is adopted; otherwise the pid
+// file is removed, along with any processes left in the dead server's group,
+// so the next start isn't refused as "Already running".
+func recoverDevServer() {
+	rec, err := readPIDFile()
+	pid := rec.PID
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Removing unreadable PID file %s: %v", pidFile, err)
+			os.Remove(pidFile)
+		}
+		return
+	}
+
+	if processExists(pid) {
+		if !rec.matchesProcess() {
+			log.Printf("PID %d from the PID file now belongs to another process; removing stale PID file", pid)
+			os.Remove(pidFile)
+			return
+		}
+		log.Printf("Adopting dev server still running from a previous control plane instance (PID %d)", pid)
+		devServerExpected.Store(true)
+		return
+	}
+
+	// No process has this pid, so any process still in the group with the
+	// same id was started by the dead dev server.
+	if syscall.Kill(-pid, 0) == nil {
+		log.Printf("Dev server PID %d is gone but processes remain in its group; killing them", pid)
+		syscall.Kill(-pid, syscall.SIGKILL)
+	}
+	log.Printf("Removing stale PID file for PID %d", pid)
+	os.Remove(pidFile)
+}
@@ -0,0 +1,54 @@
+// procinfo_test.go
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProcStatFieldsWithAwkwardCommandName(t *testing.T) {
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep is not installed")
+	}
+	// The command name in /proc/<pid>/stat comes from the executable's file
+	// name, which may contain spaces and parentheses.
+	link := filepath.Join(t.TempDir(), "a) b (c")
+	if err := os.Symlink(sleep, link); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(link, "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	pid := cmd.Process.Pid
+
+	fields, err := procStatFields(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields[0] != "S" && fields[0] != "R" {
+		t.Errorf("got state %q", fields[0])
+	}
+	ticks, err := processStartTicks(pid)
+	if err != nil || ticks <= 0 {
+		t.Errorf("got start ticks %d, %v", ticks, err)
+	}
+	if started, err := processStartTime(pid); err != nil || time.Since(started) > time.Minute || time.Until(started) > 5*time.Second {
+		t.Errorf("got start time %v, %v", started, err)
+	}
+	if isZombie(pid) {
+		t.Error("a running process is reported as a zombie")
+	}
+
+	cmd.Process.Kill()
+	waitFor(t, "the process to become a zombie", func() bool { return isZombie(pid) })
+	if processExists(pid) {
+		t.Error("an unreaped zombie is reported as existing")
+	}
+	cmd.Wait()
+}
@@ -0,0 +1,698 @@
+// pull.go
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// --- Remote Project Pull (for /sync/pull and /sync/archive) ---
+
+// maxPullBytes caps both the downloaded archive and the total size of the
+// files extracted from it.
+var maxPullBytes int64 = 512 << 20
+
+// pullTimeout bounds a git clone or archive download for /sync/pull.
+var pullTimeout = 5 * time.Minute
+
+// pullStagingPrefix names the directories in appDir that pulled and uploaded
+// files are extracted into, before being moved into place once all of them
+// have been.
+const pullStagingPrefix = ".dev.pull-"
+
+// errPullTooLarge is returned when a pulled project exceeds maxPullBytes.
+var errPullTooLarge = errors.New("pulled content exceeds the size limit")
+
+// errInvalidArchive is returned for an archive that can't be read.
+var errInvalidArchive = errors.New("invalid archive")
+
+type PullRequest struct {
+	URL string `json:"url"`
+	// Type is "git" or "archive". It is inferred from the URL when empty.
+	Type string `json:"type,omitempty"`
+	// Ref is the branch or tag to clone (git only).
+	Ref string `json:"ref,omitempty"`
+	// StripComponents drops leading path elements from archive entries, like tar's option of the same name.
+	StripComponents int  `json:"strip_components,omitempty"`
+	Install         bool `json:"install,omitempty"`
+}
+
+type PullResponse struct {
+	Success bool     `json:"success"`
+	Message string   `json:"message"`
+	Files   []string `json:"files"`
+	Skipped []string `json:"skipped,omitempty"`
+	Bytes   int64    `json:"bytes"`
+	// SyncID identifies this pull in /sync/changes.
+	SyncID int64 `json:"sync_id"`
+	// Reconcile is true when an uploaded archive's package.json changed the
+	// dependencies and they were reconciled.
+	Reconcile bool `json:"reconcile,omitempty"`
+}
+
+func pullHandler(w http.ResponseWriter, r *http.Request) {
+	var req PullRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if req.URL == "" {
+		httpError(w, "Field 'url' is required", http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		httpError(w, fmt.Sprintf("Invalid url: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.StripComponents < 0 {
+		httpError(w, "Field 'strip_components' must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	kind := req.Type
+	if kind == "" {
+		kind = inferPullType(u)
+	}
+	if kind != "git" && kind != "archive" {
+		httpError(w, fmt.Sprintf("Unsupported pull type %q: must be 'git' or 'archive'", kind), http.StatusBadRequest)
+		return
+	}
+	if err := checkPullScheme(u, kind); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ex, err := newExtractor(req.StripComponents)
+	if err != nil {
+		httpError(w, fmt.Sprintf("Failed to pull project: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer ex.cleanup()
+	logBroadcaster.Submit(fmt.Sprintf("--- Pulling project from %s ---", u.Redacted()))
+	ctx, cancel := context.WithTimeout(r.Context(), pullTimeout)
+	defer cancel()
+	if kind == "git" {
+		err = pullGit(ctx, u, req.Ref, ex)
+	} else {
+		err = pullArchive(ctx, u, ex)
+	}
+	if err == nil {
+		err = ex.commit()
+	}
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, errPullTooLarge) {
+			code = http.StatusRequestEntityTooLarge
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			code = http.StatusGatewayTimeout
+		}
+		logBroadcaster.Submit(fmt.Sprintf("--- Pull failed: %v ---", err))
+		httpError(w, fmt.Sprintf("Failed to pull project: %v", err), code)
+		return
+	}
+	logBroadcaster.Submit(fmt.Sprintf("--- Pulled %d files (%d bytes) ---", len(ex.files), ex.written))
+	syncID := syncChanges.record(ex.files, nil)
+
+	message := "Project pulled successfully"
+	installDirs := make(map[string]bool)
+	for _, m := range dependencyManifests() {
+		if fileExists(filepath.Join(appDir, m)) {
+			installDirs[installDir(m)] = true
+		}
+	}
+	if req.Install && len(installDirs) > 0 {
+		logBroadcaster.Submit("--- Project pulled. Reconciling dependencies... ---")
+		depMessages, depErrors := requestReconciles(installDirs)
+		if len(depErrors) > 0 {
+			httpError(w, strings.Join(depErrors, "; "), http.StatusInternalServerError)
+			return
+		}
+		message = fmt.Sprintf("%s. %s", message, strings.Join(depMessages, " "))
+	}
+
+	jsonResponse(w, http.StatusOK, PullResponse{
+		Success: true,
+		Message: message,
+		Files:   ex.files,
+		Skipped: ex.skipped,
+		Bytes:   ex.written,
+		SyncID:  syncID,
+	})
+}
+
+// archiveHandler extracts a tar, tar.gz or zip archive sent as the request
+// body into appDir, as a faster alternative to /sync for bootstrapping a
+// project. ?strip_components=N drops leading path elements from entries. As
+// with /sync, dependencies are reconciled when package.json's dependencies
+// change.
+func archiveHandler(w http.ResponseWriter, r *http.Request) {
+	strip := 0
+	if v := r.URL.Query().Get("strip_components"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			httpError(w, "Query parameter 'strip_components' must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		strip = n
+	}
+
+	manifests := dependencyManifests()
+	beforeData := make(map[string][]byte)
+	before := make(map[string]*PackageJSON)
+	for _, m := range manifests {
+		beforeData[m], _ = os.ReadFile(filepath.Join(appDir, m))
+		before[m], _ = readPackageJSON(filepath.Join(appDir, filepath.Dir(m)))
+	}
+	ex, err := newExtractor(strip)
+	if err != nil {
+		httpError(w, fmt.Sprintf("Failed to extract archive: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer ex.cleanup()
+	logBroadcaster.Submit("--- Extracting uploaded archive ---")
+	err = extractArchive(r.Body, ex)
+	if err == nil {
+		err = ex.commit()
+	}
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, errPullTooLarge) {
+			code = http.StatusRequestEntityTooLarge
+		} else if errors.Is(err, errInvalidArchive) {
+			code = http.StatusBadRequest
+		}
+		logBroadcaster.Submit(fmt.Sprintf("--- Archive extraction failed: %v ---", err))
+		httpError(w, fmt.Sprintf("Failed to extract archive: %v", err), code)
+		return
+	}
+	logBroadcaster.Submit(fmt.Sprintf("--- Extracted %d files (%d bytes) ---", len(ex.files), ex.written))
+	syncID := syncChanges.record(ex.files, nil)
+
+	message := "Archive extracted successfully"
+	reconcileDirs := make(map[string]bool)
+	for _, m := range manifests {
+		if !slices.Contains(ex.files, m) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(appDir, m))
+		if err != nil {
+			httpError(w, fmt.Sprintf("Failed to read %s: %v", m, err), http.StatusInternalServerError)
+			return
+		}
+		if bytes.Equal(beforeData[m], data) {
+			data = nil
+		}
+		if shouldReconcile(before[m], data) {
+			reconcileDirs[installDir(m)] = true
+		}
+	}
+	if len(reconcileDirs) > 0 {
+		logBroadcaster.Submit("--- package.json updated. Reconciling dependencies... ---")
+		depMessages, depErrors := requestReconciles(reconcileDirs)
+		if len(depErrors) > 0 {
+			httpError(w, strings.Join(depErrors, "; "), http.StatusInternalServerError)
+			return
+		}
+		message = fmt.Sprintf("%s. %s", message, strings.Join(depMessages, " "))
+	}
+
+	jsonResponse(w, http.StatusOK, PullResponse{
+		Success:   true,
+		Message:   message,
+		Files:     ex.files,
+		Skipped:   ex.skipped,
+		Bytes:     ex.written,
+		SyncID:    syncID,
+		Reconcile: len(reconcileDirs) > 0,
+	})
+}
+
+// inferPullType guesses whether a URL points to a git repository or an archive.
+func inferPullType(u *url.URL) string {
+	switch u.Scheme {
+	case "git", "ssh":
+		return "git"
+	}
+	if strings.HasSuffix(u.Path, ".git") {
+		return "git"
+	}
+	return "archive"
+}
+
+// checkPullScheme rejects URLs /sync/pull won't fetch. file:// is refused
+// for both kinds, so a request can't copy files from elsewhere on the
+// container into appDir.
+func checkPullScheme(u *url.URL, kind string) error {
+	switch u.Scheme {
+	case "http", "https":
+		return nil
+	case "ssh", "git":
+		if kind == "git" {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported %s url scheme %q", kind, u.Scheme)
+}
+
+// pullGit shallow-clones the repository into a temporary directory and hands
+// its regular files to ex. The clone is killed if ctx ends first.
+func pullGit(ctx context.Context, u *url.URL, ref string, ex *extractor) error {
+	if _, err := exec.LookPath("git"); err != nil {
+		return fmt.Errorf("git is not available: %w", err)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "pull-git-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	args := []string{"clone", "--depth", "1"}
+	if ref != "" {
+		args = append(args, "--branch", ref)
+	}
+	args = append(args, "--", u.String(), tmpDir)
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = appDir
+	// Never wait on a credential prompt, and kill git's helpers (such as
+	// git-remote-https) along with it on timeout.
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	cmd.WaitDelay = 5 * time.Second
+	if out, err := streamCommandOutput(cmd, nil); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("git clone took longer than %s: %w", pullTimeout, ctx.Err())
+		}
+		if line := gitFatalLine(out.Stderr); line != "" {
+			return fmt.Errorf("git clone failed: %w: %s", err, line)
+		}
+		return fmt.Errorf("git clone failed: %w", err)
+	}
+
+	return filepath.WalkDir(tmpDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(tmpDir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			ex.skip(filepath.ToSlash(rel), "not a regular file")
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return ex.writeFile(filepath.ToSlash(rel), f, info.Mode())
+	})
+}
+
+// gitFatalLine returns git's "fatal:" message from its stderr, if any.
+func gitFatalLine(stderr string) string {
+	for _, line := range strings.Split(stderr, "\n") {
+		if msg, ok := strings.CutPrefix(strings.TrimSpace(line), "fatal: "); ok {
+			return msg
+		}
+	}
+	return ""
+}
+
+// pullArchive downloads a tar, tar.gz or zip archive and hands its entries to
+// ex.
+func pullArchive(ctx context.Context, u *url.URL, ex *extractor) error {
+	body, err := openPullURL(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return extractArchive(body, ex)
+}
+
+// extractArchive hands the entries of a tar, tar.gz or zip archive read from
+// body to ex.
+func extractArchive(body io.Reader, ex *extractor) error {
+	// Spool to disk first: zip needs random access, and it lets us enforce the
+	// size limit before touching appDir.
+	tmp, err := os.CreateTemp("", "pull-archive-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	n, err := io.Copy(tmp, io.LimitReader(body, maxPullBytes+1))
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+	if n > maxPullBytes {
+		return errPullTooLarge
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(tmp)
+	magic, _ := br.Peek(4)
+	switch {
+	case len(magic) >= 4 && string(magic) == "PK\x03\x04":
+		zr, err := zip.NewReader(tmp, n)
+		if err != nil {
+			return fmt.Errorf("%w: zip: %v", errInvalidArchive, err)
+		}
+		return extractZip(zr, ex)
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("%w: gzip: %v", errInvalidArchive, err)
+		}
+		defer gz.Close()
+		return extractTar(tar.NewReader(gz), ex)
+	default:
+		return extractTar(tar.NewReader(br), ex)
+	}
+}
+
+// openPullURL starts downloading an http(s) URL; ctx bounds the whole
+// download.
+func openPullURL(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	if err := checkPullScheme(u, "archive"); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download archive: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download archive: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download archive: %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func extractTar(tr *tar.Reader, ex *extractor) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: tar: %v", errInvalidArchive, err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg:
+			if err := ex.writeFile(hdr.Name, tr, hdr.FileInfo().Mode()); err != nil {
+				return err
+			}
+		default:
+			ex.skip(hdr.Name, "not a regular file")
+		}
+	}
+}
+
+func extractZip(zr *zip.Reader, ex *extractor) error {
+	for _, zf := range zr.File {
+		mode := zf.Mode()
+		if mode.IsDir() {
+			continue
+		}
+		if !mode.IsRegular() {
+			ex.skip(zf.Name, "not a regular file")
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return fmt.Errorf("%w: zip entry %s: %v", errInvalidArchive, zf.Name, err)
+		}
+		err = ex.writeFile(zf.Name, rc, mode)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractor writes archive entries into a staging directory in appDir,
+// enforcing path safety and a total size budget, and moves them into place on
+// commit. Until then appDir is left as it was, and a commit that fails midway
+// puts back what it replaced, so a failed pull or upload changes nothing
+// beyond creating empty directories.
+type extractor struct {
+	stripComponents int
+	// ignore, when set, skips entries it ignores.
+	ignore    *ignoreMatcher
+	remaining int64
+	written   int64
+	files     []string
+	skipped   []string
+	// staging holds the extracted files until commit.
+	staging string
+	staged  map[string]bool
+	// replaced holds the files commit replaced, by path relative to appDir,
+	// until cleanup, so a failed commit can restore them.
+	replaced      string
+	replacedPaths map[string]bool
+}
+
+// newExtractor creates an extractor and its staging directory, which the
+// caller must remove with cleanup.
+func newExtractor(stripComponents int) (*extractor, error) {
+	staging, err := os.MkdirTemp(appDir, pullStagingPrefix+"*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	return &extractor{
+		stripComponents: stripComponents,
+		remaining:       maxPullBytes,
+		ignore:          loadIgnore(nil),
+		staging:         staging,
+		staged:          make(map[string]bool),
+	}, nil
+}
+
+// removeStaleStaging removes staging directories left in appDir by a control
+// plane that exited mid-pull.
+func removeStaleStaging() {
+	matches, _ := filepath.Glob(filepath.Join(appDir, pullStagingPrefix+"*"))
+	for _, m := range matches {
+		if err := os.RemoveAll(m); err != nil {
+			log.Printf("Failed to remove %s: %v", m, err)
+		}
+	}
+}
+
+// commit moves the extracted files into appDir, replacing existing ones.
+// Each path is checked again, as a symlink may have appeared along it since
+// it was extracted. If a move fails, the files already moved are removed and
+// the ones they replaced put back.
+func (e *extractor) commit() error {
+	replaced, err := os.MkdirTemp(appDir, pullStagingPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	e.replaced, e.replacedPaths = replaced, make(map[string]bool)
+	for i, rel := range e.files {
+		if err := e.moveIntoPlace(rel); err != nil {
+			e.rollback(e.files[:i], rel)
+			return fmt.Errorf("failed to move %s into place: %w", rel, err)
+		}
+	}
+	return nil
+}
+
+// moveIntoPlace moves the staged file rel into appDir, first moving aside a
+// file (not a directory) already there.
+func (e *extractor) moveIntoPlace(rel string) error {
+	dest, err := resolveWithinAppDir(rel)
+	if err == nil {
+		err = checkSymlinks(dest, true)
+	}
+	if err != nil {
+		return err
+	}
+	dir, err := openDirBeneath(filepath.Dir(dest), true)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	target := fdPath(dir, filepath.Base(dest))
+	if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+		aside := filepath.Join(e.replaced, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(aside), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(target, aside); err != nil {
+			return err
+		}
+		e.replacedPaths[rel] = true
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.Rename(filepath.Join(e.staging, filepath.FromSlash(rel)), target)
+}
+
+// rollback undoes a failed commit: it removes the files in moved, then puts
+// back what they and failed replaced. Errors are logged, as the commit has
+// already failed.
+func (e *extractor) rollback(moved []string, failed string) {
+	for i := len(moved); i >= 0; i-- {
+		rel := failed
+		if i < len(moved) {
+			rel = moved[i]
+		}
+		dest, err := resolveWithinAppDir(rel)
+		if err != nil {
+			continue
+		}
+		dir, err := openDirBeneath(filepath.Dir(dest), false)
+		if err != nil {
+			log.Printf("Failed to restore %s: %v", rel, err)
+			continue
+		}
+		target := fdPath(dir, filepath.Base(dest))
+		if rel != failed {
+			if err := os.Remove(target); err != nil {
+				log.Printf("Failed to remove %s: %v", rel, err)
+			}
+		}
+		if e.replacedPaths[rel] {
+			if err := os.Rename(filepath.Join(e.replaced, filepath.FromSlash(rel)), target); err != nil {
+				log.Printf("Failed to restore %s: %v", rel, err)
+			}
+		}
+		dir.Close()
+	}
+}
+
+// cleanup removes the staging directory and whatever commit didn't move, and
+// the files commit replaced.
+func (e *extractor) cleanup() {
+	for _, d := range []string{e.staging, e.replaced} {
+		if d == "" {
+			continue
+		}
+		if err := os.RemoveAll(d); err != nil {
+			log.Printf("Failed to remove %s: %v", d, err)
+		}
+	}
+}
+
+func (e *extractor) skip(name, reason string) {
+	log.Printf("Skipping archive entry %s: %s", name, reason)
+	e.skipped = append(e.skipped, name)
+}
+
+// entryPath maps an archive entry name to a path relative to appDir, or
+// returns false if the entry should be skipped.
+func (e *extractor) entryPath(name string) (string, bool) {
+	name = path.Clean(strings.TrimLeft(strings.ReplaceAll(name, "\\", "/"), "/"))
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", false
+	}
+	parts := strings.Split(name, "/")
+	if len(parts) <= e.stripComponents {
+		return "", false
+	}
+	rel := path.Join(parts[e.stripComponents:]...)
+	if rel == "" || rel == "." || rel == filepath.Base(pidFile) {
+		return "", false
+	}
+	return rel, true
+}
+
+func (e *extractor) writeFile(name string, r io.Reader, mode fs.FileMode) error {
+	rel, ok := e.entryPath(name)
+	if !ok {
+		e.skip(name, "outside extraction root")
+		return nil
+	}
+	if e.ignore != nil && e.ignore.Ignored(rel, false) {
+		e.skip(name, "ignored")
+		return nil
+	}
+	dest, err := resolveWithinAppDir(rel)
+	if err == nil {
+		err = checkSymlinks(dest, true)
+	}
+	if err != nil {
+		e.skip(name, err.Error())
+		return nil
+	}
+	staged := filepath.Join(e.staging, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(staged), 0755); err != nil {
+		return err
+	}
+
+	perm := fs.FileMode(0644)
+	if mode&0111 != 0 {
+		perm = 0755
+	}
+	f, err := os.OpenFile(staged, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, e.remaining+1))
+	closeErr := f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", rel, err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("failed to write %s: %w", rel, closeErr)
+	}
+	if n > e.remaining {
+		return errPullTooLarge
+	}
+	e.remaining -= n
+	e.written += n
+	// A later entry for the same path replaces the staged file.
+	if !e.staged[rel] {
+		e.staged[rel] = true
+		e.files = append(e.files, rel)
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+// pull_test.go
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tarEntry is one entry of a test archive; a non-empty link makes it a
+// symlink.
+type tarEntry struct {
+	name, content, link string
+}
+
+func makeTarGz(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content)), Typeflag: tar.TypeReg}
+		if e.link != "" {
+			hdr = &tar.Header{Name: e.name, Linkname: e.link, Typeflag: tar.TypeSymlink}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// makeTar is makeTarGz without the compression.
+func makeTar(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(makeTarGz(t, entries)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func makeZip(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		hdr.SetMode(0644)
+		content := e.content
+		if e.link != "" {
+			hdr.SetMode(fs.ModeSymlink | 0777)
+			content = e.link
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// assertNoStaging fails if a staging directory was left in dir.
+func assertNoStaging(t *testing.T, dir string) {
+	t.Helper()
+	if matches, _ := filepath.Glob(filepath.Join(dir, pullStagingPrefix+"*")); len(matches) > 0 {
+		t.Errorf("staging directories left behind: %v", matches)
+	}
+}
+
+func readTestFile(t *testing.T, dir, rel string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, rel))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestArchiveHandlerExtracts(t *testing.T) {
+	dir := useAppDir(t)
+	writeTestFile(t, dir, "keep.txt", "untouched")
+	writeTestFile(t, dir, "a.txt", "old")
+	body := makeTarGz(t, []tarEntry{
+		{name: "project/a.txt", content: "new"},
+		{name: "project/src/b.js", content: "console.log(1)"},
+		{name: "project/../../evil.txt", content: "x"},
+		{name: "project/link", link: "/etc/passwd"},
+		{name: "project/node_modules/x/index.js", content: "x"},
+	})
+	rec := httptest.NewRecorder()
+	archiveHandler(rec, httptest.NewRequest(http.MethodPost, "/sync/archive?strip_components=1", bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+	var resp PullResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(resp.Files, ","); got != "a.txt,src/b.js" {
+		t.Errorf("got files %q", resp.Files)
+	}
+	if len(resp.Skipped) != 3 {
+		t.Errorf("got skipped %q, want the escaping entry, the symlink and node_modules", resp.Skipped)
+	}
+	for rel, want := range map[string]string{"a.txt": "new", "src/b.js": "console.log(1)", "keep.txt": "untouched"} {
+		if got := readTestFile(t, dir, rel); got != want {
+			t.Errorf("%s: got %q, want %q", rel, got, want)
+		}
+	}
+	for _, rel := range []string{"link", "node_modules", "../evil.txt"} {
+		if _, err := os.Lstat(filepath.Join(dir, rel)); err == nil {
+			t.Errorf("%s was extracted", rel)
+		}
+	}
+	assertNoStaging(t, dir)
+}
+
+func TestArchiveHandlerFailureLeavesAppDirUnchanged(t *testing.T) {
+	dir := useAppDir(t)
+	saved := maxPullBytes
+	t.Cleanup(func() { maxPullBytes = saved })
+	maxPullBytes = 1000
+	writeTestFile(t, dir, "a.txt", "old")
+	body := makeTarGz(t, []tarEntry{
+		{name: "a.txt", content: "new"},
+		{name: "b.txt", content: "b"},
+		{name: "big.bin", content: strings.Repeat("x", 2000)},
+	})
+	rec := httptest.NewRecorder()
+	archiveHandler(rec, httptest.NewRequest(http.MethodPost, "/sync/archive", bytes.NewReader(body)))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+	if got := readTestFile(t, dir, "a.txt"); got != "old" {
+		t.Errorf("a.txt: got %q after a failed upload, want it unchanged", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.txt")); err == nil {
+		t.Error("b.txt was extracted by a failed upload")
+	}
+	assertNoStaging(t, dir)
+}
+
+func TestArchiveHandlerFailedCommitRollsBack(t *testing.T) {
+	dir := useAppDir(t)
+	writeTestFile(t, dir, "a.txt", "old")
+	// The last entry can't replace a directory, after the others have been
+	// moved into place.
+	writeTestFile(t, dir, "dir/keep.txt", "keep")
+	body := makeTarGz(t, []tarEntry{
+		{name: "a.txt", content: "new"},
+		{name: "sub/c.txt", content: "c"},
+		{name: "dir", content: "not a directory"},
+	})
+	rec := httptest.NewRecorder()
+	archiveHandler(rec, httptest.NewRequest(http.MethodPost, "/sync/archive", bytes.NewReader(body)))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+	if got := readTestFile(t, dir, "a.txt"); got != "old" {
+		t.Errorf("a.txt: got %q after a failed commit, want it restored", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub", "c.txt")); err == nil {
+		t.Error("sub/c.txt was left by a failed commit")
+	}
+	if got := readTestFile(t, dir, "dir/keep.txt"); got != "keep" {
+		t.Errorf("dir/keep.txt: got %q", got)
+	}
+	assertNoStaging(t, dir)
+}
+
+func postPull(t *testing.T, req PullRequest) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(req)
+	rec := httptest.NewRecorder()
+	pullHandler(rec, httptest.NewRequest(http.MethodPost, "/sync/pull", bytes.NewReader(body)))
+	return rec
+}
+
+func TestPullHandlerRejectsURLs(t *testing.T) {
+	dir := useAppDir(t)
+	tests := []struct {
+		name string
+		req  PullRequest
+	}{
+		{name: "file archive", req: PullRequest{URL: "file:///etc/passwd"}},
+		{name: "file tarball", req: PullRequest{URL: "file:///tmp/project.tar.gz", Type: "archive"}},
+		{name: "file git", req: PullRequest{URL: "file:///srv/repo.git"}},
+		{name: "file git by type", req: PullRequest{URL: "file:///srv/repo", Type: "git"}},
+		{name: "plain path", req: PullRequest{URL: "/srv/repo.git"}},
+		{name: "ssh archive", req: PullRequest{URL: "ssh://host/project.tar", Type: "archive"}},
+		{name: "ftp", req: PullRequest{URL: "ftp://host/project.tar"}},
+		{name: "unknown type", req: PullRequest{URL: "https://host/project.tar", Type: "svn"}},
+		{name: "missing url", req: PullRequest{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := postPull(t, tt.req); rec.Code != http.StatusBadRequest {
+				t.Errorf("got %d (%s), want 400", rec.Code, strings.TrimSpace(rec.Body.String()))
+			}
+		})
+	}
+	assertNoStaging(t, dir)
+}
+
+func TestPullHandlerArchiveOverHTTP(t *testing.T) {
+	dir := useAppDir(t)
+	archive := makeTarGz(t, []tarEntry{{name: "index.js", content: "ok"}})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/project.tar.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(archive)
+	}))
+	defer srv.Close()
+
+	if rec := postPull(t, PullRequest{URL: srv.URL + "/project.tar.gz"}); rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+	if got := readTestFile(t, dir, "index.js"); got != "ok" {
+		t.Errorf("index.js: got %q", got)
+	}
+	if rec := postPull(t, PullRequest{URL: srv.URL + "/missing.tar.gz"}); rec.Code != http.StatusInternalServerError {
+		t.Errorf("missing archive: got %d, want 500", rec.Code)
+	}
+	assertNoStaging(t, dir)
+}
+
+func TestPullHandlerTimeout(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := useAppDir(t)
+	saved := pullTimeout
+	t.Cleanup(func() { pullTimeout = saved })
+	pullTimeout = 300 * time.Millisecond
+
+	// The server never answers, so only the timeout ends the clone or
+	// download.
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	for _, u := range []string{srv.URL + "/repo.git", srv.URL + "/project.tar.gz"} {
+		start := time.Now()
+		rec := postPull(t, PullRequest{URL: u})
+		if rec.Code != http.StatusGatewayTimeout {
+			t.Errorf("%s: got %d (%s), want 504", u, rec.Code, strings.TrimSpace(rec.Body.String()))
+		}
+		if d := time.Since(start); d > 10*time.Second {
+			t.Errorf("%s: took %s to give up", u, d)
+		}
+	}
+	assertNoStaging(t, dir)
+}
+
+func TestArchiveHandlerFormats(t *testing.T) {
+	entries := []tarEntry{
+		{name: "index.js", content: "ok"},
+		{name: "src/lib/util.js", content: "util"},
+		{name: "link", link: "index.js"},
+	}
+	tests := []struct {
+		name     string
+		body     []byte
+		wantCode int
+	}{
+		{name: "tar.gz", body: makeTarGz(t, entries), wantCode: http.StatusOK},
+		{name: "tar", body: makeTar(t, entries), wantCode: http.StatusOK},
+		{name: "zip", body: makeZip(t, entries), wantCode: http.StatusOK},
+		{name: "not an archive", body: []byte("hello, this is not an archive at all"), wantCode: http.StatusBadRequest},
+		{name: "corrupt gzip", body: append([]byte{0x1f, 0x8b}, "garbage"...), wantCode: http.StatusBadRequest},
+		{name: "corrupt zip", body: []byte("PK\x03\x04garbage"), wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := useAppDir(t)
+			rec := httptest.NewRecorder()
+			archiveHandler(rec, httptest.NewRequest(http.MethodPost, "/sync/archive", bytes.NewReader(tt.body)))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got %d: %s", rec.Code, rec.Body)
+			}
+			assertNoStaging(t, dir)
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var resp PullResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(resp.Files, ","); got != "index.js,src/lib/util.js" {
+				t.Errorf("got files %q", resp.Files)
+			}
+			if strings.Join(resp.Skipped, ",") != "link" {
+				t.Errorf("got skipped %q, want the symlink", resp.Skipped)
+			}
+			if got := readTestFile(t, dir, "src/lib/util.js"); got != "util" {
+				t.Errorf("src/lib/util.js: got %q", got)
+			}
+			if _, err := os.Lstat(filepath.Join(dir, "link")); err == nil {
+				t.Error("the symlink was extracted")
+			}
+		})
+	}
+}
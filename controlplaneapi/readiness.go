@@ -0,0 +1,85 @@
+// readiness.go
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"sync"
+)
+
+// --- Log-Based Readiness ---
+
+// defaultReadyPattern matches the "ready" messages of common dev servers:
+// Next.js ("✓ Ready in 1.2s", "ready - started server on"), Vite ("ready in
+// 300 ms", "Local:   http://localhost:5173/") and Angular ("Compiled
+// successfully").
+const defaultReadyPattern = `(?i)\bready in\b|\bready - started server\b|\bstarted server on\b|\bLocal:\s+https?://|\bcompiled successfully\b`
+
+// readyPattern, when set, marks the dev server ready as soon as a line of its
+// output matches, even before HTTP polling succeeds.
+var readyPattern = regexp.MustCompile(defaultReadyPattern)
+
+// ansiEscapeRegex matches terminal color and cursor codes, which dev servers
+// sprinkle through their ready messages.
+var ansiEscapeRegex = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// maxReadyLineBytes caps how much of an unterminated line is kept for matching.
+const maxReadyLineBytes = 4 << 10
+
+// readyWatcher closes ready the first time a line of the dev server's output
+// matches readyPattern.
+type readyWatcher struct {
+	once  sync.Once
+	ready chan struct{}
+}
+
+func newReadyWatcher() *readyWatcher {
+	return &readyWatcher{ready: make(chan struct{})}
+}
+
+// seen reports whether the ready pattern has matched.
+func (rw *readyWatcher) seen() bool {
+	select {
+	case <-rw.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// stream returns a writer for one output stream, to be fed with io.TeeReader.
+// Each stream needs its own writer so partial lines don't interleave.
+func (rw *readyWatcher) stream() *readyStream {
+	return &readyStream{watcher: rw}
+}
+
+type readyStream struct {
+	watcher *readyWatcher
+	partial []byte
+}
+
+func (s *readyStream) Write(p []byte) (int, error) {
+	if readyPattern == nil || s.watcher.seen() {
+		return len(p), nil
+	}
+	data := append(s.partial, p...)
+	for {
+		i := bytes.IndexAny(data, "\r\n")
+		if i < 0 {
+			break
+		}
+		s.match(data[:i])
+		data = data[i+1:]
+	}
+	if len(data) > maxReadyLineBytes {
+		data = data[len(data)-maxReadyLineBytes:]
+	}
+	s.partial = append(s.partial[:0], data...)
+	return len(p), nil
+}
+
+func (s *readyStream) match(line []byte) {
+	if readyPattern.Match(ansiEscapeRegex.ReplaceAll(line, nil)) {
+		s.watcher.once.Do(func() { close(s.watcher.ready) })
+	}
+}
@@ -0,0 +1,73 @@
+// runlog.go
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// --- Per-Run Log Files (for /dev/logs/download) ---
+
+// runLogFile holds everything broadcast since the dev server last started;
+// the run before it is kept as runLogFile + ".1".
+var runLogFile = "/app/applet/.dev.run.log"
+
+// runLogs captures broadcast lines to runLogFile, rotating it (keeping one
+// previous run) each time the dev server starts; nil until main opens it.
+var runLogs *rotatingLog
+
+// formatLogFileLine renders a line as "<timestamp> STDOUT|STDERR <text>\n".
+func formatLogFileLine(msg BroadcastMessage, text string) string {
+	stream := "STDOUT"
+	if msg.IsStderr {
+		stream = "STDERR"
+	}
+	return fmt.Sprintf("%s %s %s\n", formatLogTime(msg.Time), stream, text)
+}
+
+// logsDownloadHandler serves a run's log as a file: the current run by
+// default, or the one before it with ?run=previous.
+func logsDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	name, file := "current", runLogFile
+	switch run := r.URL.Query().Get("run"); run {
+	case "", "current":
+	case "previous":
+		name, file = "previous", runLogFile+".1"
+	default:
+		httpError(w, "Query parameter 'run' must be 'current' or 'previous'", http.StatusBadRequest)
+		return
+	}
+
+	if runLogs != nil {
+		runLogs.Flush()
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			httpError(w, fmt.Sprintf("No log for the %s run", name), http.StatusNotFound)
+			return
+		}
+		httpError(w, fmt.Sprintf("Failed to open log: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		httpError(w, fmt.Sprintf("Failed to open log: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// The current run's file keeps growing; serve what was there when asked.
+	filename := fmt.Sprintf("dev-server-%s-%s.log", name, strings.ReplaceAll(info.ModTime().UTC().Format(time.RFC3339), ":", ""))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Content-Length", fmt.Sprint(info.Size()))
+	if _, err := io.CopyN(w, f, info.Size()); err != nil {
+		log.Printf("Log download interrupted: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+// synclog.go
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- Sync Change Log (for /sync/changes) ---
+
+// maxSyncLogEntries caps how many syncs are remembered. Clients asking for
+// changes since an older id must resync fully.
+const maxSyncLogEntries = 1000
+
+// syncLogEntry records the paths a single sync touched.
+type syncLogEntry struct {
+	ID      int64
+	At      time.Time
+	Written []string
+	Deleted []string
+}
+
+// syncLog is an in-memory log of recent syncs. Ids start at 1 for each
+// control plane instance.
+type syncLog struct {
+	mu      sync.Mutex
+	lastID  int64
+	entries []syncLogEntry
+}
+
+// syncChanges records every /sync and /sync/pull that changed files.
+var syncChanges = &syncLog{}
+
+// record appends a sync and returns its id.
+func (l *syncLog) record(written, deleted []string) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastID++
+	l.entries = append(l.entries, syncLogEntry{ID: l.lastID, At: time.Now(), Written: written, Deleted: deleted})
+	if len(l.entries) > maxSyncLogEntries {
+		l.entries = append(l.entries[:0], l.entries[len(l.entries)-maxSyncLogEntries:]...)
+	}
+	return l.lastID
+}
+
+// recordResults records the successful operations of a /sync.
+func (l *syncLog) recordResults(results map[string]SyncFileResult) int64 {
+	var written, deleted []string
+	for p, r := range results {
+		switch r.Status {
+		case "written":
+			written = append(written, p)
+		case "deleted":
+			deleted = append(deleted, p)
+		}
+	}
+	sort.Strings(written)
+	sort.Strings(deleted)
+	return l.record(written, deleted)
+}
+
+// since returns the paths changed and deleted by syncs after id, each path
+// reported by its latest operation. ok is false if id is older than the
+// retained log or newer than the latest sync.
+func (l *syncLog) since(id int64) (changed, deleted []string, latest int64, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	latest = l.lastID
+	if id > latest {
+		return nil, nil, latest, false
+	}
+	if len(l.entries) > 0 && id < l.entries[0].ID-1 {
+		return nil, nil, latest, false
+	}
+
+	state := make(map[string]bool) // path -> exists after the latest op
+	for _, e := range l.entries {
+		if e.ID <= id {
+			continue
+		}
+		for _, p := range e.Written {
+			state[p] = true
+		}
+		for _, p := range e.Deleted {
+			state[p] = false
+		}
+	}
+	changed, deleted = []string{}, []string{}
+	for p, exists := range state {
+		if exists {
+			changed = append(changed, p)
+		} else {
+			deleted = append(deleted, p)
+		}
+	}
+	sort.Strings(changed)
+	sort.Strings(deleted)
+	return changed, deleted, latest, true
+}
+
+// syncChangesHandler reports the files changed by syncs after ?since=<id>.
+// A 410 means the id is unknown to this instance (too old, or from before a
+// restart) and the client should resync fully.
+func syncChangesHandler(w http.ResponseWriter, r *http.Request) {
+	since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if err != nil || since < 0 {
+		httpError(w, "Query parameter 'since' must be a non-negative sync id", http.StatusBadRequest)
+		return
+	}
+	changed, deleted, latest, ok := syncChanges.since(since)
+	if !ok {
+		jsonResponse(w, http.StatusGone, map[string]interface{}{
+			"error":  "Sync id is not available; resync all files",
+			"latest": latest,
+		})
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"since":   since,
+		"latest":  latest,
+		"changed": changed,
+		"deleted": deleted,
+	})
+}
@@ -0,0 +1,104 @@
+// synclog_test.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSyncLogSince(t *testing.T) {
+	l := &syncLog{}
+	l.record([]string{"a.js", "b.js"}, nil)      // 1
+	l.record([]string{"c.js"}, []string{"a.js"}) // 2
+	l.record([]string{"a.js"}, []string{"b.js"}) // 3
+
+	tests := []struct {
+		since                    int64
+		wantChanged, wantDeleted string
+		wantOK                   bool
+	}{
+		{since: 0, wantChanged: "a.js,c.js", wantDeleted: "b.js", wantOK: true},
+		// a.js was deleted and then written again, so it's only changed.
+		{since: 1, wantChanged: "a.js,c.js", wantDeleted: "b.js", wantOK: true},
+		{since: 2, wantChanged: "a.js", wantDeleted: "b.js", wantOK: true},
+		{since: 3, wantOK: true},
+		{since: 4, wantOK: false},
+	}
+	for _, tt := range tests {
+		changed, deleted, latest, ok := l.since(tt.since)
+		if ok != tt.wantOK || latest != 3 {
+			t.Errorf("since(%d): got ok=%v latest=%d, want ok=%v latest=3", tt.since, ok, latest, tt.wantOK)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if got := strings.Join(changed, ","); got != tt.wantChanged {
+			t.Errorf("since(%d): got changed %q, want %q", tt.since, got, tt.wantChanged)
+		}
+		if got := strings.Join(deleted, ","); got != tt.wantDeleted {
+			t.Errorf("since(%d): got deleted %q, want %q", tt.since, got, tt.wantDeleted)
+		}
+	}
+}
+
+func TestSyncLogForgetsOldEntries(t *testing.T) {
+	l := &syncLog{}
+	for i := 0; i < maxSyncLogEntries+5; i++ {
+		l.record([]string{fmt.Sprintf("f%d.js", i)}, nil)
+	}
+	// Entries 1-5 are gone. Resuming from 5 needs nothing older than 6.
+	if _, _, _, ok := l.since(4); ok {
+		t.Error("since(4) succeeded after entry 5 was forgotten")
+	}
+	changed, _, _, ok := l.since(5)
+	if !ok || len(changed) != maxSyncLogEntries {
+		t.Errorf("since(5): got ok=%v and %d changes, want %d", ok, len(changed), maxSyncLogEntries)
+	}
+}
+
+func TestSyncLogRecordResults(t *testing.T) {
+	l := &syncLog{}
+	id := l.recordResults(map[string]SyncFileResult{
+		"b.js": {Status: "written"},
+		"a.js": {Status: "written"},
+		"c.js": {Status: "deleted"},
+		"d.js": {Status: "unchanged"},
+		"e.js": {Status: "failed"},
+	})
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := l.entries[0]
+	if id != 1 || strings.Join(e.Written, ",") != "a.js,b.js" || strings.Join(e.Deleted, ",") != "c.js" {
+		t.Errorf("got id %d and %+v, want only the successful operations, sorted", id, e)
+	}
+}
+
+func TestSyncChangesHandler(t *testing.T) {
+	saved := syncChanges
+	t.Cleanup(func() { syncChanges = saved })
+	syncChanges = &syncLog{}
+	syncChanges.record([]string{"a.js"}, nil)
+
+	tests := []struct {
+		query    string
+		wantCode int
+	}{
+		{query: "?since=0", wantCode: http.StatusOK},
+		{query: "?since=1", wantCode: http.StatusOK},
+		{query: "?since=2", wantCode: http.StatusGone},
+		{query: "", wantCode: http.StatusBadRequest},
+		{query: "?since=-1", wantCode: http.StatusBadRequest},
+		{query: "?since=abc", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		syncChangesHandler(rec, httptest.NewRequest(http.MethodGet, "/sync/changes"+tt.query, nil))
+		if rec.Code != tt.wantCode {
+			t.Errorf("%q: got %d, want %d: %s", tt.query, rec.Code, tt.wantCode, rec.Body)
+		}
+	}
+}
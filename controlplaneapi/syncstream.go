@@ -0,0 +1,426 @@
+// syncstream.go
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// --- Streaming /sync Decoding ---
+
+// syncStreamThreshold is the largest base64 string held in memory for a
+// synced file. Files up to it are written concurrently; larger ones are
+// decoded from the request body straight into their temp file, one at a time.
+const syncStreamThreshold = 1 << 20
+
+// syncStreamChunk is how much of a streamed file's string is unescaped at a
+// time.
+const syncStreamChunk = 64 << 10
+
+// decodeSyncRequest stream-decodes a sync body. Each entry of "files" is
+// handed to onFile as soon as it is parsed, so the whole map is never held in
+// memory; every other field is decoded into the returned SyncRequest. Plain
+// string entries longer than syncStreamThreshold are passed with a stream
+// reading the rest of the string from the body, which onFile must consume
+// before returning.
+//
+// The body is walked with json.Decoder.Token, but the decoder reads every
+// value into memory before returning it, so a syncBodyGate in front of it
+// holds those long strings back.
+func decodeSyncRequest(body io.Reader, onFile func(path string, file SyncFile)) (*SyncRequest, error) {
+	gate := &syncBodyGate{r: bufio.NewReader(body)}
+	dec := json.NewDecoder(gate)
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+
+	rest := make(map[string]json.RawMessage)
+	for dec.More() {
+		key, err := objectKey(dec)
+		if err != nil {
+			return nil, err
+		}
+		if key == "files" {
+			if err := decodeSyncFiles(dec, gate, onFile); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		rest[key] = raw
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	if tok, err := dec.Token(); err == nil {
+		return nil, fmt.Errorf("unexpected %v after the request body", tok)
+	} else if err != io.EOF {
+		return nil, err
+	}
+
+	var req SyncRequest
+	restJSON, err := json.Marshal(rest)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(restJSON, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// decodeSyncFiles decodes the value of "files", null or an object, passing
+// each entry to onFile.
+func decodeSyncFiles(dec *json.Decoder, gate *syncBodyGate, onFile func(path string, file SyncFile)) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if tok == nil {
+		return nil // "files": null
+	}
+	if tok != json.Delim('{') {
+		return fmt.Errorf("expected object for \"files\"")
+	}
+	for dec.More() {
+		p, err := objectKey(dec)
+		if err != nil {
+			return err
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return fmt.Errorf("invalid content for %s: %w", p, unexpectedEOF(err))
+		}
+		if stream := gate.takeStream(); stream != nil {
+			onFile(p, SyncFile{stream: stream})
+			// Skip whatever onFile left unread, e.g. after a failed write.
+			if _, err := io.Copy(io.Discard, stream); err != nil {
+				return fmt.Errorf("invalid content for %s: %w", p, err)
+			}
+			continue
+		}
+		var file SyncFile
+		if err := json.Unmarshal(raw, &file); err != nil {
+			return fmt.Errorf("invalid content for %s: %w", p, err)
+		}
+		onFile(p, file)
+	}
+	return expectDelim(dec, '}')
+}
+
+// objectKey reads the next key of an object.
+func objectKey(dec *json.Decoder) (string, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return "", unexpectedEOF(err)
+	}
+	key, ok := tok.(string)
+	if !ok {
+		return "", fmt.Errorf("expected an object key, got %v", tok)
+	}
+	return key, nil
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if tok != want {
+		return fmt.Errorf("expected %v, got %v", want, tok)
+	}
+	return nil
+}
+
+// unexpectedEOF turns running out of input mid-value into an error, leaving
+// other read errors (such as the body size limit) as they are.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// syncBodyGate passes the sync body through to the json.Decoder, except for
+// string values of "files" longer than syncStreamThreshold: the decoder gets
+// an empty string in their place, and takeStream returns the real content.
+// It follows only as much of the syntax (strings, nesting, the current
+// top-level key) as it takes to find those values; checking the syntax is
+// left to the decoder.
+type syncBodyGate struct {
+	r *bufio.Reader
+	// pending holds bytes for the decoder that were read from r ahead of it.
+	pending []byte
+	depth   int
+	// valueStart is set between a ':' and the value after it.
+	valueStart bool
+	inString   bool
+	// backslash and hexLeft track an escape within a string.
+	backslash bool
+	hexLeft   int
+	// key collects the top-level key being read, filesKey whether the last
+	// one was "files".
+	inKey    bool
+	key      []byte
+	filesKey bool
+	// stream is the held-back string, until takeStream returns it. held is
+	// set until it has been read to its closing quote, and the decoder
+	// can be given what follows it.
+	stream *syncFileStream
+	held   bool
+}
+
+func (g *syncBodyGate) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(g.pending) > 0 {
+			k := copy(p[n:], g.pending)
+			g.pending = g.pending[k:]
+			n += k
+			continue
+		}
+		if g.held || (n > 0 && g.r.Buffered() == 0) {
+			break
+		}
+		c, err := g.r.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		if c == '"' && !g.inString && g.valueStart && g.depth == 2 && g.filesKey {
+			if n > 0 {
+				// Stop short, so that a held-back string is always the
+				// value the decoder is decoding when it reads on.
+				g.r.UnreadByte()
+				break
+			}
+			g.valueStart = false
+			if err := g.readFileString(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		p[n] = c
+		n++
+		g.scan(c)
+	}
+	if n == 0 && g.held {
+		return 0, errors.New("sync body read past a streamed file")
+	}
+	return n, nil
+}
+
+// scan follows the syntax past c, which is going to the decoder.
+func (g *syncBodyGate) scan(c byte) {
+	if g.inString {
+		if end, _ := g.scanString(c); end {
+			g.inString = false
+			if g.inKey {
+				g.inKey = false
+				g.filesKey = string(g.key) == "files"
+			}
+		} else if g.inKey && len(g.key) <= len("files") {
+			g.key = append(g.key, c)
+		}
+		return
+	}
+	switch c {
+	case ' ', '\t', '\r', '\n':
+		return
+	case ':':
+		g.valueStart = true
+		return
+	case '"':
+		g.inString = true
+		g.inKey = g.depth == 1 && !g.valueStart
+		g.key = g.key[:0]
+	case '{', '[':
+		g.depth++
+	case '}', ']':
+		g.depth--
+	}
+	g.valueStart = false
+}
+
+// scanString follows a string past c, reporting whether c is its closing
+// quote, and whether it's an ASCII character outside of any escape, after
+// which the string can be split without splitting an escape, a surrogate
+// pair or a UTF-8 sequence.
+func (g *syncBodyGate) scanString(c byte) (end, plain bool) {
+	switch {
+	case g.backslash:
+		g.backslash = false
+		if c == 'u' {
+			g.hexLeft = 4
+		}
+	case g.hexLeft > 0:
+		g.hexLeft--
+	case c == '\\':
+		g.backslash = true
+	case c == '"':
+		return true, false
+	default:
+		return false, c < utf8.RuneSelf
+	}
+	return false, false
+}
+
+// readFileString reads ahead the string value of "files" whose opening quote
+// was just read from r. One that ends within syncStreamThreshold bytes goes
+// to the decoder as it is; a longer one is held back.
+func (g *syncBodyGate) readFileString() error {
+	buf := []byte{'"'}
+	split := 0
+	for len(buf) <= syncStreamThreshold {
+		c, err := g.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		buf = append(buf, c)
+		end, plain := g.scanString(c)
+		if end {
+			g.pending = buf
+			return nil
+		}
+		if plain {
+			split = len(buf) - 1
+		}
+	}
+	g.pending = []byte(`"" `) // The space ends the value for the decoder.
+	g.stream = &syncFileStream{g: g, raw: buf[1:], split: split}
+	g.held = true
+	return nil
+}
+
+// takeStream returns the string held back for the value just decoded, if
+// any.
+func (g *syncBodyGate) takeStream() io.Reader {
+	s := g.stream
+	g.stream = nil
+	if s == nil {
+		return nil
+	}
+	return s
+}
+
+// syncFileStream reads a held-back string up to its closing quote,
+// unescaping it with encoding/json a chunk at a time.
+type syncFileStream struct {
+	g *syncBodyGate
+	// raw holds the string's bytes read but not yet unescaped, of which
+	// raw[:split] can be unescaped on their own.
+	raw   []byte
+	split int
+	out   []byte
+	done  bool
+}
+
+func (s *syncFileStream) Read(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+// fill unescapes the next chunk of the string into out.
+func (s *syncFileStream) fill() error {
+	for !s.done && (s.split == 0 || len(s.raw) < syncStreamChunk) {
+		c, err := s.g.r.ReadByte()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		end, plain := s.g.scanString(c)
+		if end {
+			s.done = true
+			s.split = len(s.raw)
+			s.g.held = false
+			break
+		}
+		s.raw = append(s.raw, c)
+		if plain {
+			s.split = len(s.raw)
+		}
+	}
+	quoted := make([]byte, 0, s.split+2)
+	quoted = append(append(append(quoted, '"'), s.raw[:s.split]...), '"')
+	var chunk string
+	if err := json.Unmarshal(quoted, &chunk); err != nil {
+		return err
+	}
+	s.out = []byte(chunk)
+	s.raw = append(s.raw[:0], s.raw[s.split:]...)
+	s.split = 0
+	return nil
+}
+
+// --- Compressed Sync Bodies ---
+
+// syncContentEncodings lists the request Content-Encodings /sync accepts,
+// advertised in its Accept-Encoding response header.
+const syncContentEncodings = "gzip, deflate"
+
+var (
+	// errUnsupportedEncoding is returned for a Content-Encoding /sync can't
+	// decompress.
+	errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+	// errCompressedBody marks a request body that failed to decompress.
+	errCompressedBody = errors.New("invalid compressed body")
+)
+
+// decompressBody returns r's body, decompressed according to its
+// Content-Encoding: gzip, or deflate (zlib, as HTTP defines it).
+func decompressBody(r *http.Request) (io.Reader, error) {
+	var (
+		body io.Reader
+		err  error
+	)
+	switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+		return r.Body, nil
+	case "gzip", "x-gzip":
+		body, err = gzip.NewReader(r.Body)
+	case "deflate":
+		body, err = zlib.NewReader(r.Body)
+	default:
+		return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, enc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCompressedBody, err)
+	}
+	return compressedBodyReader{body}, nil
+}
+
+// compressedBodyReader marks decompression errors with errCompressedBody, so
+// they aren't reported as malformed JSON. The body size limit's error is
+// passed through.
+type compressedBodyReader struct {
+	r io.Reader
+}
+
+func (c compressedBodyReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err != nil && err != io.EOF {
+		var maxErr *http.MaxBytesError
+		if !errors.As(err, &maxErr) {
+			err = fmt.Errorf("%w: %v", errCompressedBody, err)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,262 @@
+// syncstream_test.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDecodeSyncRequestStreamsEscapes(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		wantErr bool
+	}{
+		{name: "plain", in: `aGVsbG8gd29ybGQ=`},
+		{name: "utf-8", in: `héllo 世界`},
+		{name: "simple escapes", in: `a\"b\\c\/d\be\ff\ng\rh\ti`},
+		{name: "unicode escape", in: `caf\u00e9 \u4e16`},
+		{name: "surrogate pair", in: `smile \ud83d\ude00!`},
+		{name: "uppercase surrogate pair", in: `\uD834\uDD1E`},
+		{name: "lone high surrogate", in: `\ud800x`},
+		{name: "lone high surrogate at end", in: `\ud800`},
+		{name: "lone low surrogate", in: `\udc00x`},
+		{name: "two high surrogates", in: `\ud800\ud800\udc00`},
+		{name: "high surrogate then simple escape", in: `\ud800\n`},
+		{name: "invalid escape", in: `\q`, wantErr: true},
+		{name: "invalid hex", in: `\u12g4`, wantErr: true},
+		{name: "control character", in: "a\nb", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Repeat the case across a chunk boundary, and put it at the
+			// very end, where the closing quote cuts the last chunk.
+			pad := strings.Repeat("A", syncStreamChunk-3)
+			content := strings.Repeat("A", syncStreamThreshold) + tt.in + pad + tt.in + pad + tt.in
+			body := `{"files": {"a.txt": "` + content + `"}}`
+			_, files, streamed, err := decodeForTest(bufio.NewReaderSize(iotest.HalfReader(strings.NewReader(body)), 16))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var want string
+			if err := json.Unmarshal([]byte(`"`+content+`"`), &want); err != nil {
+				t.Fatalf("encoding/json rejects %s: %v", tt.in, err)
+			}
+			if !streamed["a.txt"] {
+				t.Error("a.txt wasn't streamed")
+			}
+			if files["a.txt"] != want {
+				t.Errorf("got %q, want %q as encoding/json decodes it", files["a.txt"][syncStreamThreshold:], want[syncStreamThreshold:])
+			}
+		})
+	}
+}
+
+// decodeForTest decodes body, collecting each file's content, streamed or
+// not.
+func decodeForTest(body io.Reader) (*SyncRequest, map[string]string, map[string]bool, error) {
+	files := map[string]string{}
+	streamed := map[string]bool{}
+	req, err := decodeSyncRequest(body, func(p string, file SyncFile) {
+		if file.stream != nil {
+			data, _ := io.ReadAll(file.stream)
+			files[p] = string(data)
+			streamed[p] = true
+			return
+		}
+		files[p] = file.Content
+	})
+	return req, files, streamed, err
+}
+
+func TestDecodeSyncRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantFiles   map[string]string
+		wantDeleted []string
+		wantMode    string
+		wantPatches int
+		wantErr     bool
+	}{
+		{
+			name:      "string and object entries",
+			body:      `{"files": {"a.txt": "YQ==", "b.txt": {"content": "Yg==", "sha256": "00"}}}`,
+			wantFiles: map[string]string{"a.txt": "YQ==", "b.txt": "Yg=="},
+		},
+		{
+			name:        "other fields around files",
+			body:        `{"mode": "mirror", "files": {"a.txt": "YQ=="}, "deleted_file_paths": ["x", "y/z"], "skip_install": true}`,
+			wantFiles:   map[string]string{"a.txt": "YQ=="},
+			wantDeleted: []string{"x", "y/z"},
+			wantMode:    "mirror",
+		},
+		{
+			name:        "nested values with structural characters in strings",
+			body:        `{"patches": {"a.txt": {"base_sha256": "}\"]", "ops": [{"offset": 1, "length": 2, "replacement": "{["}]}}, "extra": {"x": [1, {"y": null}, true, -2.5e3]}, "files": {}}`,
+			wantFiles:   map[string]string{},
+			wantPatches: 1,
+		},
+		{
+			name:      "escaped path",
+			body:      `{"files": {"caf\u00e9/\ud83d\ude00.txt": "YQ=="}}`,
+			wantFiles: map[string]string{"caf\u00e9/\U0001F600.txt": "YQ=="},
+		},
+		{
+			name:      "null files",
+			body:      `{"files": null, "deleted_file_paths": ["x"]}`,
+			wantFiles: map[string]string{}, wantDeleted: []string{"x"},
+		},
+		{name: "empty body", body: ``, wantErr: true},
+		{name: "not an object", body: `[]`, wantErr: true},
+		{name: "files not an object", body: `{"files": ["a"]}`, wantErr: true},
+		{name: "truncated after key", body: `{"files": {"a.txt"`, wantErr: true},
+		{name: "truncated in content", body: `{"files": {"a.txt": "YQ`, wantErr: true},
+		{name: "truncated after files", body: `{"files": {"a.txt": "YQ=="}`, wantErr: true},
+		{name: "truncated in nested value", body: `{"patches": {"a": {"ops": [`, wantErr: true},
+		{name: "missing colon", body: `{"files" {}}`, wantErr: true},
+		{name: "missing comma", body: `{"files": {} "mode": "mirror"}`, wantErr: true},
+		{name: "trailing data", body: `{"files": {}} {}`, wantErr: true},
+		{name: "invalid entry", body: `{"files": {"a.txt": 12}}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, files, _, err := decodeForTest(strings.NewReader(tt.body))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(files) != len(tt.wantFiles) {
+				t.Errorf("got files %q, want %q", files, tt.wantFiles)
+			}
+			for p, want := range tt.wantFiles {
+				if files[p] != want {
+					t.Errorf("file %q: got %q, want %q", p, files[p], want)
+				}
+			}
+			if strings.Join(req.DeletedFilePaths, ",") != strings.Join(tt.wantDeleted, ",") {
+				t.Errorf("got deleted paths %q, want %q", req.DeletedFilePaths, tt.wantDeleted)
+			}
+			if req.Mode != tt.wantMode {
+				t.Errorf("got mode %q, want %q", req.Mode, tt.wantMode)
+			}
+			if len(req.Patches) != tt.wantPatches {
+				t.Errorf("got %d patches, want %d", len(req.Patches), tt.wantPatches)
+			}
+		})
+	}
+}
+
+func TestDecodeSyncRequestStreamsLargeContent(t *testing.T) {
+	large := strings.Repeat("QUJD", syncStreamThreshold/4+100)
+	body := `{"files": {"small.txt": "YQ==", "large.bin": "` + large + `", "after.txt": "Yg=="}}`
+	_, files, streamed, err := decodeForTest(iotest.HalfReader(strings.NewReader(body)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !streamed["large.bin"] || streamed["small.txt"] {
+		t.Errorf("got streamed %v, want only large.bin", streamed)
+	}
+	if files["large.bin"] != large {
+		t.Errorf("large.bin: got %d bytes, want %d", len(files["large.bin"]), len(large))
+	}
+	if files["after.txt"] != "Yg==" {
+		t.Errorf("after.txt: got %q", files["after.txt"])
+	}
+}
+
+func TestDecodeSyncRequestSizeLimit(t *testing.T) {
+	for _, size := range []int{1000, syncStreamThreshold + 1000} {
+		body := `{"files": {"a.txt": "` + strings.Repeat("A", size) + `"}}`
+		limited := http.MaxBytesReader(nil, io.NopCloser(strings.NewReader(body)), 500)
+		_, _, _, err := decodeForTest(limited)
+		var maxErr *http.MaxBytesError
+		if !errors.As(err, &maxErr) {
+			t.Errorf("%d byte file: got error %v, want the size limit's", size, err)
+		}
+	}
+}
+
+func TestSyncCompressedBody(t *testing.T) {
+	dir := useAppDir(t)
+	saved := maxSyncBytes
+	t.Cleanup(func() { maxSyncBytes = saved })
+	maxSyncBytes = 4096
+	compress := func(encoding, body string) []byte {
+		var buf bytes.Buffer
+		var w io.WriteCloser = gzip.NewWriter(&buf)
+		if encoding == "deflate" {
+			w = zlib.NewWriter(&buf)
+		}
+		io.WriteString(w, body)
+		w.Close()
+		return buf.Bytes()
+	}
+	valid := `{"files": {"a.txt": "YQ=="}}`
+	truncated := compress("gzip", valid)
+	truncated = truncated[:len(truncated)-10]
+	// Small compressed, but over the limit once decompressed.
+	bomb := compress("gzip", `{"files": {"a.txt": "`+strings.Repeat("A", 100000)+`"}}`)
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		wantCode int
+	}{
+		{name: "plain", body: []byte(valid), wantCode: http.StatusOK},
+		{name: "identity", encoding: "identity", body: []byte(valid), wantCode: http.StatusOK},
+		{name: "gzip", encoding: "gzip", body: compress("gzip", valid), wantCode: http.StatusOK},
+		{name: "x-gzip", encoding: "X-Gzip", body: compress("gzip", valid), wantCode: http.StatusOK},
+		{name: "deflate", encoding: "deflate", body: compress("deflate", valid), wantCode: http.StatusOK},
+		{name: "unsupported", encoding: "br", body: []byte(valid), wantCode: http.StatusUnsupportedMediaType},
+		{name: "not gzip", encoding: "gzip", body: []byte(valid), wantCode: http.StatusBadRequest},
+		{name: "truncated gzip", encoding: "gzip", body: truncated, wantCode: http.StatusBadRequest},
+		{name: "over the limit decompressed", encoding: "gzip", body: bomb, wantCode: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(filepath.Join(dir, "a.txt"))
+			req := httptest.NewRequest(http.MethodPost, "/sync", bytes.NewReader(tt.body))
+			if tt.encoding != "" {
+				req.Header.Set("Content-Encoding", tt.encoding)
+			}
+			rec := httptest.NewRecorder()
+			syncHandler(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got %d: %s", rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get("Accept-Encoding"); got != syncContentEncodings {
+				t.Errorf("got Accept-Encoding %q", got)
+			}
+			if tt.wantCode == http.StatusOK && readTestFile(t, dir, "a.txt") != "a" {
+				t.Error("a.txt wasn't written")
+			}
+			if tt.name == "truncated gzip" && !strings.Contains(rec.Body.String(), "Invalid compressed body") {
+				t.Errorf("got %s, want the error to blame the compression", rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+// warmpaths.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Persisted Warm Paths ---
+
+const (
+	// maxWarmPaths caps how many paths are remembered.
+	maxWarmPaths = 50
+	// warmPathTTL is how long a path is remembered after it last warmed.
+	warmPathTTL = 7 * 24 * time.Hour
+)
+
+var (
+	// warmPathsMu serializes read-modify-write cycles of warmPathsFile.
+	warmPathsMu sync.Mutex
+	// defaultPrewarmPaths are always warmed when a start or restart has no
+	// prewarm paths of its own, regardless of what was persisted.
+	defaultPrewarmPaths []string
+)
+
+// warmPath is a previously prewarmed path, persisted in warmPathsFile so the
+// next dev server (even in a new control plane instance) is warmed the same way.
+type warmPath struct {
+	Path       string    `json:"path"`
+	OK         bool      `json:"ok"`
+	LastWarmed time.Time `json:"last_warmed"`
+}
+
+func readWarmPaths() []warmPath {
+	data, err := os.ReadFile(warmPathsFile)
+	if err != nil {
+		return nil
+	}
+	var entries []warmPath
+	if err := json.Unmarshal(data, &entries); err != nil {
+		log.Printf("Ignoring unreadable warm path file %s: %v", warmPathsFile, err)
+		return nil
+	}
+	return entries
+}
+
+// loadWarmPaths returns the persisted paths that last warmed successfully and
+// haven't expired, most recent first.
+func loadWarmPaths() []string {
+	warmPathsMu.Lock()
+	defer warmPathsMu.Unlock()
+
+	var paths []string
+	for _, e := range readWarmPaths() {
+		if e.OK && time.Since(e.LastWarmed) < warmPathTTL {
+			paths = append(paths, e.Path)
+		}
+	}
+	return paths
+}
+
+// defaultWarmPaths returns the paths to warm when a request specifies none:
+// the configured defaults followed by the persisted paths, without duplicates.
+func defaultWarmPaths() []string {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, p := range append(append([]string{}, defaultPrewarmPaths...), loadWarmPaths()...) {
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// parsePrewarmPaths splits a comma-separated list of paths, each of which must
+// start with "/".
+func parsePrewarmPaths(list string) ([]string, error) {
+	var paths []string
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("path %q must start with \"/\"", p)
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+// recordWarmPaths merges prewarm results into warmPathsFile, dropping expired
+// entries and keeping at most maxWarmPaths of the most recently warmed.
+func recordWarmPaths(results []PrewarmResult) {
+	if len(results) == 0 {
+		return
+	}
+	warmPathsMu.Lock()
+	defer warmPathsMu.Unlock()
+
+	now := time.Now().UTC()
+	byPath := make(map[string]warmPath)
+	for _, e := range readWarmPaths() {
+		if now.Sub(e.LastWarmed) < warmPathTTL {
+			byPath[e.Path] = e
+		}
+	}
+	for _, r := range results {
+		byPath[r.Path] = warmPath{Path: r.Path, OK: r.OK(), LastWarmed: now}
+	}
+
+	entries := make([]warmPath, 0, len(byPath))
+	for _, e := range byPath {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].LastWarmed.Equal(entries[j].LastWarmed) {
+			return entries[i].LastWarmed.After(entries[j].LastWarmed)
+		}
+		return entries[i].Path < entries[j].Path
+	})
+	if len(entries) > maxWarmPaths {
+		entries = entries[:maxWarmPaths]
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		log.Printf("Failed to encode warm paths: %v", err)
+		return
+	}
+	if err := os.WriteFile(warmPathsFile, data, 0644); err != nil {
+		log.Printf("Failed to persist warm paths: %v", err)
+	}
+}
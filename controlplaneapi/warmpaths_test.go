@@ -0,0 +1,169 @@
+// warmpaths_test.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startPrewarmedDevServer starts a dev server without prewarm paths of its
+// own, waits for its prewarm to finish, and returns the paths warmed.
+func startPrewarmedDevServer(t *testing.T) []string {
+	t.Helper()
+	port := freePort(t)
+	type started struct {
+		pid    int
+		report *startReport
+		err    error
+	}
+	result := make(chan started, 1)
+	go func() {
+		pid, report, err := startDevServer(devStartOptions{
+			Port:    port,
+			Command: []string{"sh", "-c", "while :; do sleep 0.05; done"},
+			Prewarm: &PrewarmConfig{WaitForCompletion: true},
+		})
+		result <- started{pid, report, err}
+	}()
+
+	// The process only stands in for the server; once it has started, the
+	// test serves its port.
+	waitFor(t, "the dev server to start", func() bool {
+		devProcMu.Lock()
+		defer devProcMu.Unlock()
+		return devProc != nil
+	})
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &httptest.Server{Listener: ln, Config: &http.Server{Handler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})}}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	var r started
+	select {
+	case r = <-result:
+	case <-time.After(30 * time.Second):
+		t.Fatal("the start didn't finish")
+	}
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	done := ownedDevProcessDone(r.pid)
+	t.Cleanup(func() {
+		syscall.Kill(-r.pid, syscall.SIGKILL)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+		lastExitMu.Lock()
+		lastExit = nil
+		lastExitMu.Unlock()
+	})
+	var paths []string
+	if r.report.Prewarm != nil {
+		for _, res := range r.report.Prewarm.Results {
+			paths = append(paths, res.Path)
+		}
+	}
+	return paths
+}
+
+func TestPersistedWarmPathsUsedOnStart(t *testing.T) {
+	useAppDir(t)
+	useTestBroadcaster(t)
+	// As left behind by a previous control plane instance.
+	recordWarmPaths([]PrewarmResult{
+		{Path: "/dashboard", StatusCode: http.StatusOK},
+		{Path: "/broken", StatusCode: http.StatusInternalServerError},
+	})
+	if got := loadWarmPaths(); strings.Join(got, ",") != "/dashboard" {
+		t.Fatalf("got persisted paths %q, want only the one that warmed", got)
+	}
+
+	if got := startPrewarmedDevServer(t); strings.Join(got, ",") != "/dashboard" {
+		t.Errorf("warmed %q, want the persisted path", got)
+	}
+}
+
+func TestRecordWarmPathsCapsEntries(t *testing.T) {
+	useAppDir(t)
+	var results []PrewarmResult
+	for i := 0; i < maxWarmPaths+10; i++ {
+		results = append(results, PrewarmResult{Path: fmt.Sprintf("/p%02d", i), StatusCode: http.StatusOK})
+	}
+	recordWarmPaths(results[:10])
+	time.Sleep(10 * time.Millisecond) // So the rest warmed later.
+	recordWarmPaths(results[10:])
+
+	paths := loadWarmPaths()
+	if len(paths) != maxWarmPaths {
+		t.Fatalf("got %d paths, want %d", len(paths), maxWarmPaths)
+	}
+	for _, p := range paths {
+		if p < "/p10" {
+			t.Errorf("kept %s over a more recently warmed path", p)
+		}
+	}
+}
+
+func TestWarmPathsExpire(t *testing.T) {
+	useAppDir(t)
+	old := time.Now().Add(-warmPathTTL - time.Hour).UTC()
+	data, err := json.Marshal([]warmPath{
+		{Path: "/stale", OK: true, LastWarmed: old},
+		{Path: "/recent", OK: true, LastWarmed: time.Now().Add(-time.Hour).UTC()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(warmPathsFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadWarmPaths(); strings.Join(got, ",") != "/recent" {
+		t.Errorf("got %q, want the expired path left out", got)
+	}
+
+	// Recording drops the expired entry from the file too.
+	recordWarmPaths([]PrewarmResult{{Path: "/new", StatusCode: http.StatusOK}})
+	var entries []warmPath
+	data, _ = os.ReadFile(warmPathsFile)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Path == "/stale" {
+			t.Errorf("the expired path is still persisted: %s", data)
+		}
+	}
+	if len(entries) != 2 {
+		t.Errorf("got %s, want /new and /recent", data)
+	}
+}
+
+func TestDefaultWarmPathsWarmed(t *testing.T) {
+	useAppDir(t)
+	useTestBroadcaster(t)
+	saved := defaultPrewarmPaths
+	t.Cleanup(func() { defaultPrewarmPaths = saved })
+	defaultPrewarmPaths = []string{"/", "/about"}
+	recordWarmPaths([]PrewarmResult{
+		{Path: "/about", StatusCode: http.StatusOK},
+		{Path: "/dashboard", StatusCode: http.StatusOK},
+	})
+
+	// The defaults come first, and a persisted path that is also a default
+	// is only warmed once.
+	if got := startPrewarmedDevServer(t); strings.Join(got, ",") != "/,/about,/dashboard" {
+		t.Errorf("warmed %q, want the defaults then the persisted path", got)
+	}
+}
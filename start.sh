@@ -69,33 +69,52 @@ wait_for_http() {
 
 # 1. Start Go control-plane API in the background.
 echo "Starting Control Plane API service..."
+# Flags override the config file, so each is only passed when its variable is
+# set. nginx and the health wait below still need the ports, so those are
+# defaulted afterwards.
+CONTROL_PLANE_ARGS=()
+if [ -n "${CONTROL_PLANE_PORT:-}" ]; then
+  CONTROL_PLANE_ARGS+=(--listen-addr=":${CONTROL_PLANE_PORT}")
+fi
+if [ -n "${APP_DIR:-}" ]; then
+  CONTROL_PLANE_ARGS+=(--app-dir="${APP_DIR}")
+fi
+if [ -n "${DEFAULT_APP_PORT:-}" ]; then
+  CONTROL_PLANE_ARGS+=(--default-app-port="${DEFAULT_APP_PORT}")
+fi
 : "${CONTROL_PLANE_PORT:=8000}"
 : "${DEFAULT_APP_PORT:=3000}"
-: "${APP_DIR:=/app/applet}"
-
-/app/control-plane-api/control-plane-api \
-  --listen-addr=:${CONTROL_PLANE_PORT} \
-  --app-dir=${APP_DIR} \
-  --default-app-port=${DEFAULT_APP_PORT} &
+if [ -n "${CONTROL_PLANE_CONFIG:-}" ]; then
+  CONTROL_PLANE_ARGS+=(--config="${CONTROL_PLANE_CONFIG}")
+fi
+if [ -n "${HEALTH_MODE:-}" ]; then
+  CONTROL_PLANE_ARGS+=(--health-mode="${HEALTH_MODE}")
+fi
+if [ -n "${ALLOWED_ORIGINS:-}" ]; then
+  CONTROL_PLANE_ARGS+=(--allowed-origins="${ALLOWED_ORIGINS}")
+fi
+# The control plane starts the dev server itself once it is listening, so the
+# auth token it uses, wherever it comes from, never has to be known here.
+if [ "${START_DEV_SERVER:-true}" = "true" ]; then
+  CONTROL_PLANE_ARGS+=(--start-dev-server)
+fi
+
+/app/control-plane-api/control-plane-api "${CONTROL_PLANE_ARGS[@]}" &
 CONTROL_PLANE_PID=$!
 
-# 2. Wait for the control plane to become healthy.
+# 2. Wait for the control plane to become healthy. It starts the Node.js dev
+# server on its own; a failure to do so is in its log.
 wait_for_http "http://localhost:${CONTROL_PLANE_PORT}/health" 120 2 || { echo "Control plane failed to start"; exit 1; }
 
-# 3. Request that the control plane start the Node.js dev server.
-echo "Requesting app dev server start from Control Plane API..."
-curl -fsS --fail -X POST http://localhost:${CONTROL_PLANE_PORT}/dev/start \
-  -H 'Content-Type: application/json' || { echo "Failed to start app dev server via control plane. Check logs."; }
-
-# 4. Process the nginx config template.
+# 3. Process the nginx config template.
 envsubst '${NGINX_PORT} ${CONTROL_PLANE_PORT} ${DEFAULT_APP_PORT}' < /etc/nginx/nginx.conf.template > /etc/nginx/nginx.conf
 
-# 5. Start nginx in the background.
+# 4. Start nginx in the background.
 echo "Starting nginx..."
 nginx -g 'daemon off;' &
 NGINX_PID=$!
 
-# 6. Wait indefinitely. The trap handler will manage the shutdown.
+# 5. Wait indefinitely. The trap handler will manage the shutdown.
 echo "All services started. Waiting for signal to shut down."
 # This child process will be killed by the cleanup trap.
 tail -f /dev/null &